@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPathPrefix   = "/_immich-upload-optimizer"
+	adminPathPrefix = apiPathPrefix + "/admin"
+)
+
+// AdminServer exposes the administrative HTTP API guarded by a bearer token
+type AdminServer struct {
+	app       *AppConfig
+	mux       *http.ServeMux
+	server    *http.Server
+	logger    *customLogger
+	startedAt time.Time
+	closing   chan struct{}
+}
+
+// NewAdminServer creates an admin server for the application and registers the built-in endpoints
+func NewAdminServer(app *AppConfig, logger *customLogger) *AdminServer {
+	s := &AdminServer{
+		app:       app,
+		mux:       http.NewServeMux(),
+		logger:    logger,
+		startedAt: time.Now(),
+		closing:   make(chan struct{}),
+	}
+
+	s.HandleAdmin("GET /status", s.handleStatus)
+	s.HandleAdmin("GET /stats", s.handleStats)
+	s.HandleAdmin("GET /maintenance", s.handleGetMaintenance)
+	s.HandleAdmin("PUT /maintenance", s.handleSetMaintenance)
+	s.HandleAdmin("GET /queue", s.handleGetQueue)
+	s.HandleAdmin("PUT /queue", s.handleSetQueue)
+	s.HandleAdmin("GET /verification", s.handleGetVerification)
+	s.HandleAdmin("POST /verification", s.handleRunVerification)
+	s.HandleAdmin("GET /jobs", s.handleListJobs)
+	s.HandleAdmin("GET /jobs/{id}", s.handleGetJob)
+	s.HandleAdmin("POST /jobs/{id}/cancel", s.handleCancelJob)
+	s.HandleAdmin("GET /events", s.handleEvents)
+	s.HandleAdmin("GET /sessions", s.handleListSessions)
+	s.HandleAdmin("GET /history", s.handleGetHistory)
+	s.HandleAdmin("GET /history/stats", s.handleGetHistoryStats)
+	s.HandleAdmin("GET /dead-letter", s.handleGetDeadLetter)
+	s.HandleAdmin("GET /config", s.handleGetConfig)
+	s.HandleAdmin("POST /config/reload", s.handleReloadConfig)
+	s.HandleAdmin("GET /log-levels", s.handleGetLogLevels)
+	s.HandleAdmin("PUT /log-levels", s.handleSetLogLevels)
+	s.HandleAPI("POST /test-task/{name}", s.handleTestTask)
+	s.HandleAPI("POST /bulk-upload-check", s.handleBulkUploadCheck)
+	s.registerUI()
+
+	return s
+}
+
+// HandleAdmin registers an authenticated handler below the admin path prefix.
+// The pattern uses net/http syntax, e.g. "GET /jobs/{id}".
+func (s *AdminServer) HandleAdmin(pattern string, handler http.HandlerFunc) {
+	s.handle(adminPathPrefix, pattern, handler)
+}
+
+// HandleAPI registers an authenticated handler below the API path prefix
+func (s *AdminServer) HandleAPI(pattern string, handler http.HandlerFunc) {
+	s.handle(apiPathPrefix, pattern, handler)
+}
+
+func (s *AdminServer) handle(prefix, pattern string, handler http.HandlerFunc) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	s.mux.Handle(strings.TrimSpace(method+" "+prefix+path), s.authenticate(handler))
+}
+
+// Start begins serving the admin API in the background on every configured address
+func (s *AdminServer) Start() error {
+	var listeners []net.Listener
+	for _, address := range s.app.AdminListen {
+		listener, err := listenAddress(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	s.server = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	for _, listener := range listeners {
+		s.logger.Printf("Admin API listening on %s %s", listener.Addr(), adminPathPrefix)
+
+		go func(listener net.Listener) {
+			if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Printf("Admin API on %s stopped: %v", listener.Addr(), err)
+			}
+		}(listener)
+	}
+
+	return nil
+}
+
+// Stop shuts the admin server down, waiting for in-flight requests until ctx expires
+func (s *AdminServer) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	// End event streams, which would otherwise keep the shutdown waiting
+	close(s.closing)
+	return s.server.Shutdown(ctx)
+}
+
+// listenAddress opens a TCP listener, or a unix socket when address has the form unix:/path/to.sock
+func listenAddress(address string) (net.Listener, error) {
+	network := "tcp"
+	if socketPath, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", socketPath
+		// Remove a stale socket left behind by a previous run
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", address, err)
+	}
+
+	return listener, nil
+}
+
+// authenticate rejects requests that do not carry the configured bearer token
+func (s *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.app.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="immich-optimizer"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleStatus reports basic information about the running instance
+func (s *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":        version,
+		"commit":         commit,
+		"started_at":     s.startedAt.Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(s.startedAt).Seconds()),
+	})
+}
+
+// handleStats reports the collected runtime statistics
+func (s *AdminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.app.Stats.Snapshot()
+	if s.app.WorkDirs != nil {
+		usage := s.app.WorkDirs.Usage()
+		snapshot.Temp = &usage
+	}
+	if s.app.TempBudget != nil {
+		usage := s.app.TempBudget.Usage()
+		snapshot.Budget = &usage
+	}
+	if s.app.Queue != nil {
+		snapshot.Queue = &QueueStats{
+			Waiting:    s.app.Queue.Len(),
+			Limit:      s.app.Queue.Limit(),
+			Processing: s.app.Queue.Processing(),
+			Workers:    s.app.Workers,
+			Sources:    s.app.Queue.Sources(),
+			Paused:     s.app.Queue.PauseStatus().Paused,
+		}
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleGetMaintenance reports whether optimization is currently bypassed
+func (s *AdminServer) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.app.Maintenance.Status())
+}
+
+// handleSetMaintenance switches pass-through mode on or off without restarting
+func (s *AdminServer) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Enabled bool   `json:"enabled"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	if request.Enabled {
+		if request.Reason == "" {
+			request.Reason = "enabled via admin API"
+		}
+		s.app.Maintenance.Enable(request.Reason)
+		s.logger.Printf("Maintenance mode enabled, files will be uploaded without optimization: %s", request.Reason)
+	} else {
+		s.app.Maintenance.Disable()
+		s.logger.Printf("Maintenance mode disabled, optimization resumed")
+	}
+
+	writeJSON(w, http.StatusOK, s.app.Maintenance.Status())
+}
+
+// handleGetQueue reports whether the queue is paused
+func (s *AdminServer) handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	if s.app.Queue == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "the watcher is not running")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.app.Queue.PauseStatus())
+}
+
+// handleSetQueue pauses or resumes handing out queued files, letting the ones being processed finish
+func (s *AdminServer) handleSetQueue(w http.ResponseWriter, r *http.Request) {
+	if s.app.Queue == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "the watcher is not running")
+		return
+	}
+
+	var request struct {
+		Paused bool   `json:"paused"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	if request.Paused {
+		if request.Reason == "" {
+			request.Reason = "paused via admin API"
+		}
+		s.app.Queue.Pause(request.Reason)
+		s.logger.Printf("Queue paused, %d files being processed will finish: %s", s.app.Queue.Processing(), request.Reason)
+	} else {
+		s.app.Queue.Resume()
+		s.logger.Printf("Queue resumed, %d files waiting", s.app.Queue.Len())
+	}
+
+	writeJSON(w, http.StatusOK, s.app.Queue.PauseStatus())
+}
+
+// handleGetConfig reports the tasks file in use and the last failed reload
+func (s *AdminServer) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.app.Tasks.Status())
+}
+
+// handleReloadConfig reads the tasks file again, keeping the previous configuration when it is invalid
+func (s *AdminServer) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("Reloading %s via admin API", s.app.ConfigFile)
+	status, err := s.app.Tasks.Reload()
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleGetVerification reports the result of the last verification run
+func (s *AdminServer) handleGetVerification(w http.ResponseWriter, r *http.Request) {
+	if s.app.Verifier == nil {
+		writeJSONError(w, http.StatusNotFound, "verification is disabled, set -verify_interval")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"interval": s.app.VerifyInterval.String(),
+		"last":     s.app.Verifier.LastReport(),
+	})
+}
+
+// handleRunVerification verifies a sample right away and returns its report
+func (s *AdminServer) handleRunVerification(w http.ResponseWriter, r *http.Request) {
+	if s.app.Verifier == nil {
+		writeJSONError(w, http.StatusNotFound, "verification is disabled, set -verify_interval")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.app.Verifier.Run())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// handleListJobs lists the running and recently finished jobs, newest first, optionally filtered by ?state= and ?session=
+func (s *AdminServer) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	state := JobState(r.URL.Query().Get("state"))
+	switch state {
+	case "", JobQueued, JobProcessing, JobUploading, JobDone, JobFailed, JobCancelled:
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown job state %q", state))
+		return
+	}
+
+	jobs := s.app.Jobs.List(state)
+	if session := r.URL.Query().Get("session"); session != "" {
+		jobs = slices.DeleteFunc(jobs, func(job Job) bool {
+			return job.Session != session
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+// handleListSessions reports the progress and savings of the upload sessions, most recent first
+func (s *AdminServer) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": s.app.Sessions.List()})
+}
+
+// handleGetJob reports a single job
+func (s *AdminServer) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.app.Jobs.Get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("job %s not found", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleCancelJob stops a queued or processing job, optionally forwarding its original file unmodified
+func (s *AdminServer) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ForwardOriginal bool `json:"forward_original"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	id := r.PathValue("id")
+	job, err := s.app.Jobs.Cancel(id, request.ForwardOriginal)
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("job %s not found", id))
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("job %s is %s: %v", id, job.State, err))
+		return
+	}
+
+	s.logger.Printf("Cancelled job %s for %s", id, job.Path)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleGetHistory lists the most recently finished jobs, up to ?limit= (default 100)
+func (s *AdminServer) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if s.app.History == nil {
+		writeJSONError(w, http.StatusNotFound, "the job history is disabled, set -store or -hash_db")
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", value))
+			return
+		}
+		limit = parsed
+	}
+
+	records, err := s.app.History.Recent(limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("unable to read the job history: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": records})
+}
+
+// handleGetDeadLetter lists the files moved aside after failing processing repeatedly, most recent first
+func (s *AdminServer) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if s.app.DeadLetter == nil {
+		writeJSONError(w, http.StatusNotFound, "dead-lettering is disabled, set -dead_letter_after")
+		return
+	}
+
+	records, err := s.app.DeadLetter.List()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("unable to read the dead-letter directory: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": records})
+}
+
+// handleGetHistoryStats aggregates the job history overall, by source folder, Immich user and task
+func (s *AdminServer) handleGetHistoryStats(w http.ResponseWriter, r *http.Request) {
+	if s.app.History == nil {
+		writeJSONError(w, http.StatusNotFound, "the job history is disabled, set -store or -hash_db")
+		return
+	}
+
+	stats, err := s.app.History.Stats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("unable to read the job history: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleGetLogLevels reports the log level of every subsystem
+func (s *AdminServer) handleGetLogLevels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevels.Snapshot())
+}
+
+// handleSetLogLevels changes the log level of the subsystems in the body, e.g. {"watcher": "debug"},
+// without restarting. The key "*" applies to every subsystem.
+func (s *AdminServer) handleSetLogLevels(w http.ResponseWriter, r *http.Request) {
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	levels := make(map[string]LogLevel, len(request))
+	for subsystem, value := range request {
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if subsystem == "*" {
+			subsystem = ""
+		} else if !slices.Contains(logSubsystems, subsystem) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown log subsystem %q, expected one of %s", subsystem, strings.Join(logSubsystems, ", ")))
+			return
+		}
+		levels[subsystem] = level
+	}
+
+	// Apply "*" first so individual subsystems in the same request take precedence
+	if level, ok := levels[""]; ok {
+		logLevels.Set("", level)
+	}
+	for subsystem, level := range levels {
+		if subsystem != "" {
+			logLevels.Set(subsystem, level)
+		}
+	}
+
+	s.logger.Printf("Log levels changed: %v", request)
+	writeJSON(w, http.StatusOK, logLevels.Snapshot())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bulkUploadCheckRequest mirrors the body of Immich's POST /api/assets/bulk-upload-check
+type bulkUploadCheckRequest struct {
+	Assets []struct {
+		ID       string `json:"id"`
+		Checksum string `json:"checksum"`
+	} `json:"assets"`
+}
+
+// bulkUploadCheckResult mirrors one entry of Immich's bulk-upload-check response,
+// extended with the checksum of the file Immich actually stored
+type bulkUploadCheckResult struct {
+	ID               string `json:"id"`
+	Action           string `json:"action"`
+	Reason           string `json:"reason,omitempty"`
+	AssetID          string `json:"assetId,omitempty"`
+	UploadedChecksum string `json:"uploadedChecksum,omitempty"`
+}
+
+// handleBulkUploadCheck answers a bulk-upload-check with the checksums of originals already uploaded, for
+// operators and scripts holding the admin token to find out which originals reached Immich under another
+// checksum. Immich clients never call it: they check their files against Immich itself.
+func (s *AdminServer) handleBulkUploadCheck(w http.ResponseWriter, r *http.Request) {
+	if s.app.HashDB == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "checksum mapping requires a hash database or store")
+		return
+	}
+
+	var request bulkUploadCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	results := make([]bulkUploadCheckResult, 0, len(request.Assets))
+	for _, asset := range request.Assets {
+		result := bulkUploadCheckResult{ID: asset.ID, Action: "accept"}
+
+		record, ok, err := s.app.HashDB.Lookup(normalizeChecksum(asset.Checksum))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if ok {
+			result.Action = "reject"
+			result.Reason = "duplicate"
+			result.AssetID = record.AssetID
+			result.UploadedChecksum = record.UploadedChecksum
+		}
+
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// normalizeChecksum converts a SHA1 checksum sent as base64, as the Immich mobile app does, to lowercase hex
+func normalizeChecksum(checksum string) string {
+	if decoded, err := base64.StdEncoding.DecodeString(checksum); err == nil && len(decoded) == 20 {
+		return hex.EncodeToString(decoded)
+	}
+	return strings.ToLower(checksum)
+}
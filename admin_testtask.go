@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// testTaskMaxMemory is the part of an uploaded sample kept in memory, the rest is spooled to disk
+const testTaskMaxMemory = 32 << 20
+
+// handleTestTask runs a single task against an uploaded sample and returns the processed output
+// without uploading anything to Immich
+func (s *AdminServer) handleTestTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.findTask(r.PathValue("name"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("task %s not found", r.PathValue("name")))
+		return
+	}
+
+	if err := r.ParseMultipartForm(testTaskMaxMemory); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse form: %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("missing file form field: %v", err))
+		return
+	}
+	defer file.Close()
+
+	filename, err := sampleFilename(header.Filename)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sampleDir, err := os.MkdirTemp("", "test-task-*")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create temp folder: %v", err))
+		return
+	}
+	s.app.WorkDirs.Track(sampleDir)
+	defer s.app.WorkDirs.Untrack(sampleDir)
+	defer os.RemoveAll(sampleDir)
+
+	samplePath := filepath.Join(sampleDir, filename)
+	if err := saveUploadedSample(file, samplePath); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tp, err := NewTaskProcessor(samplePath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tp.Close()
+
+	tp.SetLogger(newCustomLogger(s.logger, fmt.Sprintf("test-task %s: ", task.Name)).Subsystem(logTasks))
+	tp.SetSlots(s.app.Slots, true)
+	tp.SetLimits(s.app.Tasks.Config().Limits)
+	tp.SetTimeout(s.app.Tasks.Config().timeout)
+	tp.SetResources(s.app.Tasks.Config().Resources)
+	tp.SetBuiltin(s.app.Tasks.Config().Builtin)
+	tp.SetOutputValidation(s.app.Tasks.Config().ValidateOutput)
+	tp.SetLivePhotos(s.app.Tasks.Config().LivePhotos)
+	tp.SetConfigDir(filepath.Dir(s.app.ConfigFile))
+	tp.SetWorkDirGC(s.app.WorkDirs)
+	tp.SetTempBudget(s.app.TempBudget)
+	tp.SetRemote(s.app.RemoteWorker)
+
+	start := time.Now()
+	// The request context is cancelled when the client disconnects, killing the running command
+	if err := tp.Process(r.Context(), []Task{task}); err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, ErrInsufficientTempSpace) || errors.Is(err, ErrTempUnavailable) || errors.Is(err, ErrTempBudgetExceeded) {
+			status = http.StatusInsufficientStorage
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	elapsed := time.Since(start)
+
+	if tp.ProcessedFile == nil {
+		writeJSONError(w, http.StatusInternalServerError, "task produced no output")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tp.ProcessedFilename))
+	w.Header().Set("Content-Length", strconv.FormatInt(tp.ProcessedSize, 10))
+	w.Header().Set("X-Optimizer-Task", task.Name)
+	w.Header().Set("X-Optimizer-Original-Size", strconv.FormatInt(tp.OriginalSize, 10))
+	w.Header().Set("X-Optimizer-Processed-Size", strconv.FormatInt(tp.ProcessedSize, 10))
+	w.Header().Set("X-Optimizer-Duration-Ms", strconv.FormatInt(elapsed.Milliseconds(), 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, tp.ProcessedFile); err != nil {
+		s.logger.Errorf("Error sending test-task output: %v", err)
+	}
+}
+
+// findTask looks up a configured task by name
+func (s *AdminServer) findTask(name string) (Task, bool) {
+	for _, task := range s.app.Tasks.Config().Tasks {
+		if task.Name == name {
+			return task, true
+		}
+	}
+	return Task{}, false
+}
+
+// sampleFilename returns the name an uploaded sample is saved under, the last element of the name the
+// client sent, which tasks are matched by. Names that do not name a file are rejected.
+func sampleFilename(name string) (string, error) {
+	switch base := filepath.Base(name); base {
+	case ".", "..", "/":
+		return "", fmt.Errorf("the file form field needs a filename, e.g. sample.jpg")
+	default:
+		return base, nil
+	}
+}
+
+func saveUploadedSample(src io.Reader, destPath string) error {
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to create sample file: %w", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("unable to write sample file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestSampleFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"sample.jpg", "sample.jpg", false},
+		{"photos/2024/IMG_0001.HEIC", "IMG_0001.HEIC", false},
+		{"../../etc/passwd.jpg", "passwd.jpg", false},
+		{"", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{"/", "", true},
+		{"photos/..", "", true},
+	}
+	for _, tt := range tests {
+		got, err := sampleFilename(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sampleFilename(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
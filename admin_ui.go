@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// registerUI serves the dashboard below the API path prefix. The page itself holds no data and is served
+// without authentication; it asks for the admin token and sends it with every API request.
+func (s *AdminServer) registerUI() {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	s.mux.Handle("GET "+apiPathPrefix+"/ui/", http.StripPrefix(apiPathPrefix+"/ui/", http.FileServerFS(files)))
+}
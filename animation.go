@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// animationDurationTolerance is how much the duration of an optimized animation may differ from the original
+const animationDurationTolerance = 100 * time.Millisecond
+
+// Animation is the number of frames and the duration of one loop of an animated image
+type Animation struct {
+	Frames   int
+	Duration time.Duration
+}
+
+// isAnimated reports whether an image has more than one frame: an animated GIF, APNG, WebP or AVIF
+func isAnimated(filePath, mimeType string) bool {
+	if mimeType == "image/avif" {
+		return hasAVIFSequenceBrand(filePath)
+	}
+	if !animatedMimeType(mimeType) {
+		return false
+	}
+	animation, err := readAnimation(filePath, mimeType)
+	return err == nil && animation.Frames > 1
+}
+
+// animatedMimeType reports whether the frames of an image format are counted by reading the file itself
+func animatedMimeType(mimeType string) bool {
+	switch mimeType {
+	case "image/gif", "image/png", "image/apng", "image/webp":
+		return true
+	}
+	return false
+}
+
+// hasAVIFSequenceBrand reports whether an AVIF file is an image sequence, which its avis brand tells
+func hasAVIFSequenceBrand(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLength)
+	n, _ := file.Read(head)
+	return n >= 12 && string(head[4:8]) == "ftyp" && bytes.Contains(head[8:n], []byte("avis"))
+}
+
+// readAnimation returns the frames and the duration of an image: from the file itself for GIF, PNG and
+// WebP, with ffprobe for other formats such as AVIF
+func readAnimation(filePath, mimeType string) (Animation, error) {
+	if !animatedMimeType(mimeType) {
+		frames, err := probeVideoFrames(filePath)
+		if err != nil {
+			return Animation{}, err
+		}
+		return Animation{Frames: int(frames), Duration: probeDuration(filePath)}, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return Animation{}, fmt.Errorf("unable to read file: %w", err)
+	}
+	switch mimeType {
+	case "image/gif":
+		return gifAnimation(data)
+	case "image/webp":
+		return webpAnimation(data)
+	default:
+		return pngAnimation(data)
+	}
+}
+
+// gifAnimation counts the image descriptors of a GIF and adds up the delays of their graphic control extensions
+func gifAnimation(data []byte) (Animation, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF")) {
+		return Animation{}, fmt.Errorf("invalid GIF header")
+	}
+
+	var animation Animation
+	pos, delay := 13, 0
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			if pos+6 <= len(data) && data[pos+1] == 0xF9 {
+				delay = int(binary.LittleEndian.Uint16(data[pos+4:]))
+			}
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2C:
+			animation.Frames++
+			animation.Duration += time.Duration(delay) * 10 * time.Millisecond
+			delay = 0
+			if pos+10 > len(data) {
+				return animation, nil
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// The LZW minimum code size precedes the image data
+			pos = skipGIFSubBlocks(data, pos+1)
+		case 0x3B:
+			return animation, nil
+		default:
+			return animation, fmt.Errorf("invalid GIF block 0x%02x", data[pos])
+		}
+	}
+	return animation, nil
+}
+
+// skipGIFSubBlocks returns the position after the sub-blocks starting at pos and their terminator
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+// pngAnimation counts the frame controls of an APNG and adds up their delays. A PNG without an animation
+// control is a single frame.
+func pngAnimation(data []byte) (Animation, error) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return Animation{}, fmt.Errorf("invalid PNG signature")
+	}
+
+	var animation Animation
+	animated := false
+	for pos := 8; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		body := data[pos+8 : min(pos+8+size, len(data))]
+		switch kind {
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(body) >= 26 {
+				numerator, denominator := binary.BigEndian.Uint16(body[20:]), binary.BigEndian.Uint16(body[22:])
+				if denominator == 0 {
+					denominator = 100
+				}
+				animation.Frames++
+				animation.Duration += time.Duration(numerator) * time.Second / time.Duration(denominator)
+			}
+		case "IEND":
+			pos = len(data)
+		}
+		pos += 12 + size
+	}
+	if !animated {
+		return Animation{Frames: 1}, nil
+	}
+	return animation, nil
+}
+
+// webpAnimation counts the frames of an animated WebP and adds up their durations. A WebP without frames
+// is a single image.
+func webpAnimation(data []byte) (Animation, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return Animation{}, fmt.Errorf("invalid WebP header")
+	}
+
+	var animation Animation
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if string(data[pos:pos+4]) == "ANMF" && pos+8+16 <= len(data) {
+			duration := int(data[pos+20]) | int(data[pos+21])<<8 | int(data[pos+22])<<16
+			animation.Frames++
+			animation.Duration += time.Duration(duration) * time.Millisecond
+		}
+		// Chunks are padded to an even size
+		pos += 8 + size + size&1
+	}
+	if animation.Frames == 0 {
+		return Animation{Frames: 1}, nil
+	}
+	return animation, nil
+}
+
+// validateAnimation checks that the primary output of a task on an animated image still animates, with the
+// frames of the original and as long within animationDurationTolerance, so a command flattening it to its
+// first frame does not replace it. Formats ffprobe has to count are not checked when it is not installed.
+func (tp *TaskProcessor) validateAnimation(task *Task) error {
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+
+	mimeType, err := sniffMimeType(output)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "video/") {
+		return fmt.Errorf("the result of an animated image is %s", mimeType)
+	}
+
+	original, err := readAnimation(tp.OriginalFile.Name(), tp.Media.MimeType)
+	if err == nil {
+		var optimized Animation
+		if optimized, err = readAnimation(output, mimeType); err == nil {
+			return tp.compareAnimation(task, original, optimized)
+		}
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		tp.logf("task %s: unable to check the animation without ffprobe", task.Name)
+		return nil
+	}
+	return fmt.Errorf("unable to read the animation: %w", err)
+}
+
+// compareAnimation fails when the result of a task has other frames than the original or lasts longer or
+// shorter
+func (tp *TaskProcessor) compareAnimation(task *Task, original, optimized Animation) error {
+	if optimized.Frames != original.Frames {
+		return fmt.Errorf("the result has %d frames instead of %d", optimized.Frames, original.Frames)
+	}
+	if original.Duration > 0 && (optimized.Duration-original.Duration).Abs() > animationDurationTolerance {
+		return fmt.Errorf("the result lasts %s instead of %s", optimized.Duration, original.Duration)
+	}
+	tp.debugf("task %s: animation validated, %d frames over %s", task.Name, optimized.Frames, optimized.Duration)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// defaultBuiltinJPEGQuality is the quality of JPEG files re-encoded by the built-in encoder
+const defaultBuiltinJPEGQuality = 85
+
+// commandNotFoundExitCode is the exit status of sh when a command does not exist
+const commandNotFoundExitCode = 127
+
+// pngSignature starts every PNG file
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// BuiltinEncoder re-encodes JPEG and PNG files with the Go standard library when the command of a task
+// cannot run because a tool it uses is not installed, so a container lacking e.g. cwebp still optimizes
+// images instead of failing every upload. Capture dates and color profiles are carried over.
+type BuiltinEncoder struct {
+	Fallback bool `mapstructure:"fallback"`
+	// JPEGQuality is the quality of re-encoded JPEG files, from 1 to 100 (default 85)
+	JPEGQuality int `mapstructure:"jpeg_quality"`
+	// MaxDimension downscales images whose width or height is larger, 0 keeps the resolution
+	MaxDimension int `mapstructure:"max_dimension"`
+}
+
+func (b *BuiltinEncoder) Init() error {
+	if b.JPEGQuality == 0 {
+		b.JPEGQuality = defaultBuiltinJPEGQuality
+	}
+	if b.JPEGQuality < 1 || b.JPEGQuality > 100 {
+		return fmt.Errorf("jpeg_quality must be between 1 and 100")
+	}
+	if b.MaxDimension < 0 {
+		return fmt.Errorf("max_dimension must not be negative")
+	}
+	return nil
+}
+
+// Supports reports whether the fallback is enabled and able to re-encode files of the content type
+func (b BuiltinEncoder) Supports(mimeType string) bool {
+	return b.Fallback && (mimeType == "image/jpeg" || mimeType == "image/png")
+}
+
+// Encode re-encodes the image at src into dstDir under the same name
+func (b BuiltinEncoder) Encode(src, dstDir string) error {
+	original, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("unable to read image: %w", err)
+	}
+	if bytes.HasPrefix(original, pngSignature) && pngChunks(original, "acTL") != nil {
+		return fmt.Errorf("animated PNG files are not supported by the built-in encoder")
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return fmt.Errorf("unable to decode image: %w", err)
+	}
+	if b.MaxDimension > 0 {
+		img = downscale(img, b.MaxDimension)
+	}
+
+	var encoded bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: b.JPEGQuality}); err != nil {
+			return fmt.Errorf("unable to encode JPEG: %w", err)
+		}
+		err = writeWithMetadata(filepath.Join(dstDir, filepath.Base(src)), encoded.Bytes(), 2, jpegMetadata(original))
+	case "png":
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&encoded, img); err != nil {
+			return fmt.Errorf("unable to encode PNG: %w", err)
+		}
+		// The metadata chunks go right after the IHDR chunk, ahead of the palette and the image data
+		err = writeWithMetadata(filepath.Join(dstDir, filepath.Base(src)), encoded.Bytes(), len(pngSignature)+25, pngChunks(original, "iCCP", "sRGB", "gAMA", "cHRM", "pHYs", "eXIf", "tIME", "tEXt", "zTXt", "iTXt"))
+	default:
+		return fmt.Errorf("%s files are not supported by the built-in encoder", format)
+	}
+	return err
+}
+
+// writeWithMetadata writes the encoded image with the metadata inserted at offset
+func writeWithMetadata(dst string, encoded []byte, offset int, metadata []byte) error {
+	data := make([]byte, 0, len(encoded)+len(metadata))
+	data = append(data, encoded[:offset]...)
+	data = append(data, metadata...)
+	data = append(data, encoded[offset:]...)
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write image: %w", err)
+	}
+	return nil
+}
+
+// jpegMetadata returns the EXIF, XMP and ICC profile segments of a JPEG file, which the standard library
+// encoder does not write
+func jpegMetadata(data []byte) []byte {
+	var metadata []byte
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		// Start of scan, the entropy-coded image data follows
+		if marker == 0xDA {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			break
+		}
+		if marker == 0xE1 || marker == 0xE2 {
+			metadata = append(metadata, data[pos:end]...)
+		}
+		pos = end
+	}
+	return metadata
+}
+
+// pngChunks returns the chunks of the given types of a PNG file, or nil when there are none
+func pngChunks(data []byte, types ...string) []byte {
+	var chunks []byte
+	for pos := len(pngSignature); pos+8 <= len(data); {
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos {
+			break
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		for _, t := range types {
+			if chunkType == t {
+				chunks = append(chunks, data[pos:end]...)
+			}
+		}
+		if chunkType == "IEND" {
+			break
+		}
+		pos = end
+	}
+	return chunks
+}
+
+// downscale shrinks an image with a box filter so neither side is larger than maxDimension
+func downscale(src image.Image, maxDimension int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxDimension && height <= maxDimension {
+		return src
+	}
+
+	scale := float64(maxDimension) / float64(max(width, height))
+	dstWidth := max(1, int(math.Round(float64(width)*scale)))
+	dstHeight := max(1, int(math.Round(float64(height)*scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := range dstHeight {
+		y0, y1 := y*height/dstHeight, max((y+1)*height/dstHeight, y*height/dstHeight+1)
+		for x := range dstWidth {
+			x0, x1 := x*width/dstWidth, max((x+1)*width/dstWidth, x*width/dstWidth+1)
+
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n >> 8)
+			dst.Pix[offset+1] = uint8(g / n >> 8)
+			dst.Pix[offset+2] = uint8(b / n >> 8)
+			dst.Pix[offset+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// isCommandNotFound reports whether a command failed because a tool it runs is not installed
+func isCommandNotFound(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.Is(err, exec.ErrNotFound) || errors.As(err, &exitErr) && exitErr.ExitCode() == commandNotFoundExitCode
+}
+
+// runBuiltin re-encodes the working copy with the built-in encoder, waiting for a slot like a command
+func (tp *TaskProcessor) runBuiltin(ctx context.Context, task *Task, srcPath string) error {
+	release, err := tp.acquire(ctx, task.PoolName(tp.Media), false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := resetDir(tp.tempWorkDirDst); err != nil {
+		return classifyTempError(err)
+	}
+	tp.logf("task %s: re-encoding with the built-in encoder", task.Name)
+	return tp.builtin.Encode(srcPath, tp.tempWorkDirDst)
+}
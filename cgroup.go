@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrMemoryLimitExceeded is returned when a command was killed for using more memory than memory_max
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+
+// ResourceLimits caps the CPU share and memory of every command, so a runaway encoder cannot starve or
+// OOM the Immich server on the same host. Commands run in a transient cgroup v2 below Cgroup, which has
+// to be delegated to the optimizer. Zero values disable the corresponding limit.
+type ResourceLimits struct {
+	// Cgroup is the cgroup v2 directory the cgroups of the commands are created in, set globally
+	Cgroup string `mapstructure:"cgroup"`
+	// CPUWeight is the share of CPU time relative to other cgroups, from 1 to 10000, 100 being the default
+	CPUWeight int `mapstructure:"cpu_weight"`
+	// MemoryMax is the memory a command and its children may use before being killed, e.g. 2GB
+	MemoryMax string `mapstructure:"memory_max"`
+	memoryMax int64
+}
+
+func (r *ResourceLimits) Init() (err error) {
+	if r.CPUWeight != 0 && (r.CPUWeight < 1 || r.CPUWeight > 10000) {
+		return fmt.Errorf("cpu_weight must be between 1 and 10000")
+	}
+	if r.MemoryMax != "" {
+		if r.memoryMax, err = parseSize(r.MemoryMax); err != nil {
+			return fmt.Errorf("memory_max: %v", err)
+		}
+		if r.memoryMax <= 0 {
+			return fmt.Errorf("memory_max must be positive")
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether any limit is set
+func (r ResourceLimits) Enabled() bool {
+	return r.CPUWeight > 0 || r.memoryMax > 0
+}
+
+// override returns the limits with those set in other taking precedence
+func (r ResourceLimits) override(other ResourceLimits) ResourceLimits {
+	if other.CPUWeight != 0 {
+		r.CPUWeight = other.CPUWeight
+	}
+	if other.MemoryMax != "" {
+		r.MemoryMax, r.memoryMax = other.MemoryMax, other.memoryMax
+	}
+	return r
+}
+
+// commandCgroup is the transient cgroup a single command runs in
+type commandCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newCommandCgroup creates a cgroup with the limits below the configured parent, enabling the controllers
+// it needs there first
+func newCommandCgroup(limits ResourceLimits) (*commandCgroup, error) {
+	var controllers []string
+	if limits.CPUWeight > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if limits.memoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if err := os.WriteFile(filepath.Join(limits.Cgroup, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0); err != nil {
+		return nil, fmt.Errorf("unable to enable cgroup controllers in %s: %w", limits.Cgroup, err)
+	}
+
+	path, err := os.MkdirTemp(limits.Cgroup, "task-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cgroup: %w", err)
+	}
+	cg := &commandCgroup{path: path}
+
+	if limits.CPUWeight > 0 {
+		err = cg.write("cpu.weight", strconv.Itoa(limits.CPUWeight))
+	}
+	if err == nil && limits.memoryMax > 0 {
+		err = cg.write("memory.max", strconv.FormatInt(limits.memoryMax, 10))
+	}
+	if err == nil {
+		cg.dir, err = os.Open(path)
+	}
+	if err != nil {
+		cg.Remove()
+		return nil, fmt.Errorf("unable to set up cgroup: %w", err)
+	}
+	return cg, nil
+}
+
+func (cg *commandCgroup) write(file, value string) error {
+	return os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0)
+}
+
+// Apply starts the command directly inside the cgroup
+func (cg *commandCgroup) Apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+}
+
+// OOMKilled reports whether a process of the cgroup was killed for exceeding memory.max
+func (cg *commandCgroup) OOMKilled() bool {
+	events, err := os.ReadFile(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if count, found := strings.CutPrefix(line, "oom_kill "); found {
+			return count != "0"
+		}
+	}
+	return false
+}
+
+// Remove kills what is left in the cgroup, such as daemonized children, and deletes it
+func (cg *commandCgroup) Remove() error {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+	// cgroup.kill needs Linux 5.14, a cgroup that still has processes then fails to be removed below
+	cg.write("cgroup.kill", "1")
+	return os.Remove(cg.path)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ColorSDR is standard dynamic range in the sRGB or BT.709 gamut, also assumed when the color of a file
+	// could not be probed
+	ColorSDR = "sdr"
+	// ColorHDR10 is HDR video with the PQ transfer of HDR10 and HDR10+
+	ColorHDR10 = "hdr10"
+	// ColorHLG is HDR video with the hybrid log-gamma transfer
+	ColorHLG = "hlg"
+	// ColorDolbyVision is video with a Dolby Vision configuration
+	ColorDolbyVision = "dolby_vision"
+	// ColorWideGamut is an image in a gamut wider than sRGB, such as Display P3, or of more than 8 bits, or
+	// SDR video in the BT.2020 gamut
+	ColorWideGamut = "wide_gamut"
+
+	// ColorSafeguardProtect runs only tasks listing their color in color_profiles on files that are not SDR,
+	// uploading the others as-is
+	ColorSafeguardProtect = "protect"
+	// ColorSafeguardOff runs tasks on every file whatever its color
+	ColorSafeguardOff = "off"
+)
+
+var colorProfiles = []string{ColorSDR, ColorHDR10, ColorHLG, ColorDolbyVision, ColorWideGamut}
+
+// initColorProfiles checks the color profiles of a task. Under the protect safeguard, a task without any
+// only runs on SDR files; otherwise on every file.
+func (task *Task) initColorProfiles(safeguard string) error {
+	for i, profile := range task.ColorProfiles {
+		task.ColorProfiles[i] = strings.ToLower(profile)
+		if !slices.Contains(colorProfiles, task.ColorProfiles[i]) {
+			return fmt.Errorf("task %s color_profiles: %q is not one of %s", task.Name, profile, strings.Join(colorProfiles, ", "))
+		}
+	}
+
+	task.colorProfiles = task.ColorProfiles
+	if len(task.colorProfiles) == 0 && safeguard == ColorSafeguardProtect {
+		task.colorProfiles = []string{ColorSDR}
+	}
+	return nil
+}
+
+// matchesColor reports whether the task runs on files of the color of media
+func (task *Task) matchesColor(media MediaInfo) bool {
+	if len(task.colorProfiles) == 0 {
+		return true
+	}
+	color := media.Color
+	if color == "" {
+		color = ColorSDR
+	}
+	return slices.Contains(task.colorProfiles, color)
+}
+
+// needsColor reports whether any task depends on the color of files, which requires probing them
+func needsColor(tasks []Task) bool {
+	for _, task := range tasks {
+		if len(task.colorProfiles) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// probeMediaColor adds the color of the file to media, leaving it empty when it cannot be determined: for
+// videos with ffprobe, for images with exiftool. Without the tool, every file is taken for SDR.
+func probeMediaColor(filePath string, media MediaInfo) (MediaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case strings.HasPrefix(media.MimeType, "video/"):
+		media.Color, err = probeVideoColor(ctx, filePath)
+	case strings.HasPrefix(media.MimeType, "image/"):
+		media.Color, err = probeImageColor(ctx, filePath)
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return media, nil
+	}
+	return media, err
+}
+
+// probeVideoColor tells the color of the first video stream from its transfer characteristics, primaries
+// and Dolby Vision side data
+func probeVideoColor(ctx context.Context, filePath string) (string, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=color_transfer,color_primaries:stream_side_data=side_data_type", "-of", "json", filePath).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to probe video color: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			ColorTransfer  string `json:"color_transfer"`
+			ColorPrimaries string `json:"color_primaries"`
+			SideData       []struct {
+				Type string `json:"side_data_type"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return "", fmt.Errorf("unable to parse ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return "", nil
+	}
+
+	stream := probe.Streams[0]
+	for _, sideData := range stream.SideData {
+		if strings.HasPrefix(sideData.Type, "DOVI") {
+			return ColorDolbyVision, nil
+		}
+	}
+	switch {
+	case stream.ColorTransfer == "smpte2084":
+		return ColorHDR10, nil
+	case stream.ColorTransfer == "arib-std-b67":
+		return ColorHLG, nil
+	case strings.HasPrefix(stream.ColorPrimaries, "bt2020"):
+		return ColorWideGamut, nil
+	}
+	return ColorSDR, nil
+}
+
+// wideGamutProfiles are parts of the descriptions of ICC profiles wider than sRGB
+var wideGamutProfiles = []string{"p3", "2020", "2100", "adobe rgb", "prophoto"}
+
+// probeImageColor tells whether an image is wide gamut from the description of its ICC profile and its bit
+// depth, as read by exiftool from JPEG, PNG, HEIC and AVIF files alike
+func probeImageColor(ctx context.Context, filePath string) (string, error) {
+	tags, err := readTags(ctx, []string{"ProfileDescription", "BitsPerSample", "BitDepth", "ImagePixelDepth"}, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	description, _ := tags[0]["ProfileDescription"].(string)
+	for _, profile := range wideGamutProfiles {
+		if strings.Contains(strings.ToLower(description), profile) {
+			return ColorWideGamut, nil
+		}
+	}
+	for _, tag := range []string{"BitsPerSample", "BitDepth", "ImagePixelDepth"} {
+		if bitDepth(tags[0][tag]) > 8 {
+			return ColorWideGamut, nil
+		}
+	}
+	return ColorSDR, nil
+}
+
+// bitDepth returns the largest of the bits per sample exiftool reports, a number or a list such as "10 10 10"
+func bitDepth(value any) int {
+	switch value := value.(type) {
+	case float64:
+		return int(value)
+	case string:
+		depth := 0
+		for _, field := range strings.Fields(value) {
+			if n, err := strconv.Atoi(field); err == nil {
+				depth = max(depth, n)
+			}
+		}
+		return depth
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// commandMedia is what the functions of a command template know about the file being processed
+type commandMedia interface {
+	mediaDimensions() (width, height int64)
+	mediaBitrate() int64
+	mediaDuration() time.Duration
+}
+
+// sampleMedia stands in for a file when a command template is checked at startup
+type sampleMedia struct{}
+
+func (sampleMedia) mediaDimensions() (int64, int64) { return 1920, 1080 }
+func (sampleMedia) mediaBitrate() int64             { return 8_000_000 }
+func (sampleMedia) mediaDuration() time.Duration    { return time.Minute }
+
+// commandFuncs returns the functions available in task commands. The file is only probed for the values
+// a command uses, a value that cannot be probed is 0.
+func commandFuncs(media commandMedia) template.FuncMap {
+	return template.FuncMap{
+		"add": func(a, b any) (any, error) { return arithmetic(a, b, func(x, y float64) float64 { return x + y }) },
+		"sub": func(a, b any) (any, error) { return arithmetic(a, b, func(x, y float64) float64 { return x - y }) },
+		"mul": func(a, b any) (any, error) { return arithmetic(a, b, func(x, y float64) float64 { return x * y }) },
+		"div": func(a, b any) (any, error) {
+			if y, err := toFloat(b); err != nil || y == 0 {
+				return nil, fmt.Errorf("div by %v", b)
+			}
+			return arithmetic(a, b, func(x, y float64) float64 { return x / y })
+		},
+		"min":   func(a, b any) (any, error) { return arithmetic(a, b, math.Min) },
+		"max":   func(a, b any) (any, error) { return arithmetic(a, b, math.Max) },
+		"round": func(a any) (any, error) { return arithmetic(a, 0, func(x, _ float64) float64 { return math.Round(x) }) },
+		// interpolate maps x from the range x0 to x1 onto y0 to y1, clamped to the ends, e.g. a quality
+		// falling from 90 at 2 megapixels to 70 at 24 megapixels
+		"interpolate": func(x, x0, y0, x1, y1 any) (any, error) {
+			values := make([]float64, 5)
+			for i, value := range []any{x, x0, y0, x1, y1} {
+				var err error
+				if values[i], err = toFloat(value); err != nil {
+					return nil, err
+				}
+			}
+			if values[1] == values[3] {
+				return nil, fmt.Errorf("interpolate over an empty range")
+			}
+			t := math.Max(0, math.Min(1, (values[0]-values[1])/(values[3]-values[1])))
+			return number(values[2] + t*(values[4]-values[2])), nil
+		},
+		"env":   os.Getenv,
+		"quote": shellQuote,
+		"width": func() int64 {
+			width, _ := media.mediaDimensions()
+			return width
+		},
+		"height": func() int64 {
+			_, height := media.mediaDimensions()
+			return height
+		},
+		"megapixels": func() any {
+			width, height := media.mediaDimensions()
+			return number(math.Round(float64(width*height)/1e4) / 100)
+		},
+		"bitrate":  media.mediaBitrate,
+		"duration": func() any { return number(media.mediaDuration().Seconds()) },
+	}
+}
+
+// arithmetic applies op to two numbers, returning an integer when the result is a whole number
+func arithmetic(a, b any, op func(x, y float64) float64) (any, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return nil, err
+	}
+	return number(op(x, y)), nil
+}
+
+// number returns whole numbers as int64, so they are not printed in exponent notation
+func number(x float64) any {
+	if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+		return int64(x)
+	}
+	return x
+}
+
+// toFloat converts the numbers of a template, literals being int or float64
+func toFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// shellQuote quotes a value as a single shell word
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// mediaDimensions returns the width and height of the original, probed once
+func (tp *TaskProcessor) mediaDimensions() (int64, int64) {
+	if tp.Media.Width == 0 {
+		media, err := probeMediaDimensions(tp.OriginalFile.Name(), tp.Media)
+		if err != nil {
+			tp.logf("%v", err)
+		}
+		tp.Media = media
+	}
+	return tp.Media.Width, tp.Media.Height
+}
+
+// mediaBitrate returns the overall bitrate of the original in bits per second, probed once, or 0 when it
+// is unknown
+func (tp *TaskProcessor) mediaBitrate() int64 {
+	if tp.bitrate == nil {
+		bitrate := probeBitrate(tp.OriginalFile.Name())
+		tp.bitrate = &bitrate
+	}
+	return *tp.bitrate
+}
@@ -3,62 +3,670 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"maps"
+	"math"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Task struct {
-	Name            string   `mapstructure:"name"`
-	Extensions      []string `mapstructure:"extensions"`
-	Command         string   `mapstructure:"command"`
-	CommandTemplate *template.Template
+	Name             string            `mapstructure:"name"`
+	Extensions       []string          `mapstructure:"extensions"`
+	MimeTypes        []string          `mapstructure:"mime_types"`
+	Codecs           []string          `mapstructure:"codecs"`
+	ExcludeCodecs    []string          `mapstructure:"exclude_codecs"`
+	Sources          []string          `mapstructure:"sources"`
+	ColorProfiles    []string          `mapstructure:"color_profiles"`
+	Command          string            `mapstructure:"command"`
+	Args             []string          `mapstructure:"args"`
+	Env              map[string]string `mapstructure:"env"`
+	Workdir          string            `mapstructure:"workdir"`
+	Steps            []Step            `mapstructure:"steps"`
+	Variants         []TaskVariant     `mapstructure:"variants"`
+	Ladder           *QualityLadder    `mapstructure:"ladder"`
+	Outputs          []TaskOutput      `mapstructure:"outputs"`
+	MotionPhoto      string            `mapstructure:"motion_photo"`
+	Animated         bool              `mapstructure:"animated"`
+	MotionVideoCmd   string            `mapstructure:"motion_video_command"`
+	ActiveHours      string            `mapstructure:"active_hours"`
+	MinSize          string            `mapstructure:"min_size"`
+	MaxSize          string            `mapstructure:"max_size"`
+	MinWidth         int64             `mapstructure:"min_width"`
+	MaxWidth         int64             `mapstructure:"max_width"`
+	MinHeight        int64             `mapstructure:"min_height"`
+	MaxHeight        int64             `mapstructure:"max_height"`
+	Pool             string            `mapstructure:"pool"`
+	Timeout          string            `mapstructure:"timeout"`
+	Remote           bool              `mapstructure:"remote"`
+	GPU              bool              `mapstructure:"gpu"`
+	Resources        ResourceLimits    `mapstructure:"resources"`
+	PreserveMetadata bool              `mapstructure:"preserve_metadata"`
+	DryRun           bool              `mapstructure:"dry_run"`
+	Policy           `mapstructure:",squash"`
+	CommandTemplate  *template.Template
+	ArgsTemplates    []*template.Template
+	envTemplates     map[string]*template.Template
+	workdirTemplate  *template.Template
+	hwaccel          string
+	window           *TimeWindow
+	minSize          int64
+	maxSize          int64
+	timeout          time.Duration
+	motionVideoTask  *Task
+	colorProfiles    []string
 }
 
 func (task *Task) Init() (err error) {
-	values := map[string]string{
-		"folder":    "/folder",
-		"name":      "name",
-		"extension": "ext",
+	for i := range task.Variants {
+		if err = task.Variants[i].Init(); err != nil {
+			return fmt.Errorf("task %s: %v", task.Name, err)
+		}
 	}
 
-	task.CommandTemplate, err = template.New("command").Parse(task.Command)
-	if err != nil {
-		err = fmt.Errorf("task %s unable to parse command: %v", task.Name, err)
+	modes := 0
+	for _, set := range []bool{task.Command != "", len(task.Args) > 0, len(task.Steps) > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("task %s sets more than one of command, args and steps", task.Name)
+	}
+
+	if task.CommandTemplate, err = parseCommandTemplate(task.Command); err != nil {
+		return fmt.Errorf("task %s %v", task.Name, err)
+	}
+
+	task.ArgsTemplates = make([]*template.Template, len(task.Args))
+	for i, arg := range task.Args {
+		if task.ArgsTemplates[i], err = parseCommandTemplate(arg); err != nil {
+			return fmt.Errorf("task %s args %d: %v", task.Name, i+1, err)
+		}
+	}
+
+	// The configuration keys are case-insensitive, environment variables are named in upper case
+	task.envTemplates = make(map[string]*template.Template, len(task.Env))
+	for name, value := range task.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("task %s env: invalid variable name %q", task.Name, name)
+		}
+		if task.envTemplates[strings.ToUpper(name)], err = parseCommandTemplate(value); err != nil {
+			return fmt.Errorf("task %s env %s: %v", task.Name, name, err)
+		}
+	}
+
+	if task.Workdir != "" {
+		if task.workdirTemplate, err = parseCommandTemplate(task.Workdir); err != nil {
+			return fmt.Errorf("task %s workdir: %v", task.Name, err)
+		}
+	}
+
+	if err = initOutputs(task.Outputs); err != nil {
+		return fmt.Errorf("task %s %v", task.Name, err)
+	}
+	if len(task.Outputs) > 0 && (len(task.Steps) > 0 || task.Remote) {
+		return fmt.Errorf("task %s: outputs cannot be combined with steps or remote", task.Name)
+	}
+
+	if err = task.initMotionPhoto(); err != nil {
+		return fmt.Errorf("task %s %v", task.Name, err)
+	}
+
+	if task.Ladder != nil {
+		if err = task.Ladder.Init(); err != nil {
+			return fmt.Errorf("task %s ladder: %v", task.Name, err)
+		}
+	}
+
+	for i := range task.Steps {
+		if err = task.Steps[i].Init(); err != nil {
+			return fmt.Errorf("task %s step %d: %v", task.Name, i+1, err)
+		}
+	}
+
+	for i, codec := range task.Codecs {
+		task.Codecs[i] = strings.ToLower(codec)
+	}
+	for i, codec := range task.ExcludeCodecs {
+		task.ExcludeCodecs[i] = strings.ToLower(codec)
+	}
+	for _, source := range task.Sources {
+		if _, err = path.Match(source, ""); err != nil {
+			return fmt.Errorf("task %s sources: invalid pattern %q", task.Name, source)
+		}
+	}
+
+	if task.ActiveHours != "" {
+		task.window, err = ParseTimeWindow(task.ActiveHours)
+		if err != nil {
+			err = fmt.Errorf("task %s: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.MinSize != "" {
+		task.minSize, err = parseSize(task.MinSize)
+		if err != nil {
+			err = fmt.Errorf("task %s min_size: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.MaxSize != "" {
+		task.maxSize, err = parseSize(task.MaxSize)
+		if err != nil {
+			err = fmt.Errorf("task %s max_size: %v", task.Name, err)
+			return
+		}
+	}
+
+	if task.MinWidth < 0 || task.MaxWidth < 0 || task.MinHeight < 0 || task.MaxHeight < 0 {
+		err = fmt.Errorf("task %s: width and height conditions must not be negative", task.Name)
 		return
 	}
 
-	var cmdLine bytes.Buffer
-	err = task.CommandTemplate.Execute(&cmdLine, values)
-	if err != nil {
-		err = fmt.Errorf("task %s unable to execute template for command: %v", task.Name, err)
+	if task.Timeout != "" {
+		if task.timeout, err = parseTimeout(task.Timeout); err != nil {
+			err = fmt.Errorf("task %s timeout: %v", task.Name, err)
+			return
+		}
+	}
+
+	if err = task.Policy.Init(); err != nil {
+		err = fmt.Errorf("task %s: %v", task.Name, err)
+		return
+	}
+
+	if err = task.Resources.Init(); err != nil {
+		err = fmt.Errorf("task %s resources: %v", task.Name, err)
+		return
+	}
+	if task.Resources.Cgroup != "" {
+		err = fmt.Errorf("task %s resources: cgroup can only be set globally", task.Name)
 		return
 	}
 
 	return
 }
 
+// commandKey identifies what the task runs, so results of an older configuration are not replayed
+func (task *Task) commandKey() string {
+	key := task.Command
+	for _, arg := range task.Args {
+		key += "\x00arg\x00" + arg
+	}
+	for _, step := range task.Steps {
+		key += "\x00" + step.Command + "\x00" + step.OnError
+	}
+	for _, name := range slices.Sorted(maps.Keys(task.Env)) {
+		key += "\x00env\x00" + name + "=" + task.Env[name]
+	}
+	if task.Workdir != "" {
+		key += "\x00workdir\x00" + task.Workdir
+	}
+	if task.PreserveMetadata {
+		key += "\x00preserve_metadata"
+	}
+	if task.Ladder != nil {
+		key += fmt.Sprintf("\x00ladder\x00%v\x00%s\x00%s", task.Ladder.Qualities, task.Ladder.TargetSize, task.Ladder.TargetRatio)
+	}
+	if task.MotionPhoto == MotionPhotoReembed {
+		key += "\x00motion_photo\x00" + task.MotionVideoCmd
+	}
+	return key
+}
+
+// parseCommandTemplate parses a command and makes sure it can be executed with the template values
+func parseCommandTemplate(command string) (*template.Template, error) {
+	values := map[string]any{
+		"src_folder": "/src",
+		"dst_folder": "/dst",
+		"name":       "name",
+		"extension":  "ext",
+		"quality":    80,
+	}
+
+	commandTemplate, err := template.New("command").Funcs(commandFuncs(sampleMedia{})).Parse(command)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse command: %v", err)
+	}
+
+	var cmdLine bytes.Buffer
+	if err = commandTemplate.Execute(&cmdLine, values); err != nil {
+		return nil, fmt.Errorf("unable to execute template for command: %v", err)
+	}
+	return commandTemplate, nil
+}
+
+// Matches reports whether the task applies to the file: it is one of the files the task is for, see
+// matchesFile, and it meets the conditions of the task, see matchesConditions.
+func (task *Task) Matches(media MediaInfo) bool {
+	return task.matchesFile(media) && task.matchesConditions(media)
+}
+
+// matchesFile reports whether the task is for the file. Every criterion the task sets must match:
+// the extension, the content type sniffed from the magic bytes, the video codec, the folder the file
+// came from and the minimum size.
+func (task *Task) matchesFile(media MediaInfo) bool {
+	if len(task.Extensions) == 0 && len(task.MimeTypes) == 0 {
+		return false
+	}
+	if len(task.Extensions) > 0 && !slices.Contains(task.Extensions, media.Extension) {
+		return false
+	}
+	if len(task.MimeTypes) > 0 && !matchesMimeType(task.MimeTypes, media.MimeType) {
+		return false
+	}
+	if len(task.Codecs) > 0 && !slices.Contains(task.Codecs, media.Codec) {
+		return false
+	}
+	if len(task.Sources) > 0 && !matchesSource(task.Sources, media.Source) {
+		return false
+	}
+	if media.Size < task.minSize {
+		return false
+	}
+	return true
+}
+
+// matchesConditions reports whether the file is worth running the task on: not larger than max_size,
+// within the width and height bounds, not already in one of exclude_codecs, in one of its color profiles,
+// not a motion photo the task passes through and not animated unless the task handles animations. Dimensions that could not
+// be probed do not rule a file out.
+func (task *Task) matchesConditions(media MediaInfo) bool {
+	if media.MotionPhoto && task.MotionPhoto == MotionPhotoPassthrough {
+		return false
+	}
+	if !task.matchesColor(media) {
+		return false
+	}
+	if media.Animated && !task.Animated {
+		return false
+	}
+	if task.maxSize > 0 && media.Size > task.maxSize {
+		return false
+	}
+	if slices.Contains(task.ExcludeCodecs, media.Codec) {
+		return false
+	}
+	if media.Width > 0 && (media.Width < task.MinWidth || task.MaxWidth > 0 && media.Width > task.MaxWidth) {
+		return false
+	}
+	if media.Height > 0 && (media.Height < task.MinHeight || task.MaxHeight > 0 && media.Height > task.MaxHeight) {
+		return false
+	}
+	return true
+}
+
+// needsDimensions reports whether the task has width or height conditions, which require probing the file
+func (task *Task) needsDimensions() bool {
+	return task.MinWidth > 0 || task.MaxWidth > 0 || task.MinHeight > 0 || task.MaxHeight > 0
+}
+
+// PoolName returns the pool limiting the commands of the task for a file: the pool the task sets,
+// otherwise the one of the media type
+func (task *Task) PoolName(media MediaInfo) string {
+	if task.Pool != "" {
+		return task.Pool
+	}
+	return mediaPolicyKey(media.MimeType)
+}
+
+// parseTimeout parses a positive duration such as 30m or 1h30m
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("must be positive, got %s", value)
+	}
+	return timeout, nil
+}
+
+// needsCodec reports whether any task matches on the video codec, which requires running ffprobe
+func needsCodec(tasks []Task) bool {
+	for _, task := range tasks {
+		if len(task.Codecs) > 0 || len(task.ExcludeCodecs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// needsDimensions reports whether any task has width or height conditions
+func needsDimensions(tasks []Task) bool {
+	for _, task := range tasks {
+		if task.needsDimensions() {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledTasks returns the tasks allowed to run now, leaving out those outside their active hours, or
+// outside window for tasks without active hours of their own. When every task matching the file is outside
+// its active hours, it returns none together with the time the first of them becomes active.
+func scheduledTasks(tasks []Task, media MediaInfo, window *TimeWindow, now time.Time) ([]Task, time.Time) {
+	var active []Task
+	var next time.Time
+	matched := false
+
+	for _, task := range tasks {
+		if !task.Matches(media) {
+			active = append(active, task)
+			continue
+		}
+		taskWindow := task.window
+		if taskWindow == nil {
+			taskWindow = window
+		}
+		if taskWindow == nil || taskWindow.Contains(now) {
+			matched = true
+			active = append(active, task)
+			continue
+		}
+		if start := taskWindow.NextStart(now); next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+
+	if !matched && !next.IsZero() {
+		return nil, next
+	}
+	return active, time.Time{}
+}
+
+const (
+	UnmatchedUpload = "upload"
+	UnmatchedSkip   = "skip"
+	UnmatchedFail   = "fail"
+
+	OnErrorFail            = "fail"
+	OnErrorForwardOriginal = "forward_original"
+)
+
 type Config struct {
-	Tasks []Task `mapstructure:"tasks"`
+	Tasks               []Task            `mapstructure:"tasks"`
+	UnmatchedExtensions string            `mapstructure:"unmatched_extensions"`
+	OnError             string            `mapstructure:"on_error"`
+	MinSize             string            `mapstructure:"min_size"`
+	FilenameTemplate    string            `mapstructure:"filename_template"`
+	Messages            map[string]string `mapstructure:"messages"`
+	Policies            map[string]Policy `mapstructure:"policies"`
+	Limits              MediaLimits       `mapstructure:"limits"`
+	Pools               map[string]int    `mapstructure:"pools"`
+	Priorities          []PriorityRule    `mapstructure:"priorities"`
+	Timeout             string            `mapstructure:"timeout"`
+	ActiveHours         map[string]string `mapstructure:"active_hours"`
+	Resources           ResourceLimits    `mapstructure:"resources"`
+	GPUSessions         int               `mapstructure:"gpu_sessions"`
+	Builtin             BuiltinEncoder    `mapstructure:"builtin"`
+	SkipEfficient       SkipEfficient     `mapstructure:"skip_efficient"`
+	ValidateOutput      OutputValidation  `mapstructure:"validate_output"`
+	LivePhotos          string            `mapstructure:"live_photos"`
+	RawPairs            RawPairs          `mapstructure:"raw_pairs"`
+	ColorSafeguard      string            `mapstructure:"color_safeguard"`
+	DryRun              bool              `mapstructure:"dry_run"`
+	minSize             int64
+	timeout             time.Duration
+	pools               *Pools
+	activeHours         map[string]*TimeWindow
+	filenameTemplate    *template.Template
+	messages            map[string]*template.Template
+	files               []string
+}
+
+// belowMinSize reports whether a file is too small to be worth optimizing: below the global min_size,
+// or below the min_size of every task it would otherwise match
+func (c *Config) belowMinSize(media MediaInfo) bool {
+	if media.Size < c.minSize {
+		return true
+	}
+
+	unsized := media
+	unsized.Size = math.MaxInt64
+	return !shouldProcessMedia(media, c.Tasks) && shouldProcessMedia(unsized, c.Tasks)
+}
+
+// failsConditions reports whether tasks are configured for a file but it meets the conditions of none of
+// them, e.g. because it already uses an efficient codec, so it is to be uploaded as-is
+func (c *Config) failsConditions(media MediaInfo) bool {
+	if shouldProcessMedia(media, c.Tasks) {
+		return false
+	}
+	for _, task := range c.Tasks {
+		if task.matchesFile(media) {
+			return true
+		}
+	}
+	return false
+}
+
+// priorityFor returns the priority of the first rule matching the file, or 0
+func (c *Config) priorityFor(media MediaInfo) int {
+	for _, rule := range c.Priorities {
+		if rule.Matches(media) {
+			return rule.Priority
+		}
+	}
+	return 0
+}
+
+// policyFor returns the policy applying to a file optimized by task: the default policy, overridden by
+// the fields the policy of its media type and then the task set. task may be nil.
+func (c *Config) policyFor(task *Task, media MediaInfo) Policy {
+	policy := c.Policies[PolicyDefault]
+	if key := mediaPolicyKey(media.MimeType); key != "" {
+		policy = policy.override(c.Policies[key])
+	}
+	if task != nil {
+		policy = policy.override(task.Policy)
+	}
+	return policy
+}
+
+// activeWindow returns the active hours of the media type of a file, or nil if it may be processed any time
+func (c *Config) activeWindow(media MediaInfo) *TimeWindow {
+	return c.activeHours[mediaPolicyKey(media.MimeType)]
+}
+
+func (c *Config) Init() error {
+	switch c.UnmatchedExtensions {
+	case "":
+		c.UnmatchedExtensions = UnmatchedUpload
+	case UnmatchedUpload, UnmatchedSkip, UnmatchedFail:
+	default:
+		return fmt.Errorf("unmatched_extensions must be one of %s, %s, %s", UnmatchedUpload, UnmatchedSkip, UnmatchedFail)
+	}
+
+	switch c.OnError {
+	case "":
+		c.OnError = OnErrorFail
+	case OnErrorFail, OnErrorForwardOriginal:
+	default:
+		return fmt.Errorf("on_error must be one of %s, %s", OnErrorFail, OnErrorForwardOriginal)
+	}
+
+	if c.FilenameTemplate == "" {
+		c.FilenameTemplate = defaultFilenameTemplate
+	}
+	var err error
+	if c.filenameTemplate, err = parseFilenameTemplate(c.FilenameTemplate); err != nil {
+		return err
+	}
+	if c.messages, err = parseMessages(c.Messages); err != nil {
+		return err
+	}
+
+	if c.MinSize != "" {
+		if c.minSize, err = parseSize(c.MinSize); err != nil {
+			return fmt.Errorf("min_size: %v", err)
+		}
+	}
+
+	if c.Timeout != "" {
+		if c.timeout, err = parseTimeout(c.Timeout); err != nil {
+			return fmt.Errorf("timeout: %v", err)
+		}
+	}
+
+	if err := c.Limits.Init(); err != nil {
+		return fmt.Errorf("limits: %v", err)
+	}
+
+	if err := c.Builtin.Init(); err != nil {
+		return fmt.Errorf("builtin: %v", err)
+	}
+
+	if err := c.SkipEfficient.Init(); err != nil {
+		return fmt.Errorf("skip_efficient: %v", err)
+	}
+
+	if err := c.ValidateOutput.Init(); err != nil {
+		return fmt.Errorf("validate_output: %v", err)
+	}
+
+	if err := c.RawPairs.Init(); err != nil {
+		return fmt.Errorf("raw_pairs: %v", err)
+	}
+
+	switch c.ColorSafeguard {
+	case "":
+		c.ColorSafeguard = ColorSafeguardProtect
+	case ColorSafeguardProtect, ColorSafeguardOff:
+	default:
+		return fmt.Errorf("color_safeguard must be one of %s, %s", ColorSafeguardProtect, ColorSafeguardOff)
+	}
+
+	switch c.LivePhotos {
+	case "":
+		c.LivePhotos = LivePhotosPreserve
+	case LivePhotosPreserve, LivePhotosPassthrough, LivePhotosIgnore:
+	default:
+		return fmt.Errorf("live_photos must be one of %s, %s, %s", LivePhotosPreserve, LivePhotosPassthrough, LivePhotosIgnore)
+	}
+
+	for key, policy := range c.Policies {
+		if key != PolicyDefault && key != PolicyImage && key != PolicyVideo && key != PolicyAudio {
+			return fmt.Errorf("policies: unknown media type %q, expected %s, %s, %s or %s", key, PolicyDefault, PolicyImage, PolicyVideo, PolicyAudio)
+		}
+		if err := policy.Init(); err != nil {
+			return fmt.Errorf("policies %s: %v", key, err)
+		}
+		c.Policies[key] = policy
+	}
+
+	for i := range c.Priorities {
+		if err := c.Priorities[i].Init(); err != nil {
+			return fmt.Errorf("priorities %d: %v", i+1, err)
+		}
+	}
+
+	c.activeHours = make(map[string]*TimeWindow, len(c.ActiveHours))
+	for key, value := range c.ActiveHours {
+		if key != PolicyImage && key != PolicyVideo && key != PolicyAudio {
+			return fmt.Errorf("active_hours: unknown media type %q, expected %s, %s or %s", key, PolicyImage, PolicyVideo, PolicyAudio)
+		}
+		if c.activeHours[key], err = ParseTimeWindow(value); err != nil {
+			return fmt.Errorf("active_hours %s: %v", key, err)
+		}
+	}
+
+	if err := c.Resources.Init(); err != nil {
+		return fmt.Errorf("resources: %v", err)
+	}
+
+	// Tasks switch to their hardware variant before the GPU sessions are set up for them
+	for i := range c.Tasks {
+		if len(c.Tasks[i].Variants) > 0 {
+			c.Tasks[i].selectVariant(detectHWAccel())
+		}
+	}
+
+	// GPU sessions are a pool of their own, which tasks marked gpu wait for on top of their category's
+	pools := maps.Clone(c.Pools)
+	if _, ok := pools[gpuPool]; ok {
+		return fmt.Errorf("pools: %s is reserved, use gpu_sessions", gpuPool)
+	}
+	if c.GPUSessions < 0 {
+		return fmt.Errorf("gpu_sessions must not be negative")
+	}
+	if slices.ContainsFunc(c.Tasks, func(task Task) bool { return task.GPU }) {
+		if pools == nil {
+			pools = make(map[string]int)
+		}
+		pools[gpuPool] = max(c.GPUSessions, 1)
+	}
+	if c.pools, err = NewPools(pools); err != nil {
+		return fmt.Errorf("pools: %v", err)
+	}
+
+	for i := range c.Tasks {
+		if err := c.Tasks[i].Init(); err != nil {
+			return err
+		}
+		if err := c.Tasks[i].initColorProfiles(c.ColorSafeguard); err != nil {
+			return err
+		}
+		if pool := c.Tasks[i].Pool; pool != "" && !c.pools.Has(pool) {
+			return fmt.Errorf("task %s: pool %s is not defined in pools", c.Tasks[i].Name, pool)
+		}
+		if c.Resources.override(c.Tasks[i].Resources).Enabled() && c.Resources.Cgroup == "" {
+			return fmt.Errorf("task %s: resource limits require resources.cgroup", c.Tasks[i].Name)
+		}
+	}
+
+	return nil
 }
 
 func NewConfig(configFile *string) (*Config, error) {
+	return readConfig(*configFile)
+}
+
+// readConfig loads and validates a configuration file. Its settings can be overridden with IUO_ environment
+// variables, e.g. IUO_TIMEOUT, the same way on startup and on every reload.
+func readConfig(configFile string) (*Config, error) {
 	var c *Config
-	viper.SetConfigFile(*configFile)
+	v := viper.New()
+	v.SetEnvPrefix("iuo")
+	v.AutomaticEnv()
+	v.SetConfigFile(configFile)
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("error reading config file: %w", err)
 	}
 
-	if err := viper.Unmarshal(&c); err != nil {
+	files := []string{configFile}
+	if v.IsSet("preset") || v.IsSet("include") {
+		settings, err := resolveIncludes(v.AllSettings(), filepath.Dir(configFile), []string{configFile}, &files)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if err := v.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+
+	if err := v.Unmarshal(&c); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
-	for i := range c.Tasks {
-		if err := c.Tasks[i].Init(); err != nil {
-			return nil, fmt.Errorf("error validating config: %w", err)
-		}
+	if err := c.Init(); err != nil {
+		return nil, fmt.Errorf("error validating config: %w", err)
 	}
+	c.files = files
 
 	return c, nil
 }
+
+// Files returns the files the configuration was read from, the tasks file then the files it includes
+func (c *Config) Files() []string {
+	return c.files
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// deadLetterRecordSuffix is appended to the name of a dead-lettered file for the record kept next to it
+	deadLetterRecordSuffix = ".dead-letter.json"
+	// Retries of a failed file back off from deadLetterMinBackoff, doubling up to deadLetterMaxBackoff
+	deadLetterMinBackoff = time.Minute
+	deadLetterMaxBackoff = time.Hour
+)
+
+// DeadLetterRecord describes a file that failed processing too many times
+type DeadLetterRecord struct {
+	Path           string    `json:"path"`
+	Filename       string    `json:"filename"`
+	Attempts       int       `json:"attempts"`
+	Error          string    `json:"error"`
+	Forwarded      bool      `json:"forwarded"`
+	AssetID        string    `json:"asset_id,omitempty"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+// DeadLetter retries files that fail processing and, once they failed a number of times in a row, moves
+// them out of the watch directory into a folder of their own, together with a record holding the last
+// error and the output of the failing command. A nil *DeadLetter disables retries.
+type DeadLetter struct {
+	dir         string
+	maxAttempts int
+	forward     bool
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func NewDeadLetter(dir string, maxAttempts int, forward bool) *DeadLetter {
+	return &DeadLetter{
+		dir:         dir,
+		maxAttempts: maxAttempts,
+		forward:     forward,
+		attempts:    make(map[string]int),
+	}
+}
+
+// Fail counts a failed attempt at processing the file, returning the attempts so far and whether the file
+// has to be dead-lettered
+func (d *DeadLetter) Fail(filePath string) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts[filePath]++
+	attempts := d.attempts[filePath]
+	if attempts >= d.maxAttempts {
+		delete(d.attempts, filePath)
+		return attempts, true
+	}
+	return attempts, false
+}
+
+// Forget resets the failed attempts of a file, once it was uploaded or moved aside
+func (d *DeadLetter) Forget(filePath string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.attempts, filePath)
+}
+
+// Attempts returns the failed attempts of the files that were not dead-lettered yet
+func (d *DeadLetter) Attempts() map[string]int {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return maps.Clone(d.attempts)
+}
+
+// Restore adds failed attempts counted before a restart
+func (d *DeadLetter) Restore(attempts map[string]int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for filePath, count := range attempts {
+		d.attempts[filePath] += count
+	}
+}
+
+// Backoff returns how long to wait before the next attempt after the given number of failed ones
+func (d *DeadLetter) Backoff(attempts int) time.Duration {
+	backoff := deadLetterMinBackoff
+	for range attempts - 1 {
+		if backoff >= deadLetterMaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	return min(backoff, deadLetterMaxBackoff)
+}
+
+// Move moves the file and its sidecar below the dead-letter folder, keeping their path relative to the
+// watch directory, and writes the record next to them
+func (d *DeadLetter) Move(filePath, watchDir string, record DeadLetterRecord) error {
+	relPath, err := filepath.Rel(watchDir, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: %w", err)
+	}
+	destPath := filepath.Join(d.dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0750); err != nil {
+		return fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+
+	sidecarPath := findSidecar(filePath)
+	if err := moveFile(filePath, destPath); err != nil {
+		return err
+	}
+	if sidecarPath != "" {
+		if err := moveFile(sidecarPath, filepath.Join(filepath.Dir(destPath), filepath.Base(sidecarPath))); err != nil {
+			return err
+		}
+	}
+
+	record.Path = relPath
+	record.Filename = filepath.Base(filePath)
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode dead-letter record: %w", err)
+	}
+	if err := os.WriteFile(destPath+deadLetterRecordSuffix, data, 0640); err != nil {
+		return fmt.Errorf("failed to write dead-letter record: %w", err)
+	}
+	return nil
+}
+
+// List returns the records of the dead-lettered files, most recent first
+func (d *DeadLetter) List() ([]DeadLetterRecord, error) {
+	records := []DeadLetterRecord{}
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, deadLetterRecordSuffix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var record DeadLetterRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("invalid dead-letter record %s: %w", path, err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeadLetteredAt.After(records[j].DeadLetteredAt)
+	})
+	return records, nil
+}
+
+// moveFile renames src to dst, copying it when they are on different file systems
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		if err != nil {
+			return fmt.Errorf("unable to move %s: %w", src, err)
+		}
+		return nil
+	}
+
+	if err := copyFilePreservingTimes(src, dst); err != nil {
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("unable to remove %s: %w", src, err)
+	}
+	return nil
+}
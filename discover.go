@@ -0,0 +1,237 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const defaultPresetsDir = "/etc/immich-optimizer/bundled-configs"
+
+// extensionInventory aggregates the files found for one extension
+type extensionInventory struct {
+	Extension string
+	Files     int64
+	Bytes     int64
+	MimeTypes map[string]int64
+	Codecs    map[string]int64
+	media     []MediaInfo
+}
+
+// presetCoverage is the share of the inventory a preset would hand to one of its tasks
+type presetCoverage struct {
+	Name      string
+	Files     int64
+	Bytes     int64
+	Unmatched []string
+}
+
+// runDiscover implements the discover subcommand: it inventories a directory tree and suggests
+// which bundled preset fits it best
+func runDiscover(args []string) int {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	presetsDir := flags.String("presets_dir", cmp.Or(os.Getenv("IUO_PRESETS_DIR"), defaultPresetsDir), "Directory holding one preset per folder, each with a tasks.yaml")
+	sample := flags.Int("sample", 5, "Number of videos per extension probed with ffprobe for their codec, 0 to disable")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s discover [flags] <dir>\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	inventory, err := inventoryDirectory(flags.Arg(0), *sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	presets, err := loadPresets(*presetsDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	printInventory(os.Stdout, inventory)
+	printCoverage(os.Stdout, inventory, presets)
+	return 0
+}
+
+// inventoryDirectory sniffs every file below dir, probing the codec of up to sample videos per extension
+func inventoryDirectory(dir string, sample int) ([]*extensionInventory, error) {
+	byExtension := make(map[string]*extensionInventory)
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isSidecarFile(path) || d.Name() == skipMarkerFile {
+			return nil
+		}
+
+		media, err := DetectMedia(path, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", path, err)
+			return nil
+		}
+
+		key := extensionStatsKey(media.Extension)
+		entry, ok := byExtension[key]
+		if !ok {
+			entry = &extensionInventory{
+				Extension: key,
+				MimeTypes: make(map[string]int64),
+				Codecs:    make(map[string]int64),
+			}
+			byExtension[key] = entry
+		}
+
+		if strings.HasPrefix(media.MimeType, "video/") && int64(sample) > sampledCodecs(entry) {
+			if media.Codec, err = probeVideoCodec(path); err != nil {
+				media.Codec = "unknown"
+			}
+			entry.Codecs[media.Codec]++
+		}
+
+		entry.Files++
+		entry.Bytes += media.Size
+		entry.MimeTypes[media.MimeType]++
+		entry.media = append(entry.media, media)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk %s: %w", dir, err)
+	}
+
+	inventory := slices.Collect(maps.Values(byExtension))
+	slices.SortFunc(inventory, func(a, b *extensionInventory) int {
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+	return inventory, nil
+}
+
+func sampledCodecs(entry *extensionInventory) int64 {
+	var total int64
+	for _, count := range entry.Codecs {
+		total += count
+	}
+	return total
+}
+
+// loadPresets reads every <dir>/<preset>/tasks.yaml
+func loadPresets(dir string) (map[string]*Config, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "tasks.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no presets found in %s, use -presets_dir to point at the bundled configs", dir)
+	}
+
+	presets := make(map[string]*Config)
+	for _, path := range paths {
+		config, err := readConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %w", path, err)
+		}
+		presets[filepath.Base(filepath.Dir(path))] = config
+	}
+	return presets, nil
+}
+
+func printInventory(w io.Writer, inventory []*extensionInventory) {
+	var files, bytes int64
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "EXTENSION\tFILES\tSIZE\tTYPES\tCODECS (SAMPLED)")
+	for _, entry := range inventory {
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\n", entry.Extension, entry.Files, humanReadableSize(entry.Bytes),
+			formatCounts(entry.MimeTypes), formatCounts(entry.Codecs))
+		files += entry.Files
+		bytes += entry.Bytes
+	}
+	fmt.Fprintf(table, "total\t%d\t%s\t\t\n", files, humanReadableSize(bytes))
+	table.Flush()
+}
+
+func printCoverage(w io.Writer, inventory []*extensionInventory, presets map[string]*Config) {
+	if len(presets) == 0 {
+		return
+	}
+
+	var totalFiles, totalBytes int64
+	for _, entry := range inventory {
+		totalFiles += entry.Files
+		totalBytes += entry.Bytes
+	}
+
+	var coverage []presetCoverage
+	for name, config := range presets {
+		preset := presetCoverage{Name: name}
+		for _, entry := range inventory {
+			matched := false
+			for _, media := range entry.media {
+				if shouldProcessMedia(media, config.Tasks) {
+					preset.Files++
+					preset.Bytes += media.Size
+					matched = true
+				}
+			}
+			if !matched {
+				preset.Unmatched = append(preset.Unmatched, entry.Extension)
+			}
+		}
+		coverage = append(coverage, preset)
+	}
+	slices.SortFunc(coverage, func(a, b presetCoverage) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Name, b.Name))
+	})
+
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PRESET\tFILES MATCHED\tSIZE MATCHED\tUNMATCHED EXTENSIONS")
+	for _, preset := range coverage {
+		fmt.Fprintf(table, "%s\t%d/%d\t%s\t%s\n", preset.Name, preset.Files, totalFiles,
+			percentage(preset.Bytes, totalBytes), strings.Join(preset.Unmatched, ","))
+	}
+	table.Flush()
+
+	if best := coverage[0]; best.Files > 0 {
+		fmt.Fprintf(w, "\nSuggested preset: %s, it has a task for %s of the data\n", best.Name, percentage(best.Bytes, totalBytes))
+		if len(best.Unmatched) > 0 {
+			fmt.Fprintf(w, "Add tasks for %s or set unmatched_extensions to decide what happens to them\n", strings.Join(best.Unmatched, ", "))
+		}
+	}
+}
+
+// formatCounts renders counts as "a:3 b:1", most frequent first
+func formatCounts(counts map[string]int64) string {
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%d", key, counts[key]))
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+func percentage(part, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.0f%%", float64(part)*100/float64(total))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultEfficientCodecs    = []string{"hevc", "av1"}
+	defaultEfficientMimeTypes = []string{"image/webp", "image/avif", "image/jxl"}
+)
+
+// SkipEfficient uploads media that is already in an efficient format as-is, without running any task on
+// it, so it does not lose quality to another generation of lossy encoding
+type SkipEfficient struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Codecs are the video codecs considered efficient, as named by ffprobe (default hevc, av1)
+	Codecs []string `mapstructure:"codecs"`
+	// MaxBitrate limits the videos skipped to those below a bitrate, e.g. 20M; without it every video in one
+	// of Codecs is
+	MaxBitrate string `mapstructure:"max_bitrate"`
+	// MimeTypes are the image formats considered efficient (default image/webp, image/avif, image/jxl)
+	MimeTypes  []string `mapstructure:"mime_types"`
+	maxBitrate int64
+}
+
+func (s *SkipEfficient) Init() (err error) {
+	if s.Codecs == nil {
+		s.Codecs = defaultEfficientCodecs
+	}
+	for i, codec := range s.Codecs {
+		s.Codecs[i] = strings.ToLower(codec)
+	}
+	if s.MimeTypes == nil {
+		s.MimeTypes = defaultEfficientMimeTypes
+	}
+	if s.MaxBitrate != "" {
+		if s.maxBitrate, err = parseBitrate(s.MaxBitrate); err != nil {
+			return fmt.Errorf("max_bitrate: %v", err)
+		}
+	}
+	return nil
+}
+
+// Efficient reports whether a file is already efficient and why. The bitrate of a video is only probed
+// when max_bitrate is set, a video whose bitrate cannot be probed is not considered efficient.
+func (s SkipEfficient) Efficient(filePath string, media MediaInfo) (string, bool) {
+	if !s.Enabled {
+		return "", false
+	}
+
+	if strings.HasPrefix(media.MimeType, "image/") && matchesMimeType(s.MimeTypes, media.MimeType) {
+		return media.MimeType, true
+	}
+
+	if !strings.HasPrefix(media.MimeType, "video/") || !slices.Contains(s.Codecs, media.Codec) {
+		return "", false
+	}
+	if s.maxBitrate == 0 {
+		return media.Codec, true
+	}
+	bitrate := probeBitrate(filePath)
+	if bitrate == 0 || bitrate > s.maxBitrate {
+		return "", false
+	}
+	return fmt.Sprintf("%s at %s", media.Codec, humanReadableBitrate(bitrate)), true
+}
+
+// parseBitrate parses a bitrate such as 8M, 8Mbps, 800k or 800000 into bits per second
+func parseBitrate(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "bps")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(number, "k"):
+		multiplier, number = 1e3, strings.TrimSuffix(number, "k")
+	case strings.HasSuffix(number, "m"):
+		multiplier, number = 1e6, strings.TrimSuffix(number, "m")
+	case strings.HasSuffix(number, "g"):
+		multiplier, number = 1e9, strings.TrimSuffix(number, "g")
+	}
+
+	bitrate, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || bitrate <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q, expected a value such as 8M or 800k", value)
+	}
+	return int64(bitrate * multiplier), nil
+}
+
+// humanReadableBitrate formats bits per second in megabits per second
+func humanReadableBitrate(bitrate int64) string {
+	return fmt.Sprintf("%.1f Mbps", float64(bitrate)/1e6)
+}
@@ -4,7 +4,9 @@ go 1.23.4
 
 require (
 	github.com/spf13/viper v1.19.0
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/sys v0.18.0
+	golang.org/x/text v0.14.0
 )
 
 require (
@@ -23,7 +25,6 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// hashesBucket is the store bucket holding uploaded hashes
+const hashesBucket = "hashes"
+
+// HashRecord describes a file whose content has already been uploaded to Immich.
+// AssetID is the Immich asset holding the content, which may have existed before the upload.
+// UploadedChecksum is the SHA1 of the file Immich received, which differs from the original's when it was optimized.
+// Hashes and UploadedHashes hold every digest configured with -hashes, for auditing.
+type HashRecord struct {
+	Filename         string     `json:"filename"`
+	UploadedAt       time.Time  `json:"uploaded_at"`
+	AssetID          string     `json:"asset_id,omitempty"`
+	UploadedChecksum string     `json:"uploaded_checksum,omitempty"`
+	Hashes           FileHashes `json:"hashes,omitempty"`
+	UploadedHashes   FileHashes `json:"uploaded_hashes,omitempty"`
+}
+
+// HashDB is a persistent set of content hashes of originals already uploaded to Immich.
+// Every ingestion path, and every instance using the same store, can share it.
+type HashDB struct {
+	store  Store
+	bucket string
+}
+
+// NewHashDB keeps the hashes in the given bucket of store
+func NewHashDB(store Store, bucket string) *HashDB {
+	return &HashDB{
+		store:  store,
+		bucket: bucket,
+	}
+}
+
+// Lookup returns the record stored for hash, if any
+func (db *HashDB) Lookup(hash string) (HashRecord, bool, error) {
+	var record HashRecord
+
+	data, ok, err := db.store.Get(db.bucket, hash)
+	if err != nil || !ok {
+		return record, false, err
+	}
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, false, fmt.Errorf("unable to decode hash record: %w", err)
+	}
+
+	return record, true, nil
+}
+
+// Add stores hash in the database
+func (db *HashDB) Add(hash string, record HashRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode hash record: %w", err)
+	}
+
+	return db.store.Put(db.bucket, hash, data)
+}
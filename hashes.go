@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// hashSHA1 is the algorithm Immich identifies assets by, so it is always computed
+	hashSHA1 = "sha1"
+	// hashXXH64 is the algorithm the result cache identifies originals by, much faster than SHA-1
+	hashXXH64 = "xxh64"
+)
+
+// hashAlgorithms are the algorithms that can be enabled with -hashes
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	hashSHA1:  sha1.New,
+	"sha256":  sha256.New,
+	"sha512":  sha512.New,
+	hashXXH64: newXXH64,
+}
+
+// FileHashes maps algorithm names to the hex digest of a file
+type FileHashes map[string]string
+
+// SHA1 returns the digest Immich uses for duplicate detection, or an empty string if it was not computed
+func (h FileHashes) SHA1() string {
+	return h[hashSHA1]
+}
+
+// XXH64 returns the digest the result cache uses, or an empty string if it was not computed
+func (h FileHashes) XXH64() string {
+	return h[hashXXH64]
+}
+
+// parseHashAlgorithms validates the algorithm names, always including SHA-1
+func parseHashAlgorithms(names []string) ([]string, error) {
+	algorithms := []string{hashSHA1}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := hashAlgorithms[name]; !ok {
+			supported := make([]string, 0, len(hashAlgorithms))
+			for algorithm := range hashAlgorithms {
+				supported = append(supported, algorithm)
+			}
+			sort.Strings(supported)
+			return nil, fmt.Errorf("unsupported hash algorithm %q, expected one of %s", name, strings.Join(supported, ", "))
+		}
+		if !slices.Contains(algorithms, name) {
+			algorithms = append(algorithms, name)
+		}
+	}
+	return algorithms, nil
+}
+
+// hashFile computes every requested digest of a file in a single read
+func hashFile(filePath string, algorithms []string) (FileHashes, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	if len(algorithms) == 0 {
+		algorithms = []string{hashSHA1}
+	}
+
+	hashers := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		hasher := hashAlgorithms[algorithm]()
+		hashers[algorithm] = hasher
+		writers = append(writers, hasher)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	hashes := make(FileHashes, len(hashers))
+	for algorithm, hasher := range hashers {
+		hashes[algorithm] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return hashes, nil
+}
+
+const (
+	xxh64Prime1 uint64 = 0x9E3779B185EBCA87
+	xxh64Prime2 uint64 = 0xC2B2AE3D27D4EB4F
+	xxh64Prime3 uint64 = 0x165667B19E3779F9
+	xxh64Prime4 uint64 = 0x85EBCA77C2B2AE63
+	xxh64Prime5 uint64 = 0x27D4EB2F165667C5
+)
+
+// xxh64 is a streaming XXH64 with seed 0, a fast non-cryptographic hash suited to local caches
+type xxh64 struct {
+	v      [4]uint64
+	total  uint64
+	buffer [32]byte
+	used   int
+}
+
+func newXXH64() hash.Hash {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	// The initial state wraps around, which Go only allows on variables
+	prime1, prime2 := xxh64Prime1, xxh64Prime2
+	h.v = [4]uint64{prime1 + prime2, prime2, 0, -prime1}
+	h.total = 0
+	h.used = 0
+}
+
+func (h *xxh64) Size() int      { return 8 }
+func (h *xxh64) BlockSize() int { return 32 }
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+
+	if h.used > 0 {
+		filled := copy(h.buffer[h.used:], p)
+		h.used += filled
+		p = p[filled:]
+		if h.used < len(h.buffer) {
+			return n, nil
+		}
+		h.consume(h.buffer[:])
+		h.used = 0
+	}
+
+	for ; len(p) >= 32; p = p[32:] {
+		h.consume(p[:32])
+	}
+	h.used = copy(h.buffer[:], p)
+
+	return n, nil
+}
+
+func (h *xxh64) consume(block []byte) {
+	for i := range h.v {
+		h.v[i] = xxh64Round(h.v[i], binary.LittleEndian.Uint64(block[i*8:]))
+	}
+}
+
+func (h *xxh64) Sum(b []byte) []byte {
+	var sum uint64
+	if h.total >= 32 {
+		sum = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			sum = (sum^xxh64Round(0, v))*xxh64Prime1 + xxh64Prime4
+		}
+	} else {
+		sum = xxh64Prime5
+	}
+	sum += h.total
+
+	tail := h.buffer[:h.used]
+	for ; len(tail) >= 8; tail = tail[8:] {
+		sum ^= xxh64Round(0, binary.LittleEndian.Uint64(tail))
+		sum = bits.RotateLeft64(sum, 27)*xxh64Prime1 + xxh64Prime4
+	}
+	if len(tail) >= 4 {
+		sum ^= uint64(binary.LittleEndian.Uint32(tail)) * xxh64Prime1
+		sum = bits.RotateLeft64(sum, 23)*xxh64Prime2 + xxh64Prime3
+		tail = tail[4:]
+	}
+	for _, c := range tail {
+		sum ^= uint64(c) * xxh64Prime5
+		sum = bits.RotateLeft64(sum, 11) * xxh64Prime1
+	}
+
+	sum ^= sum >> 33
+	sum *= xxh64Prime2
+	sum ^= sum >> 29
+	sum *= xxh64Prime3
+	sum ^= sum >> 32
+
+	return binary.BigEndian.AppendUint64(b, sum)
+}
+
+func xxh64Round(acc, input uint64) uint64 {
+	acc += input * xxh64Prime2
+	return bits.RotateLeft64(acc, 31) * xxh64Prime1
+}
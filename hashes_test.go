@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// xxh64Vectors are digests of the reference implementation with seed 0, covering inputs shorter than a
+// stripe, the 4 and 8 byte tails and several stripes
+var xxh64Vectors = []struct {
+	input string
+	want  string
+}{
+	{"", "ef46db3751d8e999"},
+	{"a", "d24ec4f1a98c6e5b"},
+	{"abc", "44bc2cf5ad770999"},
+	{"message digest", "066ed728fceeb3be"},
+	{"Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+	{"The quick brown fox jumps over the lazy dog", "0b242d361fda71bc"},
+	{strings.Repeat("0123456789", 10), "f80e7b96315afffa"},
+}
+
+func TestXXH64(t *testing.T) {
+	for _, tt := range xxh64Vectors {
+		h := newXXH64()
+		h.Write([]byte(tt.input))
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("xxh64(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestXXH64Streaming(t *testing.T) {
+	for _, tt := range xxh64Vectors {
+		for _, chunk := range []int{1, 3, 7, 31, 32, 33} {
+			h := newXXH64()
+			for data := []byte(tt.input); len(data) > 0; {
+				n := min(chunk, len(data))
+				h.Write(data[:n])
+				data = data[n:]
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("xxh64(%q) in chunks of %d = %s, want %s", tt.input, chunk, got, tt.want)
+			}
+		}
+	}
+
+	// Sum does not change the state, and Reset starts over
+	h := newXXH64()
+	h.Write([]byte("ab"))
+	h.Sum(nil)
+	h.Write([]byte("c"))
+	if got := hex.EncodeToString(h.Sum(nil)); got != "44bc2cf5ad770999" {
+		t.Errorf("xxh64 after Sum = %s", got)
+	}
+	h.Reset()
+	if got := hex.EncodeToString(h.Sum(nil)); got != "ef46db3751d8e999" {
+		t.Errorf("xxh64 after Reset = %s", got)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abc.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	algorithms, err := parseHashAlgorithms([]string{"XXH64", " md5 ", "sha1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := hashFile(path, algorithms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := FileHashes{
+		"sha1":  "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"md5":   "900150983cd24fb0d6963f7d28e17f72",
+		"xxh64": "44bc2cf5ad770999",
+	}
+	if len(hashes) != len(want) {
+		t.Errorf("got %v, want %v", hashes, want)
+	}
+	for algorithm, digest := range want {
+		if hashes[algorithm] != digest {
+			t.Errorf("%s: got %s, want %s", algorithm, hashes[algorithm], digest)
+		}
+	}
+
+	if _, err := parseHashAlgorithms([]string{"crc32"}); err == nil {
+		t.Errorf("unsupported algorithm was accepted")
+	}
+}
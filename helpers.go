@@ -5,8 +5,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"slices"
+	"strconv"
 	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 func humanReadableSize(size int64) string {
@@ -36,16 +38,41 @@ func normalizeExtension(extension string) string {
 	return strings.TrimPrefix(strings.ToLower(extension), ".")
 }
 
-func shouldProcessExtension(extension string, tasks []Task) bool {
-	checkExt := normalizeExtension(extension)
+func shouldProcessMedia(media MediaInfo, tasks []Task) bool {
 	for _, task := range tasks {
-		if slices.Contains(task.Extensions, checkExt) {
+		if task.Matches(media) {
 			return true
 		}
 	}
 	return false
 }
 
+// parseSize parses a size such as 200KB, 1.5MB or 1048576, using binary units like humanReadableSize
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range units {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * multiplier), nil
+}
+
 func trimSuffixCaseInsensitive(str, suffix string) string {
 	if strings.HasSuffix(strings.ToLower(str), strings.ToLower(suffix)) {
 		return str[:len(str)-len(suffix)]
@@ -84,3 +111,68 @@ func copyFileToUndone(filePath, watchDir, undoneDir string) error {
 
 	return nil
 }
+
+// sourceFolder returns the top-level folder of the watch directory a file is in, which usually tells the
+// device or app that synced it, or an empty string for files directly in the watch directory
+func sourceFolder(filePath, watchDir string) string {
+	relative, err := filepath.Rel(watchDir, filePath)
+	if err != nil {
+		return ""
+	}
+	folder, _, found := strings.Cut(filepath.ToSlash(relative), "/")
+	if !found {
+		return ""
+	}
+	return folder
+}
+
+func availableDiskSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats for %s: %w", path, err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func isSidecarFile(filePath string) bool {
+	return normalizeExtension(filepath.Ext(filePath)) == "xmp"
+}
+
+// findSidecar returns the XMP sidecar of a media file, named either photo.jpg.xmp or photo.xmp
+func findSidecar(filePath string) string {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for _, candidate := range []string{filePath + ".xmp", filePath + ".XMP", base + ".xmp", base + ".XMP"} {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// hasSkipMarker reports whether the folder of filePath, or any folder above it up to root, contains the skip marker
+func hasSkipMarker(filePath, root string) bool {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(filePath); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, skipMarkerFile)); err == nil {
+			return true
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// isPartialPath reports whether filePath, or a folder between it and root, is still being written
+// by the optimizer itself under the partialPrefix name
+func isPartialPath(filePath, root string) bool {
+	relative, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if strings.HasPrefix(part, partialPrefix) {
+			return true
+		}
+	}
+	return false
+}
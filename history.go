@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historyBucket is the store bucket holding finished jobs
+const historyBucket = "history"
+
+// HistoryRecord is a finished job as kept in the history
+type HistoryRecord struct {
+	ID            string    `json:"id"`
+	Filename      string    `json:"filename"`
+	Source        string    `json:"source,omitempty"`
+	User          string    `json:"user,omitempty"`
+	Task          string    `json:"task,omitempty"`
+	Outcome       JobState  `json:"outcome"`
+	Result        string    `json:"result,omitempty"`
+	OriginalSize  int64     `json:"original_size"`
+	OptimizedSize int64     `json:"optimized_size,omitempty"`
+	UploadedSize  int64     `json:"uploaded_size,omitempty"`
+	SavedBytes    int64     `json:"saved_bytes,omitempty"`
+	DurationMs    int64     `json:"duration_ms"`
+	FinishedAt    time.Time `json:"finished_at"`
+}
+
+// HistoryTotals aggregates a group of finished jobs
+type HistoryTotals struct {
+	Jobs          int64 `json:"jobs"`
+	Done          int64 `json:"done"`
+	Failed        int64 `json:"failed"`
+	Cancelled     int64 `json:"cancelled"`
+	OriginalBytes int64 `json:"original_bytes"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	SavedBytes    int64 `json:"saved_bytes"`
+	DurationMs    int64 `json:"duration_ms"`
+}
+
+func (t *HistoryTotals) add(record HistoryRecord) {
+	t.Jobs++
+	switch record.Outcome {
+	case JobDone:
+		t.Done++
+	case JobFailed:
+		t.Failed++
+	case JobCancelled:
+		t.Cancelled++
+	}
+	t.OriginalBytes += record.OriginalSize
+	t.UploadedBytes += record.UploadedSize
+	t.SavedBytes += record.SavedBytes
+	t.DurationMs += record.DurationMs
+}
+
+// HistoryStats aggregates the history overall and by source folder, Immich user and task
+type HistoryStats struct {
+	Since    *time.Time                `json:"since,omitempty"`
+	Total    HistoryTotals             `json:"total"`
+	BySource map[string]*HistoryTotals `json:"by_source"`
+	ByUser   map[string]*HistoryTotals `json:"by_user"`
+	ByTask   map[string]*HistoryTotals `json:"by_task"`
+}
+
+// History records every finished job in the store, keeping them for the retention period, and aggregates
+// the savings.
+type History struct {
+	store       Store
+	retention   time.Duration
+	logger      *customLogger
+	events      <-chan JobEvent
+	unsubscribe func()
+	done        chan struct{}
+
+	mu sync.Mutex
+}
+
+func NewHistory(store Store, retention time.Duration, jobs *JobRegistry, logger *customLogger) *History {
+	events, unsubscribe := jobs.Subscribe()
+	return &History{
+		store:       store,
+		retention:   retention,
+		logger:      logger,
+		events:      events,
+		unsubscribe: unsubscribe,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start records finished jobs in the background until Stop, forgetting expired records every day
+func (h *History) Start() {
+	go func() {
+		defer close(h.done)
+
+		h.prune()
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event, ok := <-h.events:
+				if !ok {
+					return
+				}
+				if event.Job.Finished() {
+					h.record(event.Job)
+				}
+			case <-ticker.C:
+				h.prune()
+			}
+		}
+	}()
+}
+
+// Stop ends the subscription and waits for the record being written
+func (h *History) Stop() {
+	h.unsubscribe()
+	<-h.done
+}
+
+func (h *History) record(job Job) {
+	record := HistoryRecord{
+		ID:            job.ID,
+		Filename:      job.Filename,
+		Source:        job.Source,
+		User:          job.User,
+		Task:          job.Task,
+		Outcome:       job.State,
+		Result:        job.Result,
+		OriginalSize:  job.OriginalSize,
+		OptimizedSize: job.OptimizedSize,
+		UploadedSize:  job.UploadedSize,
+		SavedBytes:    job.SavedBytes,
+		DurationMs:    job.DurationMs,
+		FinishedAt:    *job.FinishedAt,
+	}
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		// Job ids restart with the process, the finish time keeps keys unique and sortable
+		key := fmt.Sprintf("%d-%s", record.FinishedAt.UnixNano(), record.ID)
+		h.mu.Lock()
+		err = h.store.Put(historyBucket, key, data)
+		h.mu.Unlock()
+	}
+	if err != nil {
+		h.logger.Errorf("Error recording job %s in the history: %v", job.ID, err)
+	}
+}
+
+// prune forgets the records older than the retention period
+func (h *History) prune() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	documents, err := h.store.List(historyBucket)
+	if err != nil {
+		h.logger.Errorf("Error listing the job history: %v", err)
+		return
+	}
+
+	for key, data := range documents {
+		var record HistoryRecord
+		if err := json.Unmarshal(data, &record); err == nil && time.Since(record.FinishedAt) <= h.retention {
+			continue
+		}
+		if err := h.store.Delete(historyBucket, key); err != nil {
+			h.logger.Errorf("Error forgetting job %s from the history: %v", key, err)
+		}
+	}
+}
+
+// records returns the recorded jobs, newest first
+func (h *History) records() ([]HistoryRecord, error) {
+	documents, err := h.store.List(historyBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]HistoryRecord, 0, len(documents))
+	for _, data := range documents {
+		var record HistoryRecord
+		if err := json.Unmarshal(data, &record); err == nil {
+			records = append(records, record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].FinishedAt.After(records[j].FinishedAt)
+	})
+	return records, nil
+}
+
+// Recent returns up to limit of the most recently finished jobs
+func (h *History) Recent(limit int) ([]HistoryRecord, error) {
+	records, err := h.records()
+	if err != nil {
+		return nil, err
+	}
+	return records[:min(limit, len(records))], nil
+}
+
+// Stats aggregates the recorded jobs
+func (h *History) Stats() (HistoryStats, error) {
+	stats := HistoryStats{
+		BySource: make(map[string]*HistoryTotals),
+		ByUser:   make(map[string]*HistoryTotals),
+		ByTask:   make(map[string]*HistoryTotals),
+	}
+
+	records, err := h.records()
+	if err != nil {
+		return stats, err
+	}
+
+	group := func(groups map[string]*HistoryTotals, key string, record HistoryRecord) {
+		if key == "" {
+			key = "(none)"
+		}
+		if groups[key] == nil {
+			groups[key] = &HistoryTotals{}
+		}
+		groups[key].add(record)
+	}
+
+	for _, record := range records {
+		stats.Total.add(record)
+		group(stats.BySource, record.Source, record)
+		group(stats.ByUser, record.User, record)
+		group(stats.ByTask, record.Task, record)
+	}
+	if len(records) > 0 {
+		since := records[len(records)-1].FinishedAt
+		stats.Since = &since
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HWAccelNVENC        = "nvenc"
+	HWAccelVAAPI        = "vaapi"
+	HWAccelQSV          = "qsv"
+	HWAccelVideoToolbox = "videotoolbox"
+)
+
+// hwaccelProbeTimeout bounds the test encode run for every hardware encoder ffmpeg was built with
+const hwaccelProbeTimeout = 15 * time.Second
+
+type hwaccelProbe struct {
+	name    string
+	encoder string
+	args    func() []string
+}
+
+// hwaccelProbes are the test encodes run to find out whether a hardware encoder works on this host, in
+// the order variants are documented in. Listing the encoder in ffmpeg is not enough, the device and its
+// driver have to be there too.
+var hwaccelProbes = []hwaccelProbe{
+	{HWAccelNVENC, "h264_nvenc", func() []string { return []string{"-c:v", "h264_nvenc"} }},
+	{HWAccelVAAPI, "h264_vaapi", func() []string {
+		return []string{"-vaapi_device", renderNode(), "-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi"}
+	}},
+	{HWAccelQSV, "h264_qsv", func() []string { return []string{"-c:v", "h264_qsv"} }},
+	{HWAccelVideoToolbox, "h264_videotoolbox", func() []string { return []string{"-c:v", "h264_videotoolbox"} }},
+}
+
+// TaskVariant is a hardware-specific version of a task, used instead of the command of the task when its
+// hardware encoder works on this host
+type TaskVariant struct {
+	HWAccel string   `mapstructure:"hwaccel"`
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+	Steps   []Step   `mapstructure:"steps"`
+}
+
+// detectHWAccel returns the hardware encoders that work on this host, probed once with ffmpeg
+var detectHWAccel = sync.OnceValue(func() []string {
+	output, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil
+	}
+
+	var available []string
+	for _, probe := range hwaccelProbes {
+		if !strings.Contains(string(output), " "+probe.encoder+" ") {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), hwaccelProbeTimeout)
+		args := append([]string{"-hide_banner", "-v", "error", "-f", "lavfi", "-i", "color=black:s=256x256"}, probe.args()...)
+		err := exec.CommandContext(ctx, "ffmpeg", append(args, "-frames:v", "1", "-f", "null", "-")...).Run()
+		cancel()
+		if err == nil {
+			available = append(available, probe.name)
+		}
+	}
+	return available
+})
+
+// renderNode returns the first DRM render node, used by VAAPI
+func renderNode() string {
+	nodes, _ := filepath.Glob("/dev/dri/renderD*")
+	if len(nodes) == 0 {
+		return "/dev/dri/renderD128"
+	}
+	return nodes[0]
+}
+
+func (variant *TaskVariant) Init() error {
+	if !slices.ContainsFunc(hwaccelProbes, func(probe hwaccelProbe) bool { return probe.name == variant.HWAccel }) {
+		return fmt.Errorf("hwaccel must be one of %s, %s, %s, %s", HWAccelNVENC, HWAccelVAAPI, HWAccelQSV, HWAccelVideoToolbox)
+	}
+	if variant.Command == "" && len(variant.Args) == 0 && len(variant.Steps) == 0 {
+		return fmt.Errorf("variant %s sets none of command, args and steps", variant.HWAccel)
+	}
+	return nil
+}
+
+// selectVariant replaces what the task runs with its first variant whose hardware encoder works. The task
+// then waits for a GPU session like a task marked gpu. Without a working variant the task runs as written.
+func (task *Task) selectVariant(available []string) {
+	for _, variant := range task.Variants {
+		if !slices.Contains(available, variant.HWAccel) {
+			continue
+		}
+		task.Command, task.Args, task.Steps = variant.Command, variant.Args, variant.Steps
+		task.GPU = true
+		task.hwaccel = variant.HWAccel
+		return
+	}
+}
+
+// logVariants logs the hardware encoders found and the variant every task with variants runs
+func logVariants(logger *customLogger, tasks []Task) {
+	if !slices.ContainsFunc(tasks, func(task Task) bool { return len(task.Variants) > 0 }) {
+		return
+	}
+
+	available := detectHWAccel()
+	if len(available) == 0 {
+		logger.Printf("No hardware encoder found, tasks run their software commands")
+	} else {
+		logger.Printf("Hardware encoders found: %s", strings.Join(available, ", "))
+	}
+	for _, task := range tasks {
+		if task.hwaccel != "" {
+			logger.Printf("Task %s runs its %s variant", task.Name, task.hwaccel)
+		}
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -16,6 +20,30 @@ type ImmichClient struct {
 	APIKey         string
 	TimeoutSeconds int
 	logger         *customLogger
+	user           *ImmichUser
+	hashes         []string
+}
+
+// ImmichUser is the Immich account the API key belongs to
+type ImmichUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// AssetUploadResult is the response of Immich to an upload, plus the checksum of the bytes sent
+type AssetUploadResult struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Filename string     `json:"-"`
+	Checksum string     `json:"-"`
+	Hashes   FileHashes `json:"-"`
+	Size     int64      `json:"-"`
+}
+
+// Duplicate reports whether Immich already had an asset with the uploaded content and stored nothing new
+func (r AssetUploadResult) Duplicate() bool {
+	return r.Status == "duplicate"
 }
 
 func NewImmichClient(baseURL, apiKey string, timeoutSeconds int, logger *customLogger) *ImmichClient {
@@ -27,57 +55,299 @@ func NewImmichClient(baseURL, apiKey string, timeoutSeconds int, logger *customL
 	}
 }
 
-func (c *ImmichClient) UploadAsset(filePath string) error {
+// SetHashAlgorithms selects the digests computed for every uploaded file, SHA-1 being the one sent to Immich
+func (c *ImmichClient) SetHashAlgorithms(algorithms []string) {
+	c.hashes = algorithms
+}
+
+// UploadAsset uploads filePath to Immich as filename, attaching the XMP sidecar at sidecarPath unless it is empty
+func (c *ImmichClient) UploadAsset(filePath, filename, sidecarPath string) (AssetUploadResult, error) {
+	return c.UploadAssetWithProgress(filePath, filename, sidecarPath, nil)
+}
+
+// UploadAssetWithProgress uploads like UploadAsset, reporting the part of the request sent to progress
+// unless it is nil
+func (c *ImmichClient) UploadAssetWithProgress(filePath, filename, sidecarPath string, progress ProgressFunc) (AssetUploadResult, error) {
+	result := AssetUploadResult{Filename: filename}
+
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("unable to open file: %w", err)
+		return result, fmt.Errorf("unable to open file: %w", err)
 	}
 	defer file.Close()
 
+	var sidecar *os.File
+	var sidecarSize int64
+	if sidecarPath != "" {
+		sidecar, err = os.Open(sidecarPath)
+		if err != nil {
+			return result, fmt.Errorf("unable to open sidecar: %w", err)
+		}
+		defer sidecar.Close()
+
+		sidecarInfo, err := sidecar.Stat()
+		if err != nil {
+			return result, fmt.Errorf("unable to get sidecar info: %w", err)
+		}
+		sidecarSize = sidecarInfo.Size()
+	}
+
 	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("unable to get file info: %w", err)
+		return result, fmt.Errorf("unable to get file info: %w", err)
 	}
+	result.Size = stat.Size()
 
-	var buffer bytes.Buffer
-	writer := multipart.NewWriter(&buffer)
+	// Immich detects duplicates with the checksum of the bytes it receives, which after optimization
+	// are no longer those of the original
+	result.Hashes, err = hashFile(filePath, c.hashes)
+	if err != nil {
+		return result, fmt.Errorf("unable to compute checksum: %w", err)
+	}
+	result.Checksum = result.Hashes.SHA1()
 
 	// Add required fields
-	filename := filepath.Base(filePath)
-	deviceAssetId := fmt.Sprintf("%s-%d", filename, stat.ModTime().Unix())
-	deviceId := "immich-optimizer"
+	fields := map[string]string{
+		"deviceAssetId": fmt.Sprintf("%s-%d", filename, stat.ModTime().Unix()),
+		"deviceId":      "immich-optimizer",
+		// Convert times to RFC3339 format
+		"fileCreatedAt":  stat.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+		"fileModifiedAt": stat.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+
+	// Stream the multipart body instead of buffering it, so large videos are never held in memory
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	writer := multipart.NewWriter(pipeWriter)
+
+	// Announce the exact length so reverse proxies in front of Immich that reject or buffer chunked
+	// request bodies accept the stream
+	contentLength, err := assetFormLength(writer.Boundary(), fields, filename, stat.Size(), sidecarPath, sidecarSize)
+	if err != nil {
+		return result, err
+	}
+
+	go func() {
+		var sidecarData io.Reader
+		if sidecar != nil {
+			sidecarData = sidecar
+		}
+		pipeWriter.CloseWithError(writeAssetForm(writer, fields, filename, file, filepath.Base(sidecarPath), sidecarData))
+	}()
+
+	var body io.Reader = pipeReader
+	if progress != nil {
+		body = &uploadProgress{reader: pipeReader, total: contentLength, started: time.Now(), last: -1, report: progress}
+	}
+
+	url := fmt.Sprintf("%s/api/assets", c.BaseURL)
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return result, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	c.logger.Debugf("Uploading %s: %d byte request, checksum %s, sidecar %q", filename, contentLength, result.Checksum, sidecarPath)
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("x-api-key", c.APIKey)
+	req.Header.Set("x-immich-checksum", result.Checksum)
+
+	client := &http.Client{
+		Timeout: time.Duration(c.TimeoutSeconds) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return result, fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		c.logger.Printf("Unable to decode upload response for %s: %v", filename, err)
+	}
+
+	if result.Duplicate() {
+		c.logger.Printf("Immich already has %s as asset %s, nothing new was stored", filename, result.ID)
+		return result, nil
+	}
+
+	if sidecar != nil {
+		c.logger.Printf("Successfully uploaded %s (%s) with sidecar %s", filename, humanReadableSize(stat.Size()), filepath.Base(sidecarPath))
+	} else {
+		c.logger.Printf("Successfully uploaded %s (%s)", filename, humanReadableSize(stat.Size()))
+	}
+	return result, nil
+}
+
+// uploadProgress reports the part of a request body the client read, once per whole percent
+type uploadProgress struct {
+	reader  io.Reader
+	total   int64
+	sent    int64
+	started time.Time
+	last    int
+	report  ProgressFunc
+}
+
+func (p *uploadProgress) Read(data []byte) (int, error) {
+	n, err := p.reader.Read(data)
+	p.sent += int64(n)
+	if p.total <= 0 {
+		return n, err
+	}
+
+	percent := min(100, 100*float64(p.sent)/float64(p.total))
+	if int(percent) != p.last {
+		p.last = int(percent)
+		var eta time.Duration
+		if percent > 0 {
+			elapsed := time.Since(p.started)
+			eta = time.Duration(float64(elapsed) * (100 - percent) / percent).Round(time.Second)
+		}
+		p.report(percent, eta)
+	}
+	return n, err
+}
+
+// DownloadOriginal writes the original file Immich stores for an asset to w
+func (c *ImmichClient) DownloadOriginal(assetID string, w io.Writer) error {
+	url := fmt.Sprintf("%s/api/assets/%s/original", c.BaseURL, assetID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("x-api-key", c.APIKey)
+
+	client := &http.Client{
+		Timeout: time.Duration(c.TimeoutSeconds) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
 
-	// Convert times to RFC3339 format
-	fileCreatedAt := stat.ModTime().Format("2006-01-02T15:04:05.000Z")
-	fileModifiedAt := stat.ModTime().Format("2006-01-02T15:04:05.000Z")
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("download failed with status %d: %s", resp.StatusCode, string(body))
+	}
 
-	writer.WriteField("deviceAssetId", deviceAssetId)
-	writer.WriteField("deviceId", deviceId)
-	writer.WriteField("fileCreatedAt", fileCreatedAt)
-	writer.WriteField("fileModifiedAt", fileModifiedAt)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("unable to download asset: %w", err)
+	}
+	return nil
+}
+
+// CreateStack groups assets into a stack, the first one being shown as the primary asset
+func (c *ImmichClient) CreateStack(assetIDs ...string) error {
+	if slices.Contains(assetIDs, "") {
+		return fmt.Errorf("unable to stack assets, an asset id is unknown")
+	}
+
+	body, err := json.Marshal(map[string][]string{"assetIds": assetIDs})
+	if err != nil {
+		return fmt.Errorf("unable to encode request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/api/stacks", c.BaseURL)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.APIKey)
+
+	client := &http.Client{
+		Timeout: time.Duration(c.TimeoutSeconds) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("stack creation failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// writeAssetForm writes the upload form fields followed by the asset data and the optional sidecar,
+// then closes the writer
+func writeAssetForm(writer *multipart.Writer, fields map[string]string, filename string, file io.Reader, sidecarName string, sidecar io.Reader) error {
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return fmt.Errorf("unable to write form field %s: %w", name, err)
+		}
+	}
 
 	part, err := writer.CreateFormFile("assetData", filename)
 	if err != nil {
 		return fmt.Errorf("unable to create form file: %w", err)
 	}
 
-	_, err = io.Copy(part, file)
-	if err != nil {
+	if _, err := io.Copy(part, file); err != nil {
 		return fmt.Errorf("unable to copy file to form: %w", err)
 	}
 
-	err = writer.Close()
-	if err != nil {
+	if sidecar != nil {
+		sidecarPart, err := writer.CreateFormFile("sidecarData", sidecarName)
+		if err != nil {
+			return fmt.Errorf("unable to create sidecar form file: %w", err)
+		}
+		if _, err := io.Copy(sidecarPart, sidecar); err != nil {
+			return fmt.Errorf("unable to copy sidecar to form: %w", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
 		return fmt.Errorf("unable to close multipart writer: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/api/assets", c.BaseURL)
-	req, err := http.NewRequest("POST", url, &buffer)
+	return nil
+}
+
+// assetFormLength returns the size of the body writeAssetForm produces with the given boundary, by writing
+// the form with empty files and adding the sizes of the files
+func assetFormLength(boundary string, fields map[string]string, filename string, fileSize int64, sidecarPath string, sidecarSize int64) (int64, error) {
+	var counter byteCounter
+	writer := multipart.NewWriter(&counter)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return 0, fmt.Errorf("unable to measure upload: %w", err)
+	}
+
+	var sidecar io.Reader
+	if sidecarPath != "" {
+		sidecar = strings.NewReader("")
+	}
+	if err := writeAssetForm(writer, fields, filename, strings.NewReader(""), filepath.Base(sidecarPath), sidecar); err != nil {
+		return 0, fmt.Errorf("unable to measure upload: %w", err)
+	}
+
+	return int64(counter) + fileSize + sidecarSize, nil
+}
+
+// byteCounter is an io.Writer that only counts what is written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// ResolveUser looks up the Immich user owning the API key so uploads can be attributed to it
+func (c *ImmichClient) ResolveUser() error {
+	url := fmt.Sprintf("%s/api/users/me", c.BaseURL)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("unable to create request: %w", err)
 	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
 	req.Header.Set("x-api-key", c.APIKey)
 
 	client := &http.Client{
@@ -89,11 +359,28 @@ func (c *ImmichClient) UploadAsset(filePath string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("user lookup failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var user ImmichUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return fmt.Errorf("unable to decode user: %w", err)
 	}
+	c.user = &user
 
-	c.logger.Printf("Successfully uploaded %s (%s)", filename, humanReadableSize(stat.Size()))
+	c.logger.Printf("Connected to Immich as %s", c.UserLabel())
 	return nil
 }
+
+// UserLabel identifies the Immich user uploads are attributed to
+func (c *ImmichClient) UserLabel() string {
+	if c.user == nil {
+		return "unknown"
+	}
+	if c.user.Email != "" {
+		return c.user.Email
+	}
+	return c.user.ID
+}
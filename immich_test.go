@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssetFormLength(t *testing.T) {
+	fields := map[string]string{
+		"deviceAssetId":  "IMG_0001.jpg-1700000000",
+		"deviceId":       "immich-optimizer",
+		"fileCreatedAt":  "2023-11-14T22:13:20.000Z",
+		"fileModifiedAt": "2023-11-14T22:13:20.000Z",
+	}
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		filename string
+		file     string
+		sidecar  string // name of the sidecar, none if empty
+		data     string
+	}{
+		{"empty file", fields, "empty.jpg", "", "", ""},
+		{"file", fields, "IMG_0001.jpg", strings.Repeat("x", 4096), "", ""},
+		{"no fields", nil, "IMG_0001.jpg", "data", "", ""},
+		{"sidecar", fields, "IMG_0001.jpg", "data", "IMG_0001.jpg.xmp", "<x:xmpmeta/>"},
+		{"empty sidecar", fields, "IMG_0001.jpg", "data", "IMG_0001.xmp", ""},
+		{"escaped filename", fields, `Fête "été"\été.jpg`, "data", `a "b".xmp`, "<x/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			var sidecar io.Reader
+			sidecarPath := ""
+			if tt.sidecar != "" {
+				sidecar = strings.NewReader(tt.data)
+				sidecarPath = filepath.Join("/watch", tt.sidecar)
+			}
+			if err := writeAssetForm(writer, tt.fields, tt.filename, strings.NewReader(tt.file), tt.sidecar, sidecar); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := assetFormLength(writer.Boundary(), tt.fields, tt.filename, int64(len(tt.file)), sidecarPath, int64(len(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != int64(body.Len()) {
+				t.Errorf("got %d, want %d", got, body.Len())
+			}
+		})
+	}
+
+	if _, err := assetFormLength("bad boundary!\n", fields, "a.jpg", 1, "", 0); err == nil {
+		t.Errorf("invalid boundary was accepted")
+	}
+}
+
+func TestUploadAssetSendsContentLength(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "IMG_0001.jpg")
+	sidecarPath := filepath.Join(dir, "IMG_0001.jpg.xmp")
+	if err := os.WriteFile(filePath, bytes.Repeat([]byte{0xFF}, 100_000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sidecarPath, []byte("<x:xmpmeta/>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(r.TransferEncoding) > 0 {
+			t.Errorf("upload was sent with transfer encoding %v", r.TransferEncoding)
+		}
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("announced %d bytes, sent %d", r.ContentLength, len(body))
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), strings.TrimPrefix(r.Header.Get("Content-Type"), "multipart/form-data; boundary="))
+		form, err := reader.ReadForm(1 << 20)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(form.File["assetData"]) != 1 || form.File["assetData"][0].Size != 100_000 {
+			t.Errorf("assetData: %+v", form.File["assetData"])
+		}
+		if len(form.File["sidecarData"]) != 1 {
+			t.Errorf("sidecarData missing")
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":"asset-1","status":"created"}`)
+	}))
+	defer server.Close()
+
+	client := NewImmichClient(server.URL, "key", 10, newCustomLogger(log.New(io.Discard, "", 0), ""))
+	result, err := client.UploadAsset(filePath, "IMG_0001.jpg", sidecarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != "asset-1" || result.Size != 100_000 {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func TestUploadAssetReportsProgress(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "VID_0001.mp4")
+	if err := os.WriteFile(filePath, bytes.Repeat([]byte{0xAA}, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":"asset-1","status":"created"}`)
+	}))
+	defer server.Close()
+
+	var reported []float64
+	client := NewImmichClient(server.URL, "key", 10, newCustomLogger(log.New(io.Discard, "", 0), ""))
+	_, err := client.UploadAssetWithProgress(filePath, "VID_0001.mp4", "", func(percent float64, eta time.Duration) {
+		reported = append(reported, percent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reported) < 2 || reported[len(reported)-1] != 100 {
+		t.Fatalf("got %v, want progress up to 100%%", reported)
+	}
+	for i := 1; i < len(reported); i++ {
+		if int(reported[i]) <= int(reported[i-1]) {
+			t.Errorf("progress went from %v to %v, want once per whole percent", reported[i-1], reported[i])
+		}
+	}
+}
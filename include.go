@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"embed"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+// bundledConfigs holds the bundled configurations, each folder being a preset tasks files can build on
+//
+//go:embed config
+var bundledConfigs embed.FS
+
+// loadTasksFile reads a tasks file with the preset and the files it includes merged in, adding every file
+// read to files
+func loadTasksFile(file string, seen []string, files *[]string) (map[string]any, error) {
+	if slices.Contains(seen, file) {
+		return nil, fmt.Errorf("%s includes itself", file)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("include %s: %w", file, err)
+	}
+	*files = append(*files, file)
+	return resolveIncludes(v.AllSettings(), filepath.Dir(file), append(seen, file), files)
+}
+
+// resolveIncludes merges the preset, then the files in include, then the settings themselves. Relative
+// include paths are relative to dir, the folder of the file holding them.
+func resolveIncludes(settings map[string]any, dir string, seen []string, files *[]string) (map[string]any, error) {
+	base := map[string]any{}
+
+	if name, _ := settings["preset"].(string); name != "" {
+		preset, err := loadPreset(name)
+		if err != nil {
+			return nil, err
+		}
+		base = mergeSettings(base, preset)
+	}
+
+	for _, include := range includeList(settings["include"]) {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		included, err := loadTasksFile(include, seen, files)
+		if err != nil {
+			return nil, err
+		}
+		base = mergeSettings(base, included)
+	}
+
+	own := maps.Clone(settings)
+	delete(own, "preset")
+	delete(own, "include")
+	return mergeSettings(base, own), nil
+}
+
+// loadPreset reads a bundled preset. Its tasks run in the folder of the preset among the bundled configs
+// on disk, when there is one, so the helper files some presets use are found.
+func loadPreset(name string) (map[string]any, error) {
+	data, err := bundledConfigs.ReadFile(path.Join("config", name, "tasks.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown preset %q, expected one of %v", name, presetNames())
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("preset %s: %w", name, err)
+	}
+	settings := v.AllSettings()
+
+	presetDir := filepath.Join(cmp.Or(os.Getenv("IUO_PRESETS_DIR"), defaultPresetsDir), name)
+	if info, err := os.Stat(presetDir); err == nil && info.IsDir() {
+		tasks, _ := settings["tasks"].([]any)
+		for _, task := range tasks {
+			if task, ok := task.(map[string]any); ok && task["workdir"] == nil {
+				task["workdir"] = presetDir
+			}
+		}
+	}
+	return settings, nil
+}
+
+// includeList returns the include setting, a list of paths or a single one, as a list
+func includeList(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list
+	}
+	return nil
+}
+
+// presetNames returns the names of the bundled presets
+func presetNames() []string {
+	entries, _ := fs.ReadDir(bundledConfigs, "config")
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// mergeSettings returns base with the settings of over taking precedence. Tasks are merged by name: a
+// task named like one of base overrides the keys it sets in place, or removes it with remove: true, and
+// other tasks are added after those of base.
+func mergeSettings(base, over map[string]any) map[string]any {
+	merged := maps.Clone(base)
+	for key, value := range over {
+		if key == "tasks" {
+			baseTasks, _ := base[key].([]any)
+			overTasks, _ := value.([]any)
+			merged[key] = mergeTasks(baseTasks, overTasks)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+func mergeTasks(base, over []any) []any {
+	tasks := make([]map[string]any, 0, len(base)+len(over))
+	for _, task := range base {
+		if task, ok := task.(map[string]any); ok {
+			tasks = append(tasks, maps.Clone(task))
+		}
+	}
+
+	for _, task := range over {
+		task, ok := task.(map[string]any)
+		if !ok {
+			continue
+		}
+		task = maps.Clone(task)
+		remove, _ := task["remove"].(bool)
+		delete(task, "remove")
+
+		i := slices.IndexFunc(tasks, func(t map[string]any) bool { return t["name"] != nil && t["name"] == task["name"] })
+		switch {
+		case i >= 0 && remove:
+			tasks = slices.Delete(tasks, i, i+1)
+		case i >= 0:
+			maps.Copy(tasks[i], task)
+		case !remove:
+			tasks = append(tasks, task)
+		}
+	}
+
+	merged := make([]any, len(tasks))
+	for i, task := range tasks {
+		merged[i] = task
+	}
+	return merged
+}
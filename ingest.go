@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ingestPollInterval is how often the mount root is scanned for new volumes
+const ingestPollInterval = 5 * time.Second
+
+// Ingester copies the DCIM folder of every removable volume mounted under a mount root into the watch
+// directory once, so SD cards and USB drives go through the normal pipeline. The volume itself is never
+// modified; it is unmounted afterwards when eject is set.
+type Ingester struct {
+	root     string
+	watchDir string
+	eject    bool
+	hashDB   *HashDB
+	logger   *customLogger
+	stop     chan struct{}
+
+	mu      sync.Mutex
+	volumes map[string]uint64 // mounted volumes already ingested, by path, with their device id
+	stopped bool
+}
+
+func NewIngester(root, watchDir string, eject bool, hashDB *HashDB, logger *customLogger) *Ingester {
+	return &Ingester{
+		root:     root,
+		watchDir: watchDir,
+		eject:    eject,
+		hashDB:   hashDB,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		volumes:  make(map[string]uint64),
+	}
+}
+
+// Start scans the mount root every ingestPollInterval in the background
+func (in *Ingester) Start() {
+	in.logger.Printf("Watching %s for removable media", in.root)
+
+	go func() {
+		ticker := time.NewTicker(ingestPollInterval)
+		defer ticker.Stop()
+
+		for {
+			in.Scan()
+
+			select {
+			case <-ticker.C:
+			case <-in.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends background scanning
+func (in *Ingester) Stop() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.stopped {
+		close(in.stop)
+		in.stopped = true
+	}
+}
+
+// Scan ingests the volumes mounted since the last scan and forgets those that were removed,
+// so inserting a card again ingests it again
+func (in *Ingester) Scan() {
+	mounted := in.mountedVolumes()
+
+	in.mu.Lock()
+	var added []string
+	for volume, device := range mounted {
+		if known, ok := in.volumes[volume]; !ok || known != device {
+			added = append(added, volume)
+		}
+	}
+	in.volumes = mounted
+	in.mu.Unlock()
+
+	for _, volume := range added {
+		in.ingest(volume)
+	}
+}
+
+// mountedVolumes returns the mount points with a DCIM folder directly below the root or one level deeper,
+// as with /media/<user>/<label>, by device id
+func (in *Ingester) mountedVolumes() map[string]uint64 {
+	volumes := make(map[string]uint64)
+
+	rootDevice, err := deviceID(in.root)
+	if err != nil {
+		in.logger.Errorf("Error reading mount root %s: %v", in.root, err)
+		return volumes
+	}
+
+	var scan func(dir string, depth int)
+	scan = func(dir string, depth int) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			device, err := deviceID(path)
+			if err != nil {
+				continue
+			}
+			if device != rootDevice {
+				if findDCIM(path) != "" {
+					volumes[path] = device
+				}
+				continue
+			}
+			if depth < 2 {
+				scan(path, depth+1)
+			}
+		}
+	}
+	scan(in.root, 1)
+	in.logger.Debugf("Mounted volumes with a DCIM folder: %v", volumes)
+
+	return volumes
+}
+
+// ingest copies the DCIM folder of a volume into a hidden folder of the watch directory and renames it
+// once complete, so the watcher only sees whole files
+func (in *Ingester) ingest(volume string) {
+	dcim := findDCIM(volume)
+	label := filepath.Base(volume)
+	in.logger.Printf("Ingesting %s from %s", dcim, label)
+
+	name := fmt.Sprintf("%s-%s", label, time.Now().Format("20060102-150405"))
+	staging := filepath.Join(in.watchDir, partialPrefix+name)
+	copied, skipped, err := in.copyTree(dcim, staging)
+	if err != nil {
+		in.logger.Errorf("Error ingesting %s, nothing was queued: %v", label, err)
+		os.RemoveAll(staging)
+		return
+	}
+
+	if copied > 0 {
+		if err := os.Rename(staging, filepath.Join(in.watchDir, name)); err != nil {
+			in.logger.Errorf("Error queueing files from %s: %v", label, err)
+			os.RemoveAll(staging)
+			return
+		}
+	} else {
+		os.RemoveAll(staging)
+	}
+	in.logger.Printf("Queued %d files from %s, %d already uploaded", copied, label, skipped)
+
+	if in.eject {
+		in.unmount(volume)
+	}
+}
+
+// copyTree copies every regular file below src to dst, keeping modification times and leaving out
+// hidden files and files whose content was already uploaded
+func (in *Ingester) copyTree(src, dst string) (copied, skipped int, err error) {
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != src {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if in.alreadyUploaded(path) {
+			skipped++
+			return nil
+		}
+
+		relative, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if err := copyFilePreservingTimes(path, filepath.Join(dst, relative)); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, skipped, err
+}
+
+// alreadyUploaded reports whether the content of a file is in the hash database
+func (in *Ingester) alreadyUploaded(path string) bool {
+	if in.hashDB == nil {
+		return false
+	}
+
+	hashes, err := hashFile(path, []string{hashSHA1})
+	if err != nil {
+		return false
+	}
+	_, ok, err := in.hashDB.Lookup(hashes.SHA1())
+	return err == nil && ok
+}
+
+// unmount releases a volume after ingesting it so it can be removed safely
+func (in *Ingester) unmount(volume string) {
+	output, err := exec.Command("umount", volume).CombinedOutput()
+	if err != nil {
+		in.logger.Errorf("Error ejecting %s: %v: %s", volume, err, strings.TrimSpace(string(output)))
+		return
+	}
+	in.logger.Printf("Ejected %s, it can be removed", volume)
+}
+
+// findDCIM returns the DCIM folder of a volume, matched case-insensitively, or an empty string
+func findDCIM(volume string) string {
+	entries, err := os.ReadDir(volume)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.EqualFold(entry.Name(), "DCIM") {
+			return filepath.Join(volume, entry.Name())
+		}
+	}
+	return ""
+}
+
+func deviceID(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unable to read device of %s", path)
+	}
+	return uint64(stat.Dev), nil
+}
+
+func copyFilePreservingTimes(src, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", src, err)
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to get file info of %s: %w", src, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return fmt.Errorf("unable to create folder for %s: %w", dst, err)
+	}
+
+	target, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return fmt.Errorf("unable to copy %s: %w", src, err)
+	}
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("unable to write %s: %w", dst, err)
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
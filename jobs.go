@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// jobHistoryLimit is the number of finished jobs kept for the jobs API
+	jobHistoryLimit = 1000
+	// jobHistoryTTL is how long finished jobs are kept for the jobs API
+	jobHistoryTTL = 24 * time.Hour
+)
+
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobProcessing JobState = "processing"
+	JobUploading  JobState = "uploading"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+	JobCancelled  JobState = "cancelled"
+)
+
+var (
+	ErrJobNotFound       = errors.New("job not found")
+	ErrJobNotCancellable = errors.New("only queued or processing jobs can be cancelled")
+)
+
+// Job tracks one file from the watch directory through optimization and upload
+type Job struct {
+	ID            string     `json:"id"`
+	Path          string     `json:"path"`
+	Filename      string     `json:"filename"`
+	Source        string     `json:"source,omitempty"`
+	Session       string     `json:"session,omitempty"`
+	User          string     `json:"user,omitempty"`
+	State         JobState   `json:"state"`
+	Task          string     `json:"task,omitempty"`
+	Result        string     `json:"result,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	AssetID       string     `json:"asset_id,omitempty"`
+	OriginalSize  int64      `json:"original_size"`
+	OptimizedSize int64      `json:"optimized_size,omitempty"`
+	UploadedSize  int64      `json:"uploaded_size,omitempty"`
+	SavedBytes    int64      `json:"saved_bytes,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	DurationMs    int64      `json:"duration_ms"`
+	Progress      *float64   `json:"progress,omitempty"`
+	ETASeconds    int64      `json:"eta_seconds,omitempty"`
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool
+	forward   bool
+}
+
+// Finished reports whether the job reached a final state
+func (j *Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// JobEventType tells state changes from progress updates of a running job
+type JobEventType string
+
+const (
+	JobEventState    JobEventType = "state"
+	JobEventProgress JobEventType = "progress"
+)
+
+// JobEvent reports a job moving to a new state or making progress
+type JobEvent struct {
+	Type JobEventType `json:"type"`
+	Time time.Time    `json:"time"`
+	Job  Job          `json:"job"`
+}
+
+// jobEventBuffer is the number of events a subscriber may fall behind before further events are dropped
+const jobEventBuffer = 256
+
+// JobRegistry keeps the running jobs, by the path of their file, and the most recent finished ones.
+// A nil *JobRegistry tracks nothing.
+type JobRegistry struct {
+	mu          sync.Mutex
+	nextID      uint64
+	jobs        map[string]*Job
+	active      map[string]*Job
+	subscribers map[chan JobEvent]struct{}
+	observers   map[uint64]func(JobEvent)
+	nextObserve uint64
+}
+
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{
+		jobs:        make(map[string]*Job),
+		active:      make(map[string]*Job),
+		subscribers: make(map[chan JobEvent]struct{}),
+		observers:   make(map[uint64]func(JobEvent)),
+	}
+}
+
+// Subscribe returns a channel receiving every state change and progress update and the function ending the subscription,
+// which closes the channel. Events are dropped for subscribers that fall behind.
+func (r *JobRegistry) Subscribe() (<-chan JobEvent, func()) {
+	events := make(chan JobEvent, jobEventBuffer)
+	if r == nil {
+		close(events)
+		return events, func() {}
+	}
+
+	r.mu.Lock()
+	r.subscribers[events] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, events)
+			r.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// Observe calls fn with every event as it happens, for consumers that cannot lose events, and returns the
+// function ending the observation. fn runs with the registry locked, so it must only hand the event over.
+func (r *JobRegistry) Observe(fn func(JobEvent)) func() {
+	if r == nil {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	r.nextObserve++
+	id := r.nextObserve
+	r.observers[id] = fn
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.observers, id)
+		r.mu.Unlock()
+	}
+}
+
+// publish sends the current state of a job to the observers and subscribers, the caller holds r.mu
+func (r *JobRegistry) publish(eventType JobEventType, job *Job) {
+	event := JobEvent{Type: eventType, Time: time.Now(), Job: job.snapshot()}
+	for _, fn := range r.observers {
+		fn(event)
+	}
+	for events := range r.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Start registers a queued job for a file, to be processed under a context derived from ctx
+func (r *JobRegistry) Start(ctx context.Context, filePath string) {
+	if r == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	var size int64
+	if info, err := os.Stat(filePath); err == nil {
+		size = info.Size()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	job := &Job{
+		ID:           strconv.FormatUint(r.nextID, 10),
+		Path:         filePath,
+		Filename:     filepath.Base(filePath),
+		State:        JobQueued,
+		OriginalSize: size,
+		CreatedAt:    time.Now(),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	r.jobs[job.ID] = job
+	r.active[filePath] = job
+	r.publish(JobEventState, job)
+}
+
+// Context returns the context the running job of a file is processed under, which Cancel cancels,
+// or parent if there is no job
+func (r *JobRegistry) Context(parent context.Context, filePath string) context.Context {
+	ctx := parent
+	r.Update(filePath, func(job *Job) {
+		ctx = job.ctx
+	})
+	return ctx
+}
+
+// Update changes the running job of a file, if there is one
+func (r *JobRegistry) Update(filePath string, update func(job *Job)) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.active[filePath]; ok {
+		update(job)
+	}
+}
+
+// SetState moves the running job of a file to a new state, recording when processing started
+func (r *JobRegistry) SetState(filePath string, state JobState) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.active[filePath]
+	if !ok || job.State == state {
+		return
+	}
+	job.State = state
+	job.Progress = nil
+	job.ETASeconds = 0
+	if state == JobProcessing && job.StartedAt == nil {
+		now := time.Now()
+		job.StartedAt = &now
+	}
+	r.publish(JobEventState, job)
+}
+
+// SetProgress records how far the command or the upload of the running job of a file got, in percent, and
+// the time it is expected to take to complete, 0 if unknown
+func (r *JobRegistry) SetProgress(filePath string, percent float64, eta time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.active[filePath]
+	if !ok || (job.State != JobProcessing && job.State != JobUploading) {
+		return
+	}
+	job.Progress = &percent
+	job.ETASeconds = int64(eta.Seconds())
+	r.publish(JobEventProgress, job)
+}
+
+// SetResult describes the outcome of the running job of a file
+func (r *JobRegistry) SetResult(filePath, result string) {
+	r.Update(filePath, func(job *Job) {
+		job.Result = result
+	})
+}
+
+// SetError records why the running job of a file failed
+func (r *JobRegistry) SetError(filePath string, err error) {
+	r.Update(filePath, func(job *Job) {
+		job.Error = err.Error()
+	})
+}
+
+// Finish ends the running job of a file. It failed if an error was recorded and nothing reached Immich.
+func (r *JobRegistry) Finish(filePath string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.active[filePath]
+	if !ok {
+		return
+	}
+	delete(r.active, filePath)
+	job.cancel()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Progress = nil
+	job.ETASeconds = 0
+	switch {
+	case job.AssetID != "":
+		job.State = JobDone
+	case job.cancelled:
+		job.State = JobCancelled
+	case job.Error != "":
+		job.State = JobFailed
+	default:
+		job.State = JobDone
+	}
+
+	r.publish(JobEventState, job)
+	r.prune()
+}
+
+// Cancel stops a queued or processing job, killing its running command. With forward set the original
+// file is uploaded unmodified instead.
+func (r *JobRegistry) Cancel(id string, forward bool) (Job, error) {
+	if r == nil {
+		return Job{}, ErrJobNotFound
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	if job.State != JobQueued && job.State != JobProcessing {
+		return job.snapshot(), ErrJobNotCancellable
+	}
+
+	job.cancelled = true
+	job.forward = forward
+	job.cancel()
+	return job.snapshot(), nil
+}
+
+// Cancelled reports whether the running job of a file was cancelled and whether its original should be
+// forwarded
+func (r *JobRegistry) Cancelled(filePath string) (cancelled, forward bool) {
+	r.Update(filePath, func(job *Job) {
+		cancelled, forward = job.cancelled, job.forward
+	})
+	return cancelled, forward
+}
+
+// prune forgets finished jobs older than jobHistoryTTL and the oldest ones beyond jobHistoryLimit
+func (r *JobRegistry) prune() {
+	var finished []*Job
+	for id, job := range r.jobs {
+		if !job.Finished() {
+			continue
+		}
+		if time.Since(*job.FinishedAt) > jobHistoryTTL {
+			delete(r.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= jobHistoryLimit {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-jobHistoryLimit] {
+		delete(r.jobs, job.ID)
+	}
+}
+
+// Get returns a copy of a job by id
+func (r *JobRegistry) Get(id string) (Job, bool) {
+	if r == nil {
+		return Job{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// List returns copies of the known jobs in the given state, or in any state if empty, newest first
+func (r *JobRegistry) List(state JobState) []Job {
+	if r == nil {
+		return []Job{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune()
+	jobs := make([]Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		if state == "" || job.State == state {
+			jobs = append(jobs, job.snapshot())
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// snapshot copies the job, computing its duration so far
+func (j *Job) snapshot() Job {
+	job := *j
+	switch {
+	case job.FinishedAt != nil:
+		job.DurationMs = job.FinishedAt.Sub(job.CreatedAt).Milliseconds()
+	default:
+		job.DurationMs = time.Since(job.CreatedAt).Milliseconds()
+	}
+	return job
+}
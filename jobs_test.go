@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobRegistryExpiresFinishedJobs(t *testing.T) {
+	r := NewJobRegistry()
+	r.Start(context.Background(), "/watch/old.jpg")
+	r.Finish("/watch/old.jpg")
+	r.Start(context.Background(), "/watch/recent.jpg")
+	r.Finish("/watch/recent.jpg")
+	r.Start(context.Background(), "/watch/running.jpg")
+
+	r.mu.Lock()
+	for _, job := range r.jobs {
+		if job.Path == "/watch/old.jpg" {
+			expired := time.Now().Add(-jobHistoryTTL - time.Minute)
+			job.FinishedAt = &expired
+		}
+	}
+	r.mu.Unlock()
+
+	jobs := r.List("")
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.Path == "/watch/old.jpg" {
+			t.Errorf("job finished beyond the TTL was kept")
+		}
+	}
+	if running := r.List(JobQueued); len(running) != 1 || running[0].Path != "/watch/running.jpg" {
+		t.Errorf("running job: got %+v", running)
+	}
+}
+
+func TestJobRegistryCapsHistory(t *testing.T) {
+	r := NewJobRegistry()
+	for i := range jobHistoryLimit + 10 {
+		path := fmt.Sprintf("/watch/%d.jpg", i)
+		r.Start(context.Background(), path)
+		r.Finish(path)
+	}
+	r.Start(context.Background(), "/watch/running.jpg")
+
+	jobs := r.List("")
+	if len(jobs) != jobHistoryLimit+1 {
+		t.Fatalf("got %d jobs, want %d", len(jobs), jobHistoryLimit+1)
+	}
+	for i := range 10 {
+		if _, ok := r.Get(fmt.Sprint(i + 1)); ok {
+			t.Errorf("oldest job %d was kept", i+1)
+		}
+	}
+	if _, ok := r.Get(fmt.Sprint(jobHistoryLimit + 10)); !ok {
+		t.Errorf("newest finished job was dropped")
+	}
+}
+
+func TestJobRegistryFinishStates(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(r *JobRegistry, path string)
+		want  JobState
+	}{
+		{"done", func(r *JobRegistry, path string) {}, JobDone},
+		{"failed", func(r *JobRegistry, path string) { r.SetError(path, fmt.Errorf("boom")) }, JobFailed},
+		{"uploaded despite error", func(r *JobRegistry, path string) {
+			r.SetError(path, fmt.Errorf("boom"))
+			r.Update(path, func(job *Job) { job.AssetID = "asset" })
+		}, JobDone},
+		{"cancelled", func(r *JobRegistry, path string) {
+			if _, err := r.Cancel("1", false); err != nil {
+				t.Fatal(err)
+			}
+		}, JobCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewJobRegistry()
+			r.Start(context.Background(), "/watch/a.jpg")
+			tt.setup(r, "/watch/a.jpg")
+			r.Finish("/watch/a.jpg")
+			job, ok := r.Get("1")
+			if !ok || job.State != tt.want {
+				t.Errorf("got %q, want %q", job.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobRegistryConcurrentUse(t *testing.T) {
+	r := NewJobRegistry()
+	events, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for range events {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				path := fmt.Sprintf("/watch/%d/%d.jpg", worker, i)
+				r.Start(context.Background(), path)
+				r.SetState(path, JobProcessing)
+				r.SetProgress(path, 50, time.Second)
+				r.SetResult(path, "optimized")
+				r.Finish(path)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				r.List("")
+				r.List(JobProcessing)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 1600 jobs finished, the history keeps the newest jobHistoryLimit of them
+	jobs := r.List("")
+	if len(jobs) != jobHistoryLimit {
+		t.Fatalf("got %d jobs, want %d", len(jobs), jobHistoryLimit)
+	}
+	for _, job := range jobs {
+		if job.State != JobDone || job.Result != "optimized" || job.FinishedAt == nil {
+			t.Fatalf("got %+v, want a done job", job)
+		}
+	}
+
+	// Cancelling a finished job changes nothing
+	job := jobs[0]
+	if _, err := r.Cancel(job.ID, true); !errors.Is(err, ErrJobNotCancellable) {
+		t.Errorf("got %v, want ErrJobNotCancellable", err)
+	}
+	if got, _ := r.Get(job.ID); got.State != JobDone {
+		t.Errorf("cancelled finished job is %q", got.State)
+	}
+	if cancelled, _ := r.Cancelled(job.Path); cancelled {
+		t.Errorf("finished job was marked cancelled")
+	}
+}
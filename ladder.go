@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// QualityLadder runs a task again at the next of its qualities while the result is larger than the
+// target, e.g. qualities [23, 27, 31, 35] for the CRF of a video transcode. The command reads the
+// quality being tried from {{.quality}}. The last quality is the floor: its result is kept even when it
+// still misses the target, leaving the policy to decide whether it replaces the original.
+type QualityLadder struct {
+	Qualities []float64 `mapstructure:"qualities"`
+	// TargetSize is the size the result must not exceed, e.g. 50MB
+	TargetSize string `mapstructure:"target_size"`
+	// TargetRatio is the share of the original size the result must not exceed, e.g. 50%
+	TargetRatio string `mapstructure:"target_ratio"`
+	targetSize  int64
+	targetRatio float64
+}
+
+func (ladder *QualityLadder) Init() (err error) {
+	if len(ladder.Qualities) == 0 {
+		return fmt.Errorf("qualities is required")
+	}
+	if ladder.TargetSize == "" && ladder.TargetRatio == "" {
+		return fmt.Errorf("one of target_size and target_ratio is required")
+	}
+
+	if ladder.TargetSize != "" {
+		if ladder.targetSize, err = parseSize(ladder.TargetSize); err != nil {
+			return fmt.Errorf("target_size: %v", err)
+		}
+	}
+	if ladder.TargetRatio != "" {
+		if ladder.targetRatio, err = parsePercentage(ladder.TargetRatio); err != nil {
+			return fmt.Errorf("target_ratio: %v", err)
+		}
+	}
+	return nil
+}
+
+// Reached reports whether a result of processedSize bytes is small enough, meeting every target set
+func (ladder *QualityLadder) Reached(originalSize, processedSize int64) bool {
+	if ladder.targetSize > 0 && processedSize > ladder.targetSize {
+		return false
+	}
+	if ladder.targetRatio > 0 && float64(processedSize) > ladder.targetRatio*float64(originalSize) {
+		return false
+	}
+	return true
+}
+
+// runLadder runs the task at each quality of its ladder in turn until the result reaches the target or
+// the floor is reached. A result of the built-in encoder, which does not use the quality, ends the ladder.
+func (tp *TaskProcessor) runLadder(ctx context.Context, task *Task, timeout time.Duration) (cacheable bool, err error) {
+	defer func() { tp.quality = nil }()
+
+	for i, quality := range task.Ladder.Qualities {
+		if i > 0 {
+			if err := resetDir(tp.tempWorkDirSrc); err != nil {
+				return false, classifyTempError(err)
+			}
+			if err := resetDir(tp.tempWorkDirDst); err != nil {
+				return false, classifyTempError(err)
+			}
+		}
+
+		tp.quality = number(quality)
+		if cacheable, err = tp.runLocal(ctx, task, timeout); err != nil || !cacheable {
+			return cacheable, err
+		}
+
+		size, err := tp.resultSize(task)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case task.Ladder.Reached(tp.OriginalSize, size):
+			tp.logf("task %s: quality %v gave %s, within the target", task.Name, tp.quality, humanReadableSize(size))
+			return true, nil
+		case i == len(task.Ladder.Qualities)-1:
+			tp.logf("task %s: quality %v gave %s, still above the target at the lowest quality", task.Name, tp.quality, humanReadableSize(size))
+		default:
+			tp.logf("task %s: quality %v gave %s, above the target, trying %v", task.Name, tp.quality, humanReadableSize(size), number(task.Ladder.Qualities[i+1]))
+		}
+	}
+	return true, nil
+}
+
+// resultSize returns the size of the primary output of a task
+func (tp *TaskProcessor) resultSize(task *Task) (int64, error) {
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get file size: %w", err)
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrMediaLimitExceeded is returned for files whose decoded size would keep the task tools busy for hours
+var ErrMediaLimitExceeded = errors.New("media exceeds configured limits")
+
+// MediaLimits rejects pathological files, such as decompression bombs, before any task runs.
+// Zero values disable the corresponding check.
+type MediaLimits struct {
+	MaxMegapixels          float64 `mapstructure:"max_megapixels"`
+	MaxFrames              int64   `mapstructure:"max_frames"`
+	MaxMegapixelsPerSecond float64 `mapstructure:"max_megapixels_per_second"`
+}
+
+// MediaDimensions is the decoded size of a file as announced by its headers
+type MediaDimensions struct {
+	Width  int64
+	Height int64
+	Frames int64   // number of video frames, 0 for still images or when unknown
+	FPS    float64 // frames per second, 0 for still images or when unknown
+}
+
+func (l MediaLimits) Init() error {
+	if l.MaxMegapixels < 0 || l.MaxFrames < 0 || l.MaxMegapixelsPerSecond < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// Enabled reports whether any limit is set
+func (l MediaLimits) Enabled() bool {
+	return l.MaxMegapixels > 0 || l.MaxFrames > 0 || l.MaxMegapixelsPerSecond > 0
+}
+
+// Check returns an error wrapping ErrMediaLimitExceeded when the dimensions exceed a limit
+func (l MediaLimits) Check(d MediaDimensions) error {
+	megapixels := float64(d.Width*d.Height) / 1e6
+
+	if l.MaxMegapixels > 0 && megapixels > l.MaxMegapixels {
+		return fmt.Errorf("%w: %dx%d is %.1f megapixels, max_megapixels is %g", ErrMediaLimitExceeded, d.Width, d.Height, megapixels, l.MaxMegapixels)
+	}
+	if l.MaxFrames > 0 && d.Frames > l.MaxFrames {
+		return fmt.Errorf("%w: %d frames, max_frames is %d", ErrMediaLimitExceeded, d.Frames, l.MaxFrames)
+	}
+	if rate := megapixels * d.FPS; l.MaxMegapixelsPerSecond > 0 && rate > l.MaxMegapixelsPerSecond {
+		return fmt.Errorf("%w: %.0f megapixels per second, max_megapixels_per_second is %g", ErrMediaLimitExceeded, rate, l.MaxMegapixelsPerSecond)
+	}
+	return nil
+}
+
+// probeDimensions reads the decoded size of a file from its headers without decoding it, with the standard
+// library for JPEG and PNG and with ffprobe for everything else. ok is false when the size
+// cannot be determined, e.g. because ffprobe is not installed.
+func probeDimensions(filePath, mimeType string) (dimensions MediaDimensions, ok bool, err error) {
+	switch mimeType {
+	case "image/jpeg", "image/png":
+		file, err := os.Open(filePath)
+		if err != nil {
+			return dimensions, false, fmt.Errorf("unable to open file: %w", err)
+		}
+		defer file.Close()
+
+		config, _, err := image.DecodeConfig(file)
+		if err != nil {
+			return dimensions, false, nil
+		}
+		return MediaDimensions{Width: int64(config.Width), Height: int64(config.Height)}, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,nb_frames,avg_frame_rate:format=duration", "-of", "json", filePath).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return dimensions, false, nil
+	}
+	if err != nil {
+		return dimensions, false, fmt.Errorf("unable to probe dimensions: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			Width        int64  `json:"width"`
+			Height       int64  `json:"height"`
+			NbFrames     string `json:"nb_frames"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return dimensions, false, fmt.Errorf("unable to decode ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return dimensions, false, nil
+	}
+
+	stream := probe.Streams[0]
+	dimensions = MediaDimensions{Width: stream.Width, Height: stream.Height, FPS: parseFrameRate(stream.AvgFrameRate)}
+	dimensions.Frames, _ = strconv.ParseInt(stream.NbFrames, 10, 64)
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); dimensions.Frames == 0 && err == nil {
+		// Matroska and some MP4 files do not announce their frame count
+		dimensions.Frames = int64(duration * dimensions.FPS)
+	}
+	return dimensions, true, nil
+}
+
+// parseFrameRate parses an ffprobe rate such as 30000/1001, returning 0 when it is unknown
+func parseFrameRate(value string) float64 {
+	numerator, denominator, found := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+const (
+	// LivePhotosPreserve optimizes both halves of a Live Photo and carries their pairing over
+	LivePhotosPreserve = "preserve"
+	// LivePhotosPassthrough uploads both halves of a Live Photo unmodified
+	LivePhotosPassthrough = "passthrough"
+	// LivePhotosIgnore optimizes both halves of a Live Photo like any other file
+	LivePhotosIgnore = "ignore"
+)
+
+// livePhotoExtensions are those of the files an iPhone stores Live Photos in, the still and the video
+var livePhotoExtensions = []string{"heic", "heif", "jpg", "jpeg", "mov"}
+
+// contentIdentifierTag pairs the still and the video of a Live Photo: Immich links the two assets sharing it
+const contentIdentifierTag = "ContentIdentifier"
+
+// livePhotoID returns the ContentIdentifier of a file that is one half of an Apple Live Photo, or an empty
+// string for any other file. Without exiftool, no file is recognized as part of a Live Photo.
+func livePhotoID(ctx context.Context, filePath string, media MediaInfo) (string, error) {
+	if !slices.Contains(livePhotoExtensions, media.Extension) {
+		return "", nil
+	}
+
+	id, err := readContentIdentifier(ctx, filePath)
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", nil
+	}
+	return id, err
+}
+
+// preserveLivePhoto makes sure the primary output of a task keeps the ContentIdentifier of an original that
+// is one half of a Live Photo, writing it with exiftool when the command dropped it: as a QuickTime key in
+// videos, and by copying the Apple maker notes in images. The task fails when the pairing is lost anyway,
+// so the halves are not uploaded as unrelated assets.
+func (tp *TaskProcessor) preserveLivePhoto(ctx context.Context, task *Task) error {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	original := tp.OriginalFile.Name()
+	id, err := livePhotoID(ctx, original, tp.Media)
+	if err != nil {
+		return fmt.Errorf("unable to tell whether the original is part of a Live Photo: %w", err)
+	}
+	if id == "" {
+		return nil
+	}
+
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+	if outputID, _ := readContentIdentifier(ctx, output); outputID == id {
+		return nil
+	}
+
+	tp.debugf("task %s: restoring the Live Photo ContentIdentifier %s", task.Name, id)
+	args := []string{"-q", "-q", "-overwrite_original"}
+	if mimeType, _ := sniffMimeType(output); strings.HasPrefix(mimeType, "video/") {
+		args = append(args, "-Keys:"+contentIdentifierTag+"="+id)
+	} else {
+		args = append(args, "-tagsFromFile", original, "-MakerNotes")
+	}
+	if result, err := exec.CommandContext(ctx, "exiftool", append(args, output)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to restore the Live Photo ContentIdentifier with exiftool: %w\nOutput:\n%s", err, result)
+	}
+
+	if outputID, _ := readContentIdentifier(ctx, output); outputID != id {
+		return fmt.Errorf("the optimized file lost the Live Photo ContentIdentifier %s", id)
+	}
+	return nil
+}
+
+// readContentIdentifier returns the ContentIdentifier of a file, or an empty string when it has none
+func readContentIdentifier(ctx context.Context, filePath string) (string, error) {
+	tags, err := readTags(ctx, []string{contentIdentifierTag}, filePath)
+	if err != nil {
+		return "", err
+	}
+	id, _ := tags[0][contentIdentifierTag].(string)
+	return id, nil
+}
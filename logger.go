@@ -1,33 +1,183 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
 
 type customLogger struct {
-	logger *log.Logger
-	prefix string
+	logger    *log.Logger
+	prefix    string
+	subsystem string
 }
 
 func newCustomLogger(baseLogger any, additionalPrefix string) *customLogger {
 	switch logger := baseLogger.(type) {
 	case *log.Logger:
 		return &customLogger{
-			logger: logger,
-			prefix: additionalPrefix,
+			logger:    logger,
+			prefix:    additionalPrefix,
+			subsystem: logMain,
 		}
 	case *customLogger:
 		return &customLogger{
-			logger: logger.logger,
-			prefix: logger.prefix + additionalPrefix,
+			logger:    logger.logger,
+			prefix:    logger.prefix + additionalPrefix,
+			subsystem: logger.subsystem,
 		}
 	default:
 		panic("unsupported logger type")
 	}
 }
 
+// Subsystem returns a logger whose verbosity is controlled by the level of the named subsystem
+func (cl *customLogger) Subsystem(name string) *customLogger {
+	return &customLogger{
+		logger:    cl.logger,
+		prefix:    cl.prefix,
+		subsystem: name,
+	}
+}
+
 func (cl *customLogger) Println(v ...any) {
-	cl.logger.Println(cl.prefix, v)
+	if logLevels.Enabled(cl.subsystem, LogInfo) {
+		cl.logger.Println(cl.prefix, v)
+	}
 }
 
 func (cl *customLogger) Printf(format string, v ...any) {
-	cl.logger.Printf(cl.prefix+format, v...)
+	if logLevels.Enabled(cl.subsystem, LogInfo) {
+		cl.logger.Printf(cl.prefix+format, v...)
+	}
+}
+
+// Debugf logs details only worth seeing while troubleshooting the subsystem
+func (cl *customLogger) Debugf(format string, v ...any) {
+	if logLevels.Enabled(cl.subsystem, LogDebug) {
+		cl.logger.Printf(cl.prefix+format, v...)
+	}
+}
+
+// Errorf logs failures, which remain visible at every level
+func (cl *customLogger) Errorf(format string, v ...any) {
+	if logLevels.Enabled(cl.subsystem, LogError) {
+		cl.logger.Printf(cl.prefix+format, v...)
+	}
+}
+
+// LogLevel is the minimum severity a subsystem logs
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{LogDebug: "debug", LogInfo: "info", LogError: "error"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses debug, info or error
+func ParseLogLevel(value string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(value), name) {
+			return level, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("invalid log level %q, expected debug, info or error", value)
+}
+
+// Subsystems whose verbosity can be changed independently
+const (
+	logMain    = "main"
+	logWatcher = "watcher"
+	logTasks   = "tasks"
+	logImmich  = "immich"
+	logAdmin   = "admin"
+	logVerify  = "verify"
+	logIngest  = "ingest"
+	logGC      = "gc"
+	logWebhook = "webhook"
+)
+
+var logSubsystems = []string{logMain, logWatcher, logTasks, logImmich, logAdmin, logVerify, logIngest, logGC, logWebhook}
+
+// LogLevels holds the level of every subsystem and can be changed at runtime
+type LogLevels struct {
+	mu     sync.RWMutex
+	levels map[string]LogLevel
+}
+
+var logLevels = NewLogLevels()
+
+func NewLogLevels() *LogLevels {
+	levels := make(map[string]LogLevel, len(logSubsystems))
+	for _, subsystem := range logSubsystems {
+		levels[subsystem] = LogInfo
+	}
+	return &LogLevels{levels: levels}
+}
+
+// Enabled reports whether a subsystem logs messages of the given level
+func (l *LogLevels) Enabled(subsystem string, level LogLevel) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	current, ok := l.levels[subsystem]
+	return !ok || level >= current
+}
+
+// Set changes the level of one subsystem, or of all of them when subsystem is empty
+func (l *LogLevels) Set(subsystem string, level LogLevel) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if subsystem == "" {
+		for name := range l.levels {
+			l.levels[name] = level
+		}
+		return nil
+	}
+
+	if _, ok := l.levels[subsystem]; !ok {
+		return fmt.Errorf("unknown log subsystem %q, expected one of %s", subsystem, strings.Join(logSubsystems, ", "))
+	}
+	l.levels[subsystem] = level
+	return nil
+}
+
+// Apply parses settings such as "debug" or "watcher=debug" and applies them in order
+func (l *LogLevels) Apply(settings []string) error {
+	for _, setting := range settings {
+		subsystem, value, found := strings.Cut(setting, "=")
+		if !found {
+			subsystem, value = "", setting
+		}
+
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			return err
+		}
+		if err := l.Set(strings.TrimSpace(subsystem), level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the level of every subsystem by name
+func (l *LogLevels) Snapshot() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	snapshot := make(map[string]string, len(l.levels))
+	for subsystem, level := range l.levels {
+		snapshot[subsystem] = level.String()
+	}
+	return snapshot
 }
@@ -27,27 +27,82 @@ type AppConfig struct {
 	ImmichAPIKey          string
 	WatchDir              string
 	UndoneDir             string
+	DeadLetterDir         string
+	DeadLetterAfter       int
+	DeadLetterForward     bool
 	ConfigFile            string
+	HashDBFile            string
+	StoreURL              string
+	AdminListen           stringList
+	AdminToken            string
+	Hashes                stringList
+	HashAlgorithms        []string
+	VerifyInterval        time.Duration
+	VerifySample          int
+	IngestRoot            string
+	IngestEject           bool
+	LogLevel              stringList
+	ResultCacheDir        string
+	ResultCacheSize       string
+	ResultCacheTTL        time.Duration
+	TempBudgetSize        string
+	WebhookURL            string
+	MaxQueue              int
+	MaxJobsPerSource      int
+	HistoryRetention      time.Duration
+	SessionWindow         time.Duration
 	MaxConcurrentRequests int
+	Workers               int
+	MaxUploads            int
+	RemoteWorkerURL       string
+	RemoteWorkerToken     string
+	InteractiveSlots      int
 	HTTPTimeoutSeconds    int
 	InotifyBufferSize     int
-	Semaphore             chan struct{}
-	Tasks                 *Config
+	Slots                 *Slots
+	Uploads               *Slots
+	RemoteWorker          *RemoteWorker
+	Tasks                 *ConfigReloader
+	Store                 Store
+	HashDB                *HashDB
+	Stats                 *Stats
+	Maintenance           *Maintenance
+	WorkDirs              *WorkDirGC
+	Verifier              *Verifier
+	Ingester              *Ingester
+	Jobs                  *JobRegistry
+	ResultCache           *ResultCache
+	TempBudget            *TempBudget
+	Queue                 *FileQueue
+	History               *History
+	Sessions              *Sessions
+	DeadLetter            *DeadLetter
 }
 
 func NewAppConfig() *AppConfig {
-	maxConcurrent := 10
 	return &AppConfig{
-		MaxConcurrentRequests: maxConcurrent,
-		HTTPTimeoutSeconds:    120,
-		InotifyBufferSize:     8192, // 8KB buffer for better performance
-		Semaphore:             make(chan struct{}, maxConcurrent),
+		HTTPTimeoutSeconds: 120,
+		InotifyBufferSize:  8192, // 8KB buffer for better performance
+		Stats:              NewStats(),
+		Maintenance:        &Maintenance{},
+		Jobs:               NewJobRegistry(),
 	}
 }
 
 var appConfig *AppConfig
 
-func init() {
+// subcommands run instead of the watcher when named as the first argument, parsing their own flags
+var subcommands = map[string]func(args []string) int{
+	"discover": runDiscover,
+	"export":   runExport,
+	"import":   runImport,
+	"validate": runValidate,
+	"worker":   runWorker,
+}
+
+// parseFlags reads the configuration of the service from its flags and environment, in main rather than
+// init so the package can be tested
+func parseFlags() {
 	appConfig = NewAppConfig()
 
 	viper.SetEnvPrefix("iuo")
@@ -56,22 +111,116 @@ func init() {
 	viper.BindEnv("immich_api_key")
 	viper.BindEnv("watch_dir")
 	viper.BindEnv("undone_dir")
+	viper.BindEnv("dead_letter_dir")
+	viper.BindEnv("dead_letter_after")
+	viper.BindEnv("dead_letter_forward")
 	viper.BindEnv("tasks_file")
+	viper.BindEnv("hash_db")
+	viper.BindEnv("store")
+	viper.BindEnv("admin_listen")
+	viper.BindEnv("admin_token")
+	viper.BindEnv("hashes")
+	viper.BindEnv("verify_interval")
+	viper.BindEnv("verify_sample")
+	viper.BindEnv("ingest_root")
+	viper.BindEnv("ingest_eject")
+	viper.BindEnv("max_concurrency")
+	viper.BindEnv("interactive_slots")
+	viper.BindEnv("workers")
+	viper.BindEnv("max_uploads")
+	viper.BindEnv("remote_worker")
+	viper.BindEnv("remote_worker_token")
+	viper.BindEnv("log_level")
+	viper.BindEnv("result_cache_dir")
+	viper.BindEnv("result_cache_size")
+	viper.BindEnv("result_cache_ttl")
+	viper.BindEnv("temp_budget")
+	viper.BindEnv("webhook_url")
+	viper.BindEnv("max_queue")
+	viper.BindEnv("max_jobs_per_source")
+	viper.BindEnv("history_retention")
+	viper.BindEnv("session_window")
 
 	viper.SetDefault("immich_url", "")
 	viper.SetDefault("immich_api_key", "")
 	viper.SetDefault("watch_dir", "/watch")
 	viper.SetDefault("undone_dir", "/undone")
+	viper.SetDefault("dead_letter_dir", "/dead-letter")
+	viper.SetDefault("dead_letter_after", 0)
+	viper.SetDefault("dead_letter_forward", false)
 	viper.SetDefault("tasks_file", "tasks.yaml")
+	viper.SetDefault("hash_db", "")
+	viper.SetDefault("store", "")
+	viper.SetDefault("admin_listen", "")
+	viper.SetDefault("admin_token", "")
+	viper.SetDefault("hashes", hashSHA1)
+	viper.SetDefault("verify_interval", "0s")
+	viper.SetDefault("verify_sample", 5)
+	viper.SetDefault("ingest_root", "")
+	viper.SetDefault("ingest_eject", false)
+	viper.SetDefault("max_concurrency", 10)
+	viper.SetDefault("interactive_slots", 1)
+	viper.SetDefault("workers", 4)
+	viper.SetDefault("max_uploads", 2)
+	viper.SetDefault("remote_worker", "")
+	viper.SetDefault("remote_worker_token", "")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("result_cache_dir", "")
+	viper.SetDefault("result_cache_size", "10GB")
+	viper.SetDefault("result_cache_ttl", "720h")
+	viper.SetDefault("temp_budget", "")
+	viper.SetDefault("webhook_url", "")
+	viper.SetDefault("max_queue", 0)
+	viper.SetDefault("max_jobs_per_source", 0)
+	viper.SetDefault("history_retention", "2160h")
+	viper.SetDefault("session_window", "30m")
 
 	flag.BoolVar(&appConfig.ShowVersion, "version", false, "Show the current version")
 	flag.StringVar(&appConfig.ImmichURL, "immich_url", viper.GetString("immich_url"), "Immich server URL. Example: http://immich-server:2283")
 	flag.StringVar(&appConfig.ImmichAPIKey, "immich_api_key", viper.GetString("immich_api_key"), "Immich API key")
 	flag.StringVar(&appConfig.WatchDir, "watch_dir", viper.GetString("watch_dir"), "Directory to watch for new files")
 	flag.StringVar(&appConfig.UndoneDir, "undone_dir", viper.GetString("undone_dir"), "Directory to copy files that failed processing or upload")
+	flag.StringVar(&appConfig.DeadLetterDir, "dead_letter_dir", viper.GetString("dead_letter_dir"), "Directory files are moved to after failing processing -dead_letter_after times, with a record of the last error and command output")
+	flag.IntVar(&appConfig.DeadLetterAfter, "dead_letter_after", viper.GetInt("dead_letter_after"), "Number of times a file failing processing is tried, with a growing delay in between, before it is moved to -dead_letter_dir. Requires on_error: fail. Disabled if 0")
+	flag.BoolVar(&appConfig.DeadLetterForward, "dead_letter_forward", viper.GetBool("dead_letter_forward"), "Upload the original of a dead-lettered file to Immich unmodified before moving it aside")
 	flag.StringVar(&appConfig.ConfigFile, "tasks_file", viper.GetString("tasks_file"), "Path to the configuration file")
+	flag.StringVar(&appConfig.HashDBFile, "hash_db", viper.GetString("hash_db"), "Path to the database of already uploaded file hashes, shared by every ingestion path to avoid duplicate uploads. Disabled if empty")
+	flag.StringVar(&appConfig.StoreURL, "store", viper.GetString("store"), "Store for shared state such as uploaded hashes: memory:, file:///path/to/state.db or redis://[:password@]host:port/db. Enables deduplication, overriding -hash_db")
+	flag.Var(&appConfig.AdminListen, "admin_listen", "Address for the admin API, e.g. :2284 or unix:/run/iuo.sock. Repeat or separate with commas to listen on several addresses. Disabled if empty")
+	flag.StringVar(&appConfig.AdminToken, "admin_token", viper.GetString("admin_token"), "Bearer token required to access the admin API")
+	flag.Var(&appConfig.Hashes, "hashes", "Hash algorithms computed for every file in a single read and kept in the hash database: sha1, sha256, sha512, md5, xxh64. SHA-1 is always included as Immich identifies assets by it. Repeat or separate with commas")
+	flag.DurationVar(&appConfig.VerifyInterval, "verify_interval", viper.GetDuration("verify_interval"), "How often to download a sample of recently optimized assets back from Immich and verify them, e.g. 6h. Requires -store or -hash_db. Disabled if 0")
+	flag.IntVar(&appConfig.VerifySample, "verify_sample", viper.GetInt("verify_sample"), "Number of assets checked on every verification run")
+	flag.StringVar(&appConfig.IngestRoot, "ingest_root", viper.GetString("ingest_root"), "Directory removable media is mounted under, e.g. /media. The DCIM folder of every newly mounted volume is copied into the watch directory once. Disabled if empty")
+	flag.BoolVar(&appConfig.IngestEject, "ingest_eject", viper.GetBool("ingest_eject"), "Unmount removable media once its files are queued")
+	flag.IntVar(&appConfig.MaxConcurrentRequests, "max_concurrency", viper.GetInt("max_concurrency"), "Maximum number of task commands running at the same time")
+	flag.IntVar(&appConfig.InteractiveSlots, "interactive_slots", viper.GetInt("interactive_slots"), "Number of the concurrent task slots reserved for interactive jobs such as the test-task endpoint, which watch directory files can never take")
+	flag.IntVar(&appConfig.Workers, "workers", viper.GetInt("workers"), "Number of files from the watch directory processed at the same time. Their commands also share -max_concurrency")
+	flag.IntVar(&appConfig.MaxUploads, "max_uploads", viper.GetInt("max_uploads"), "Maximum number of uploads to Immich running at the same time")
+	flag.StringVar(&appConfig.RemoteWorkerURL, "remote_worker", viper.GetString("remote_worker"), "URL of a machine running the worker subcommand, e.g. http://gpu-box:2285, which runs the tasks marked remote. Disabled if empty")
+	flag.StringVar(&appConfig.RemoteWorkerToken, "remote_worker_token", viper.GetString("remote_worker_token"), "Bearer token of the remote worker")
+	flag.Var(&appConfig.LogLevel, "log_level", "Log level: debug, info or error, for every subsystem or as subsystem=level for one of main, watcher, tasks, immich, admin, verify, ingest, gc, webhook. Repeat or separate with commas. Can be changed at runtime via the admin API")
+	flag.StringVar(&appConfig.ResultCacheDir, "result_cache_dir", viper.GetString("result_cache_dir"), "Directory caching optimized files by the content of their original, so an original seen again is not optimized again. Disabled if empty")
+	flag.StringVar(&appConfig.ResultCacheSize, "result_cache_size", viper.GetString("result_cache_size"), "Maximum size of the result cache, e.g. 10GB. The oldest results are evicted first")
+	flag.DurationVar(&appConfig.ResultCacheTTL, "result_cache_ttl", viper.GetDuration("result_cache_ttl"), "How long optimized files are kept in the result cache")
+	flag.StringVar(&appConfig.TempBudgetSize, "temp_budget", viper.GetString("temp_budget"), "Maximum disk space taken by work folders and the result cache together, e.g. 20GB. Each file reserves twice its size while processed, the oldest cached results are evicted to make room, and files that do not fit wait. Unlimited if empty")
+	flag.StringVar(&appConfig.WebhookURL, "webhook_url", viper.GetString("webhook_url"), "URL receiving a JSON POST when a job starts, completes, fails or is cancelled. Disabled if empty")
+	flag.IntVar(&appConfig.MaxQueue, "max_queue", viper.GetInt("max_queue"), "Maximum number of files waiting to be processed. Further files stay in the watch directory until the queue drains. Unlimited if 0")
+	flag.IntVar(&appConfig.MaxJobsPerSource, "max_jobs_per_source", viper.GetInt("max_jobs_per_source"), "Maximum number of files from a single top-level folder of the watch directory, usually one per device, processed at the same time. Unlimited if 0")
+	flag.DurationVar(&appConfig.HistoryRetention, "history_retention", viper.GetDuration("history_retention"), "How long finished jobs are kept in the job history, which requires -store or -hash_db. Disabled if 0")
+	flag.DurationVar(&appConfig.SessionWindow, "session_window", viper.GetDuration("session_window"), "Files from the same top-level folder of the watch directory are grouped into one upload session until none arrived for this long")
 	flag.Parse()
 
+	if len(appConfig.AdminListen) == 0 {
+		appConfig.AdminListen.Set(viper.GetString("admin_listen"))
+	}
+	if len(appConfig.Hashes) == 0 {
+		appConfig.Hashes.Set(viper.GetString("hashes"))
+	}
+	if len(appConfig.LogLevel) == 0 {
+		appConfig.LogLevel.Set(viper.GetString("log_level"))
+	}
+
 	if appConfig.ShowVersion {
 		fmt.Println(printVersion())
 		os.Exit(0)
@@ -108,10 +257,61 @@ func (ac *AppConfig) validate() error {
 		return fmt.Errorf("immich_api_key appears to be too short (minimum 10 characters)")
 	}
 
+	if len(ac.AdminListen) > 0 && len(strings.TrimSpace(ac.AdminToken)) < 16 {
+		return fmt.Errorf("the -admin_token flag is required when the admin API is enabled (minimum 16 characters)")
+	}
+
 	if ac.ConfigFile == "" {
 		return fmt.Errorf("the -tasks_file flag is required")
 	}
 
+	if err := logLevels.Apply(ac.LogLevel); err != nil {
+		return fmt.Errorf("invalid -log_level: %w", err)
+	}
+
+	var err error
+	if ac.HashAlgorithms, err = parseHashAlgorithms(ac.Hashes); err != nil {
+		return err
+	}
+
+	if ac.VerifyInterval < 0 || ac.VerifySample < 1 {
+		return fmt.Errorf("-verify_interval must not be negative and -verify_sample must be at least 1")
+	}
+	if ac.VerifyInterval > 0 && ac.StoreURL == "" && ac.HashDBFile == "" {
+		return fmt.Errorf("the -verify_interval flag requires -store or -hash_db to remember uploaded assets")
+	}
+
+	if ac.IngestRoot != "" {
+		if info, err := os.Stat(ac.IngestRoot); err != nil || !info.IsDir() {
+			return fmt.Errorf("the -ingest_root directory %s does not exist", ac.IngestRoot)
+		}
+	}
+
+	if ac.MaxConcurrentRequests < 1 {
+		return fmt.Errorf("-max_concurrency must be at least 1")
+	}
+	if ac.InteractiveSlots < 0 || ac.InteractiveSlots >= ac.MaxConcurrentRequests {
+		return fmt.Errorf("-interactive_slots must be between 0 and %d", ac.MaxConcurrentRequests-1)
+	}
+	ac.Slots = NewSlots(ac.MaxConcurrentRequests, ac.InteractiveSlots)
+
+	if ac.Workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	if ac.MaxUploads < 1 {
+		return fmt.Errorf("-max_uploads must be at least 1")
+	}
+	ac.Uploads = NewSlots(ac.MaxUploads, 0)
+
+	if ac.RemoteWorkerURL != "" {
+		if len(ac.RemoteWorkerToken) < 16 {
+			return fmt.Errorf("-remote_worker_token must be at least 16 characters")
+		}
+		if ac.RemoteWorker, err = NewRemoteWorker(ac.RemoteWorkerURL, ac.RemoteWorkerToken); err != nil {
+			return fmt.Errorf("invalid -remote_worker: %v", err)
+		}
+	}
+
 	// Create watch directory if it doesn't exist
 	if mkdirErr := os.MkdirAll(ac.WatchDir, 0750); mkdirErr != nil {
 		return fmt.Errorf("error creating watch directory: %v", mkdirErr)
@@ -122,16 +322,85 @@ func (ac *AppConfig) validate() error {
 		return fmt.Errorf("error creating undone directory: %v", mkdirErr)
 	}
 
-	var err error
-	ac.Tasks, err = NewConfig(&ac.ConfigFile)
+	tasks, err := NewConfig(&ac.ConfigFile)
 	if err != nil {
 		return fmt.Errorf("error loading config file: %v", err)
 	}
+	ac.Tasks = NewConfigReloader(ac.ConfigFile, tasks)
+
+	if ac.DeadLetterAfter < 0 {
+		return fmt.Errorf("-dead_letter_after must not be negative")
+	}
+	if ac.DeadLetterAfter > 0 {
+		if mkdirErr := os.MkdirAll(ac.DeadLetterDir, 0750); mkdirErr != nil {
+			return fmt.Errorf("error creating dead-letter directory: %v", mkdirErr)
+		}
+		ac.DeadLetter = NewDeadLetter(ac.DeadLetterDir, ac.DeadLetterAfter, ac.DeadLetterForward)
+	}
+
+	if ac.HistoryRetention < 0 {
+		return fmt.Errorf("-history_retention must not be negative")
+	}
+	if ac.SessionWindow <= 0 {
+		return fmt.Errorf("-session_window must be positive")
+	}
+
+	if ac.MaxQueue < 0 {
+		return fmt.Errorf("-max_queue must not be negative")
+	}
+
+	if ac.MaxJobsPerSource < 0 {
+		return fmt.Errorf("-max_jobs_per_source must not be negative")
+	}
+
+	if ac.WebhookURL != "" {
+		if webhookURL, err := url.Parse(ac.WebhookURL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			return fmt.Errorf("-webhook_url must be an http or https URL")
+		}
+	}
+
+	if ac.ResultCacheDir != "" {
+		size, err := parseSize(ac.ResultCacheSize)
+		if err != nil {
+			return fmt.Errorf("invalid -result_cache_size: %v", err)
+		}
+		if ac.ResultCacheTTL <= 0 {
+			return fmt.Errorf("-result_cache_ttl must be positive")
+		}
+		if ac.ResultCache, err = NewResultCache(ac.ResultCacheDir, size, ac.ResultCacheTTL); err != nil {
+			return err
+		}
+	}
+
+	if ac.TempBudgetSize != "" {
+		budget, err := parseSize(ac.TempBudgetSize)
+		if err != nil {
+			return fmt.Errorf("invalid -temp_budget: %v", err)
+		}
+		if budget <= 0 {
+			return fmt.Errorf("-temp_budget must be positive")
+		}
+		ac.TempBudget = NewTempBudget(budget, ac.ResultCache)
+	}
+
+	store, bucket, err := openStateStore(ac.StoreURL, ac.HashDBFile)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		ac.Store = store
+		ac.HashDB = NewHashDB(store, bucket)
+	}
 
 	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		os.Exit(subcommands[os.Args[1]](os.Args[2:]))
+	}
+	parseFlags()
+
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -141,25 +410,80 @@ func main() {
 	baseLogger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	customLogger := newCustomLogger(baseLogger, "")
 	customLogger.Printf("Starting %s", printVersion())
+	logVariants(customLogger, config.Tasks.Config().Tasks)
+
+	if config.Store != nil {
+		defer config.Store.Close()
+	}
+
+	// Collect work folders left behind by previous runs
+	config.WorkDirs = NewWorkDirGC(os.TempDir(), newCustomLogger(customLogger, "gc: ").Subsystem(logGC))
+	config.WorkDirs.Start()
+	defer config.WorkDirs.Stop()
 
 	// Create Immich client
-	immichClient := NewImmichClient(config.ImmichURL, config.ImmichAPIKey, config.HTTPTimeoutSeconds, customLogger)
+	immichClient := NewImmichClient(config.ImmichURL, config.ImmichAPIKey, config.HTTPTimeoutSeconds, customLogger.Subsystem(logImmich))
+	immichClient.SetHashAlgorithms(config.HashAlgorithms)
+	if err := immichClient.ResolveUser(); err != nil {
+		customLogger.Printf("Unable to resolve Immich user, uploads will be attributed to an unknown user: %v", err)
+	}
+
+	if config.VerifyInterval > 0 {
+		config.Verifier = NewVerifier(immichClient, config.Store, config.VerifyInterval, config.VerifySample, newCustomLogger(customLogger, "verify: ").Subsystem(logVerify))
+		config.Verifier.Start()
+		defer config.Verifier.Stop()
+	}
+
+	if config.WebhookURL != "" {
+		webhook := NewWebhook(config.WebhookURL, config.Jobs, newCustomLogger(customLogger, "webhook: ").Subsystem(logWebhook))
+		webhook.Start()
+		defer webhook.Stop()
+	}
+
+	if config.Store != nil && config.HistoryRetention > 0 {
+		config.History = NewHistory(config.Store, config.HistoryRetention, config.Jobs, newCustomLogger(customLogger, "history: ").Subsystem(logMain))
+		config.History.Start()
+		defer config.History.Stop()
+	}
+
+	config.Sessions = NewSessions(config.SessionWindow, config.Jobs, newCustomLogger(customLogger, "sessions: ").Subsystem(logWatcher))
+	config.Sessions.Start()
+	defer config.Sessions.Stop()
+
+	config.Tasks.Start(newCustomLogger(customLogger, "config: ").Subsystem(logMain))
+	defer config.Tasks.Stop()
 
 	// Create file watcher
-	watcher, err := NewFileWatcher(config.WatchDir, immichClient, config.Tasks, baseLogger, config.InotifyBufferSize)
+	watcher, err := NewFileWatcher(config.WatchDir, immichClient, config.Tasks, customLogger.Subsystem(logWatcher), config.InotifyBufferSize)
 	if err != nil {
-		customLogger.Printf("Error creating file watcher: %v", err)
+		customLogger.Errorf("Error creating file watcher: %v", err)
 		os.Exit(1)
 	}
 	defer watcher.Stop()
+	config.Queue = watcher.queue
 
 	// Start watching
 	err = watcher.Start(config)
 	if err != nil {
-		customLogger.Printf("Error starting file watcher: %v", err)
+		customLogger.Errorf("Error starting file watcher: %v", err)
 		os.Exit(1)
 	}
 
+	if config.IngestRoot != "" {
+		config.Ingester = NewIngester(config.IngestRoot, config.WatchDir, config.IngestEject, config.HashDB, newCustomLogger(customLogger, "ingest: ").Subsystem(logIngest))
+		config.Ingester.Start()
+		defer config.Ingester.Stop()
+	}
+
+	var adminServer *AdminServer
+	if len(config.AdminListen) > 0 {
+		adminServer = NewAdminServer(config, newCustomLogger(customLogger, "admin: ").Subsystem(logAdmin))
+		if err := adminServer.Start(); err != nil {
+			customLogger.Errorf("Error starting admin API: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	// Block until we receive our signal
 	<-sigChan
 
@@ -172,6 +496,9 @@ func main() {
 	// Stop the watcher gracefully
 	done := make(chan struct{})
 	go func() {
+		if adminServer != nil {
+			adminServer.Stop(shutdownCtx)
+		}
 		watcher.Stop()
 		close(done)
 	}()
@@ -184,6 +511,25 @@ func main() {
 	}
 }
 
+// stringList is a flag.Value accepting repeated or comma separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
 func printVersion() string {
 	return fmt.Sprintf("immich-optimizer %s, commit %s, built at %s", version, commit, date)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MaintenanceStatus describes whether optimization is currently bypassed
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// Maintenance switches the optimizer into pure pass-through at runtime.
+// While enabled, files are uploaded as-is without running any task.
+type Maintenance struct {
+	mu     sync.RWMutex
+	status MaintenanceStatus
+}
+
+// Enable starts pass-through mode, keeping the original start time if it was already enabled
+func (m *Maintenance) Enable(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.status.Enabled {
+		now := time.Now()
+		m.status.Since = &now
+	}
+	m.status.Enabled = true
+	m.status.Reason = reason
+}
+
+// Disable resumes normal optimization
+func (m *Maintenance) Disable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status = MaintenanceStatus{}
+}
+
+// Enabled reports whether pass-through mode is active
+func (m *Maintenance) Enabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.status.Enabled
+}
+
+// Status returns a copy of the current maintenance state
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.status
+}
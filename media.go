@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffLength is the number of leading bytes inspected to detect the content type
+	sniffLength = 512
+	// codecProbeTimeout bounds a single ffprobe run
+	codecProbeTimeout = 30 * time.Second
+)
+
+// MediaInfo describes what a file really is, independently of its name
+type MediaInfo struct {
+	Extension   string // normalized file extension, without dot
+	MimeType    string // content type detected from the magic bytes
+	Codec       string // codec of the first video stream as reported by ffprobe, if probed
+	Size        int64
+	Width       int64 // pixel dimensions as stored in the file, 0 when not probed or unknown
+	Height      int64
+	Source      string // top-level folder of the watch directory the file came from, usually one per device
+	MotionPhoto bool   // JPEG with a video appended, see isMotionPhoto
+	Color       string // color profile, see ColorSDR, empty when not probed or unknown
+	Animated    bool   // image of several frames, see isAnimated
+}
+
+// DetectMedia sniffs the content type of a file and, when probeCodec is set, the codec of its first video stream
+func DetectMedia(filePath string, probeCodec bool) (MediaInfo, error) {
+	media := MediaInfo{
+		Extension: normalizeExtension(filepath.Ext(filePath)),
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return media, fmt.Errorf("unable to get file info: %w", err)
+	}
+	media.Size = info.Size()
+
+	if media.MimeType, err = sniffMimeType(filePath); err != nil {
+		return media, err
+	}
+
+	media.MotionPhoto = media.MimeType == "image/jpeg" && isMotionPhoto(filePath)
+	media.Animated = strings.HasPrefix(media.MimeType, "image/") && isAnimated(filePath, media.MimeType)
+
+	if probeCodec && strings.HasPrefix(media.MimeType, "video/") {
+		if media.Codec, err = probeVideoCodec(filePath); err != nil {
+			return media, err
+		}
+	}
+
+	return media, nil
+}
+
+// probeMediaDimensions adds the pixel dimensions of the file to media, leaving them 0 when they cannot be
+// determined
+func probeMediaDimensions(filePath string, media MediaInfo) (MediaInfo, error) {
+	dimensions, ok, err := probeDimensions(filePath, media.MimeType)
+	if ok {
+		media.Width, media.Height = dimensions.Width, dimensions.Height
+	}
+	return media, err
+}
+
+// matchesMimeType reports whether mimeType matches one of the patterns, such as image/heic or video/*
+func matchesMimeType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSource reports whether source matches one of the patterns, such as pixel-8 or EOS_DIGITAL-*.
+// Files directly in the watch directory have no source and match no pattern.
+func matchesSource(patterns []string, source string) bool {
+	if source == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffMimeType identifies the content type from the magic bytes, covering the image and video containers
+// phones produce that net/http does not know about
+func sniffMimeType(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open file: %w", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("unable to read file: %w", err)
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0x0A}),
+		bytes.HasPrefix(head, []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A}):
+		return "image/jxl", nil
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return isoMediaType(head), nil
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff", nil
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm", nil
+		}
+		return "video/x-matroska", nil
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return "video/x-msvideo", nil
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac", nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "audio/ogg", nil
+	}
+
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	return mimeType, nil
+}
+
+// isoMediaType maps the brands of an ISO base media file (HEIF, AVIF, MP4, QuickTime, ...) to a content type
+func isoMediaType(head []byte) string {
+	brands := []string{string(head[8:12])}
+	boxSize := int(head[0])<<24 | int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+	for offset := 16; offset+4 <= boxSize && offset+4 <= len(head); offset += 4 {
+		brands = append(brands, string(head[offset:offset+4]))
+	}
+
+	for _, brand := range brands {
+		switch brand {
+		case "avif", "avis":
+			return "image/avif"
+		}
+	}
+
+	switch brands[0] {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+		return "image/heic"
+	case "qt  ":
+		return "video/quicktime"
+	case "M4A ", "M4B ", "M4P ":
+		return "audio/mp4"
+	case "crx ":
+		return "image/x-canon-cr3"
+	case "3gp4", "3gp5", "3gp6", "3g2a":
+		return "video/3gpp"
+	default:
+		return "video/mp4"
+	}
+}
+
+// probeVideoCodec asks ffprobe for the codec of the first video stream
+func probeVideoCodec(filePath string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to probe video codec: %w", err)
+	}
+
+	return strings.ToLower(strings.TrimSpace(string(output))), nil
+}
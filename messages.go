@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Reasons a file did not reach Immich, each with a message that can be replaced in the tasks file
+const (
+	MessageProcessingFailed = "processing_failed"
+	MessageUploadFailed     = "upload_failed"
+	MessageUnmatched        = "unmatched"
+	MessageCancelled        = "cancelled"
+)
+
+// defaultMessages are shown when the tasks file does not replace them
+var defaultMessages = map[string]string{
+	MessageProcessingFailed: "{{.filename}} could not be optimized and was not uploaded: {{.error}}",
+	MessageUploadFailed:     "{{.filename}} could not be uploaded to Immich: {{.error}}",
+	MessageUnmatched:        "{{.filename}} was not uploaded, files of this type are not accepted",
+	MessageCancelled:        "{{.filename}} was not uploaded, its processing was cancelled",
+}
+
+// parseMessages parses the message templates of the tasks file over the defaults, making sure each renders
+func parseMessages(messages map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(defaultMessages))
+	for reason, text := range defaultMessages {
+		templates[reason] = template.Must(template.New(reason).Option("missingkey=error").Parse(text))
+	}
+
+	for reason, text := range messages {
+		if _, ok := defaultMessages[reason]; !ok {
+			return nil, fmt.Errorf("messages: unknown message %q, must be one of %s", reason, strings.Join(messageReasons(), ", "))
+		}
+		tmpl, err := template.New(reason).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse message %s: %w", reason, err)
+		}
+		if _, err := renderMessage(tmpl, "IMG_0001.jpg", "jpegli", "exit status 1"); err != nil {
+			return nil, fmt.Errorf("unable to execute message %s: %w", reason, err)
+		}
+		templates[reason] = tmpl
+	}
+	return templates, nil
+}
+
+// messageReasons returns the reasons a message can be configured for, sorted
+func messageReasons() []string {
+	reasons := make([]string, 0, len(defaultMessages))
+	for reason := range defaultMessages {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+func renderMessage(tmpl *template.Template, filename, task, errText string) (string, error) {
+	values := map[string]string{
+		"filename": filename,
+		"task":     task,
+		"error":    errText,
+	}
+
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, values); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(message.String()), nil
+}
+
+// message renders the message for reason about filePath, err may be nil
+func (c *Config) message(reason, filePath, task string, err error) string {
+	var errText string
+	if err != nil {
+		errText = err.Error()
+	}
+
+	tmpl := c.messages[reason]
+	if tmpl == nil {
+		tmpl = template.Must(template.New(reason).Parse(defaultMessages[reason]))
+	}
+	message, renderErr := renderMessage(tmpl, filepath.Base(filePath), task, errText)
+	if renderErr != nil {
+		return fmt.Sprintf("%s: %s", filepath.Base(filePath), reason)
+	}
+	return message
+}
+
+// copyToUndone copies a file that did not reach Immich to the undone directory and records why on its job.
+// When the tasks file configures the message for reason, it is also written next to the copy as
+// <file>.txt, so whoever looks through the undone directory reads it in their language.
+func (fw *FileWatcher) copyToUndone(filePath, reason string, err error) error {
+	if copyErr := copyFileToUndone(filePath, fw.watchDir, fw.appConfig.UndoneDir); copyErr != nil {
+		return copyErr
+	}
+
+	config := fw.config()
+	message := config.message(reason, filePath, "", err)
+	fw.jobs().Update(filePath, func(job *Job) {
+		message = config.message(reason, filePath, job.Task, err)
+		job.Message = message
+	})
+
+	if _, ok := config.Messages[reason]; !ok {
+		return nil
+	}
+	relPath, relErr := filepath.Rel(fw.watchDir, filePath)
+	if relErr != nil {
+		return fmt.Errorf("failed to get relative path: %w", relErr)
+	}
+	if writeErr := os.WriteFile(filepath.Join(fw.appConfig.UndoneDir, relPath)+".txt", []byte(message+"\n"), 0o640); writeErr != nil {
+		return fmt.Errorf("failed to write message: %w", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseMessages(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		messages map[string]string
+		wantErr  string
+	}{
+		{"defaults", nil, ""},
+		{"translated", map[string]string{MessageUploadFailed: "{{.filename}} konnte nicht hochgeladen werden"}, ""},
+		{"unknown message", map[string]string{"upload_failure": "{{.filename}}"}, "unknown message"},
+		{"unparsable", map[string]string{MessageUnmatched: "{{.filename"}, "unable to parse"},
+		{"unknown field", map[string]string{MessageCancelled: "{{.user}}"}, "unable to execute"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := parseMessages(tt.messages)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(templates) != len(defaultMessages) {
+				t.Errorf("got %d templates, want one for each of %v", len(templates), messageReasons())
+			}
+		})
+	}
+}
+
+func TestConfigMessage(t *testing.T) {
+	messages := map[string]string{
+		MessageProcessingFailed: "{{.filename}} ({{.task}}) ist fehlgeschlagen: {{.error}}. Fragen an Anna.",
+	}
+	templates, err := parseMessages(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Messages: messages, messages: templates}
+
+	got := config.message(MessageProcessingFailed, "/watch/phone/IMG_0001.jpg", "jpegli", errors.New("exit status 1"))
+	if want := "IMG_0001.jpg (jpegli) ist fehlgeschlagen: exit status 1. Fragen an Anna."; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got = config.message(MessageCancelled, "/watch/phone/IMG_0002.jpg", "", nil)
+	if want := "IMG_0002.jpg was not uploaded, its processing was cancelled"; got != want {
+		t.Errorf("got default %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// metadataTimeout bounds copying the metadata of one file with exiftool
+const metadataTimeout = 2 * time.Minute
+
+// preservedTags are checked after copying the metadata, a tag of the original missing from the optimized
+// file fails the task. Capture dates lost in transcoding put files at the wrong place of the timeline.
+var preservedTags = []string{"DateTimeOriginal", "CreateDate", "GPSLatitude", "GPSLongitude"}
+
+// preserveMetadata copies the EXIF, GPS and XMP metadata of the original into the primary output of a task
+// with exiftool, then verifies the capture date and location survived
+func (tp *TaskProcessor) preserveMetadata(ctx context.Context, task *Task) error {
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+	original := tp.OriginalFile.Name()
+
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	tp.debugf("task %s: copying metadata of the original", task.Name)
+	result, err := exec.CommandContext(ctx, "exiftool", "-q", "-q", "-overwrite_original", "-tagsFromFile", original,
+		"-all:all", output).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to copy metadata with exiftool: %w\nOutput:\n%s", err, result)
+	}
+
+	tags, err := readTags(ctx, preservedTags, original, output)
+	if err != nil {
+		return err
+	}
+	var lost []string
+	for _, tag := range preservedTags {
+		if _, ok := tags[0][tag]; ok {
+			if _, ok := tags[1][tag]; !ok {
+				lost = append(lost, tag)
+			}
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("metadata lost in the optimized file: %s", strings.Join(lost, ", "))
+	}
+	return nil
+}
+
+// readTags returns the tags present in each file, in the order of the files
+func readTags(ctx context.Context, tags []string, filePaths ...string) ([]map[string]any, error) {
+	args := []string{"-j", "-n", "-q", "-q"}
+	for _, tag := range tags {
+		args = append(args, "-"+tag)
+	}
+	output, err := exec.CommandContext(ctx, "exiftool", append(args, filePaths...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metadata with exiftool: %w", err)
+	}
+
+	var values []map[string]any
+	if err := json.Unmarshal(output, &values); err != nil {
+		return nil, fmt.Errorf("unable to parse exiftool output: %w", err)
+	}
+	if len(values) != len(filePaths) {
+		return nil, fmt.Errorf("unexpected exiftool output for %d files", len(filePaths))
+	}
+	return values, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/tar"
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migrationVersion is bumped when the layout of export archives changes incompatibly
+const migrationVersion = 1
+
+// migrationManifest is stored first in every export archive
+type migrationManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Host      string    `json:"host"`
+}
+
+// migrationState is the state shared by the export and import subcommands
+type migrationState struct {
+	flags     *flag.FlagSet
+	storeURL  *string
+	hashDB    *string
+	watchDir  *string
+	undoneDir *string
+	stateOnly *bool
+}
+
+func newMigrationState(name, usage string) *migrationState {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	s := &migrationState{
+		flags:     flags,
+		storeURL:  flags.String("store", os.Getenv("IUO_STORE"), "Store holding the shared state, as for the watcher"),
+		hashDB:    flags.String("hash_db", os.Getenv("IUO_HASH_DB"), "Hash database file, as for the watcher"),
+		watchDir:  flags.String("watch_dir", cmp.Or(os.Getenv("IUO_WATCH_DIR"), "/watch"), "Directory with the files waiting to be processed"),
+		undoneDir: flags.String("undone_dir", cmp.Or(os.Getenv("IUO_UNDONE_DIR"), "/undone"), "Directory with the files that failed processing or upload"),
+		stateOnly: flags.Bool("state_only", false, "Only migrate the hash database, not the pending and undone files"),
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <archive.tar.gz>\n\n%s\n\n", filepath.Base(os.Args[0]), name, usage)
+		flags.PrintDefaults()
+	}
+	return s
+}
+
+// parse parses the flags and opens the store, returning the archive path
+func (s *migrationState) parse(args []string) (string, Store, string, error) {
+	s.flags.Parse(args)
+	if s.flags.NArg() != 1 {
+		s.flags.Usage()
+		os.Exit(2)
+	}
+
+	store, bucket, err := openStateStore(*s.storeURL, *s.hashDB)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if store == nil && *s.stateOnly {
+		return "", nil, "", fmt.Errorf("-state_only requires -store or -hash_db")
+	}
+	return s.flags.Arg(0), store, bucket, nil
+}
+
+// migrationBuckets maps the bucket names used inside archives to the buckets of the configured store,
+// so hashes exported from a -hash_db file can be imported into a -store and the other way around
+func migrationBuckets(hashBucket string) map[string]string {
+	return map[string]string{
+		hashesBucket:       hashBucket,
+		replacementsBucket: replacementsBucket,
+	}
+}
+
+// runExport implements the export subcommand
+func runExport(args []string) int {
+	state := newMigrationState("export", "Writes the hash database, the files waiting in the watch directory and the undone files to a portable archive.")
+	archivePath, store, bucket, err := state.parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	if err := exportState(archivePath, store, bucket, state); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Remove(archivePath)
+		return 1
+	}
+	return 0
+}
+
+func exportState(archivePath string, store Store, hashBucket string, state *migrationState) error {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("unable to create archive: %w", err)
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+
+	host, _ := os.Hostname()
+	manifest, _ := json.Marshal(migrationManifest{Version: migrationVersion, CreatedAt: time.Now(), Host: host})
+	if err := writeArchiveFile(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+
+	if store != nil {
+		for name, bucket := range migrationBuckets(hashBucket) {
+			documents, err := store.List(bucket)
+			if err != nil {
+				return fmt.Errorf("unable to read bucket %s: %w", bucket, err)
+			}
+			// The documents are JSON themselves, they are embedded as they are rather than as base64 strings
+			embedded := make(map[string]json.RawMessage, len(documents))
+			for key, value := range documents {
+				embedded[key] = value
+			}
+			data, err := json.Marshal(embedded)
+			if err != nil {
+				return fmt.Errorf("unable to encode bucket %s: %w", bucket, err)
+			}
+			if err := writeArchiveFile(archive, path.Join("store", name+".json"), data); err != nil {
+				return err
+			}
+			fmt.Printf("Exported %d %s entries\n", len(documents), name)
+		}
+	}
+
+	if !*state.stateOnly {
+		for prefix, dir := range map[string]string{"watch": *state.watchDir, "undone": *state.undoneDir} {
+			count, err := exportDirectory(archive, prefix, dir)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Exported %d files from %s\n", count, dir)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("unable to write archive: %w", err)
+	}
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("unable to write archive: %w", err)
+	}
+	return file.Close()
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0o640, Size: int64(len(data)), ModTime: time.Now()}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("unable to write %s to archive: %w", name, err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return fmt.Errorf("unable to write %s to archive: %w", name, err)
+	}
+	return nil
+}
+
+// exportDirectory adds every regular file below dir to the archive under prefix, keeping modification times
+func exportDirectory(archive *tar.Writer, prefix, dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && filePath == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(prefix, filepath.ToSlash(relative))
+		if err := archive.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write %s to archive: %w", filePath, err)
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(archive, file); err != nil {
+			return fmt.Errorf("unable to write %s to archive: %w", filePath, err)
+		}
+
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("unable to export %s: %w", dir, err)
+	}
+	return count, nil
+}
+
+// runImport implements the import subcommand
+func runImport(args []string) int {
+	state := newMigrationState("import", "Restores an archive written by export. Hash database entries are merged into the configured store, files are restored into the watch and undone directories without overwriting existing ones.")
+	archivePath, store, bucket, err := state.parse(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	if err := importState(archivePath, store, bucket, state); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func importState(archivePath string, store Store, hashBucket string, state *migrationState) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("unable to open archive: %w", err)
+	}
+	defer file.Close()
+
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("unable to read archive: %w", err)
+	}
+	archive := tar.NewReader(compressed)
+
+	buckets := migrationBuckets(hashBucket)
+	directories := map[string]string{"watch": *state.watchDir, "undone": *state.undoneDir}
+	restored := make(map[string]int)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read archive: %w", err)
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("refusing unsafe archive entry %s", header.Name)
+		}
+		prefix, relative, _ := strings.Cut(name, "/")
+
+		switch {
+		case name == "manifest.json":
+			var manifest migrationManifest
+			if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+				return fmt.Errorf("invalid manifest: %w", err)
+			}
+			if manifest.Version > migrationVersion {
+				return fmt.Errorf("archive version %d is newer than supported version %d", manifest.Version, migrationVersion)
+			}
+			fmt.Printf("Importing archive created on %s at %s\n", manifest.Host, manifest.CreatedAt.Format(time.RFC3339))
+
+		case prefix == "store":
+			bucket, ok := buckets[strings.TrimSuffix(relative, ".json")]
+			if !ok || store == nil {
+				fmt.Printf("Skipping %s\n", name)
+				continue
+			}
+			count, err := importBucket(archive, store, bucket)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Imported %d %s entries\n", count, strings.TrimSuffix(relative, ".json"))
+
+		case directories[prefix] != "" && header.Typeflag == tar.TypeReg:
+			if *state.stateOnly {
+				continue
+			}
+			imported, err := importFile(archive, header, filepath.Join(directories[prefix], filepath.FromSlash(relative)))
+			if err != nil {
+				return err
+			}
+			if imported {
+				restored[prefix]++
+			}
+		}
+	}
+
+	for prefix, dir := range directories {
+		if !*state.stateOnly {
+			fmt.Printf("Restored %d files into %s\n", restored[prefix], dir)
+		}
+	}
+	return nil
+}
+
+func importBucket(r io.Reader, store Store, bucket string) (int, error) {
+	var documents map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&documents); err != nil {
+		return 0, fmt.Errorf("unable to decode bucket %s: %w", bucket, err)
+	}
+
+	for key, value := range documents {
+		// Archives of earlier versions hold the documents as base64 strings
+		if len(value) > 0 && value[0] == '"' {
+			var document []byte
+			if err := json.Unmarshal(value, &document); err != nil {
+				return 0, fmt.Errorf("unable to decode %s/%s: %w", bucket, key, err)
+			}
+			value = document
+		}
+		if err := store.Put(bucket, key, value); err != nil {
+			return 0, fmt.Errorf("unable to import %s/%s: %w", bucket, key, err)
+		}
+	}
+	return len(documents), nil
+}
+
+// importFile writes an archived file to target unless it already exists, restoring its modification time
+func importFile(r io.Reader, header *tar.Header, target string) (bool, error) {
+	if _, err := os.Stat(target); err == nil {
+		fmt.Printf("Keeping existing %s\n", target)
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+		return false, fmt.Errorf("unable to create folder for %s: %w", target, err)
+	}
+
+	// Write to a hidden temp name first so a running watcher never picks up a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(target), partialPrefix+"import-*")
+	if err != nil {
+		return false, fmt.Errorf("unable to create %s: %w", target, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("unable to write %s: %w", target, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("unable to write %s: %w", target, err)
+	}
+	os.Chtimes(tmp.Name(), header.ModTime, header.ModTime)
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, fmt.Errorf("unable to restore %s: %w", target, err)
+	}
+	return true, nil
+}
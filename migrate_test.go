@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMigrationState returns the state of a migration between the watch and undone folders below dir
+func testMigrationState(dir string, stateOnly bool) *migrationState {
+	watchDir, undoneDir := filepath.Join(dir, "watch"), filepath.Join(dir, "undone")
+	return &migrationState{watchDir: &watchDir, undoneDir: &undoneDir, stateOnly: &stateOnly}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "watch", "phone", "IMG_0001.jpg"), "pending")
+	writeTestFile(t, filepath.Join(src, "undone", "IMG_0002.jpg"), "failed")
+	writeTestFile(t, filepath.Join(dst, "watch", "phone", "IMG_0001.jpg"), "already there")
+
+	srcStore, err := NewBoltStore(filepath.Join(src, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcStore.Close()
+	if err := srcStore.Put(hashesBucket, "abc", []byte(`{"filename":"a.jpg"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(src, "export.tar.gz")
+	if err := exportState(archivePath, srcStore, hashesBucket, testMigrationState(src, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	dstStore, err := NewBoltStore(filepath.Join(dst, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstStore.Close()
+	// Hashes of a -hash_db file go into whatever bucket the destination keeps them in
+	if err := importState(archivePath, dstStore, "other-hashes", testMigrationState(dst, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok, err := dstStore.Get("other-hashes", "abc"); !ok || err != nil || string(value) != `{"filename":"a.jpg"}` {
+		t.Errorf("hash entry: got %s %v %v", value, ok, err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dst, "watch", "phone", "IMG_0001.jpg"): "already there",
+		filepath.Join(dst, "undone", "IMG_0002.jpg"):         "failed",
+	} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s: got %q %v, want %q", path, data, err, want)
+		}
+	}
+}
+
+func TestImportStateRejectsUnsafePaths(t *testing.T) {
+	for _, name := range []string{"/etc/passwd", "../escaped.jpg", "watch/../../escaped.jpg"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, "evil.tar.gz")
+			file, err := os.Create(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed := gzip.NewWriter(file)
+			archive := tar.NewWriter(compressed)
+			if err := writeArchiveFile(archive, name, []byte("evil")); err != nil {
+				t.Fatal(err)
+			}
+			archive.Close()
+			compressed.Close()
+			file.Close()
+
+			state := testMigrationState(filepath.Join(dir, "restore"), false)
+			err = importState(archivePath, nil, hashesBucket, state)
+			if err == nil || !strings.Contains(err.Error(), "unsafe") {
+				t.Errorf("got %v, want the entry refused", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "escaped.jpg")); err == nil {
+				t.Errorf("the entry was written outside the restore folders")
+			}
+		})
+	}
+}
+
+func TestImportBucketDecodesBase64Documents(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	archived := `{"abc":"eyJmaWxlbmFtZSI6ImEuanBnIn0=","def":{"filename":"d.jpg"}}`
+	if count, err := importBucket(strings.NewReader(archived), store, hashesBucket); count != 2 || err != nil {
+		t.Fatalf("got %d %v", count, err)
+	}
+	for key, want := range map[string]string{"abc": `{"filename":"a.jpg"}`, "def": `{"filename":"d.jpg"}`} {
+		if value, _, _ := store.Get(hashesBucket, key); string(value) != want {
+			t.Errorf("%s: got %s, want %s", key, value, want)
+		}
+	}
+}
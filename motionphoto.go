@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// MotionPhotoPassthrough leaves motion photos to other tasks, or uploads them as they are
+	MotionPhotoPassthrough = "passthrough"
+	// MotionPhotoReembed runs the task on the still, optimizes the video with motion_video_command when set,
+	// and embeds it again into the optimized JPEG
+	MotionPhotoReembed = "reembed"
+	// MotionPhotoIgnore runs the task on motion photos like on any JPEG, which usually drops the video
+	MotionPhotoIgnore = "ignore"
+
+	// motionPhotoProbeLength is how much of the start and the end of a JPEG is searched for the markers of
+	// a motion photo, the XMP of Google motion photos and the trailer of Samsung ones
+	motionPhotoProbeLength = 64 << 10
+)
+
+var (
+	// googleMotionPhotoMarkers are the XMP properties of Google motion photos, the current one and the
+	// earlier micro video
+	googleMotionPhotoMarkers = [][]byte{[]byte("MotionPhoto=\"1\""), []byte("MicroVideo=\"1\""), []byte("<GCamera:MotionPhoto>1<")}
+	// samsungMotionPhotoMarker precedes the video of Samsung motion photos and names it in their trailer
+	samsungMotionPhotoMarker = []byte("MotionPhoto_Data")
+	xmpNamespace             = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// initMotionPhoto checks how the task handles motion photos and prepares the task running the motion video
+// command on their video
+func (task *Task) initMotionPhoto() error {
+	switch task.MotionPhoto {
+	case "":
+		task.MotionPhoto = MotionPhotoPassthrough
+	case MotionPhotoPassthrough, MotionPhotoReembed, MotionPhotoIgnore:
+	default:
+		return fmt.Errorf("motion_photo must be one of %s, %s, %s", MotionPhotoPassthrough, MotionPhotoReembed, MotionPhotoIgnore)
+	}
+
+	if task.MotionVideoCmd == "" {
+		return nil
+	}
+	if task.MotionPhoto != MotionPhotoReembed {
+		return fmt.Errorf("motion_video_command requires motion_photo %s", MotionPhotoReembed)
+	}
+	if task.Remote {
+		return fmt.Errorf("motion_photo %s cannot be combined with remote", MotionPhotoReembed)
+	}
+	task.motionVideoTask = &Task{
+		Name:      task.Name + " motion video",
+		MimeTypes: []string{"video/*"},
+		Command:   task.MotionVideoCmd,
+		Timeout:   task.Timeout,
+		Resources: task.Resources,
+	}
+	return task.motionVideoTask.Init()
+}
+
+// isMotionPhoto reports whether a JPEG file is a Google or Samsung motion photo, with a video after the image
+func isMotionPhoto(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	head := make([]byte, min(info.Size(), motionPhotoProbeLength))
+	if _, err := io.ReadFull(file, head); err != nil {
+		return false
+	}
+	for _, marker := range googleMotionPhotoMarkers {
+		if bytes.Contains(head, marker) {
+			return true
+		}
+	}
+
+	tail := make([]byte, min(info.Size(), motionPhotoProbeLength))
+	if _, err := file.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return false
+	}
+	return bytes.Contains(tail, samsungMotionPhotoMarker)
+}
+
+// splitMotionPhoto returns the still image and the MP4 video of a motion photo
+func splitMotionPhoto(data []byte) (still, video []byte, err error) {
+	start := -1
+	if i := bytes.Index(data, samsungMotionPhotoMarker); i >= 0 {
+		start = i + len(samsungMotionPhotoMarker)
+		still = data[:i]
+	} else {
+		for i := 0; ; {
+			j := bytes.Index(data[i:], []byte("ftyp"))
+			if j < 0 {
+				break
+			}
+			// The ftyp box opens the video, its size is just before its type
+			if box := i + j - 4; box >= 0 && isMP4Box(data[box:]) {
+				start, still = box, data[:box]
+				break
+			}
+			i += j + 4
+		}
+	}
+	if start < 0 {
+		return nil, nil, fmt.Errorf("no video found in the motion photo")
+	}
+
+	// Samsung motion photos end with a trailer after the video, which is left out
+	end := start
+	for end < len(data) && isMP4Box(data[end:]) {
+		size := uint64(binary.BigEndian.Uint32(data[end:]))
+		if size == 1 {
+			size = binary.BigEndian.Uint64(data[end+8:])
+		}
+		// A box extending to or beyond the end of the file ends the video there
+		if size == 0 || size >= uint64(len(data)-end) {
+			end = len(data)
+			break
+		}
+		end += int(size)
+	}
+	if end == start {
+		return nil, nil, fmt.Errorf("no video found in the motion photo")
+	}
+	return still, data[start:end], nil
+}
+
+// isMP4Box reports whether data starts with a plausible ISO base media box: a size and a printable type
+func isMP4Box(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	for _, c := range data[4:8] {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	size := binary.BigEndian.Uint32(data)
+	switch {
+	case size == 1:
+		return len(data) >= 16 && binary.BigEndian.Uint64(data[8:]) >= 16
+	case size == 0:
+		return true
+	}
+	return size >= 8
+}
+
+// embedMotionVideo appends a video to a JPEG image, replacing its XMP with the description Google motion
+// photos use, which Immich and Google Photos read the video from
+func embedMotionVideo(image, video []byte) ([]byte, error) {
+	if !bytes.HasPrefix(image, []byte{0xFF, 0xD8}) {
+		return nil, fmt.Errorf("motion photos can only be embedded again in a JPEG")
+	}
+
+	xmp := motionPhotoXMP(len(video))
+	segment := make([]byte, 4, 4+len(xmpNamespace)+len(xmp))
+	segment[0], segment[1] = 0xFF, 0xE1
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(xmpNamespace)+len(xmp)))
+	segment = append(append(segment, xmpNamespace...), xmp...)
+
+	result := append([]byte{0xFF, 0xD8}, segment...)
+	pos := 2
+	for pos+4 <= len(image) && image[pos] == 0xFF && image[pos+1] != 0xDA {
+		end := pos + 2 + int(binary.BigEndian.Uint16(image[pos+2:]))
+		if end > len(image) {
+			return nil, fmt.Errorf("truncated JPEG segment")
+		}
+		if image[pos+1] != 0xE1 || !bytes.HasPrefix(image[pos+4:end], xmpNamespace) {
+			result = append(result, image[pos:end]...)
+		}
+		pos = end
+	}
+	result = append(result, image[pos:]...)
+	return append(result, video...), nil
+}
+
+// motionPhotoXMP describes a video of length bytes at the end of the file, in the current Google motion
+// photo format and the earlier micro video one
+func motionPhotoXMP(length int) []byte {
+	return []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:GCamera="http://ns.google.com/photos/1.0/camera/" ` +
+		`xmlns:Container="http://ns.google.com/photos/1.0/container/" xmlns:Item="http://ns.google.com/photos/1.0/container/item/" ` +
+		`GCamera:MotionPhoto="1" GCamera:MotionPhotoVersion="1" GCamera:MotionPhotoPresentationTimestampUs="-1" ` +
+		`GCamera:MicroVideo="1" GCamera:MicroVideoVersion="1" GCamera:MicroVideoOffset="` + strconv.Itoa(length) + `">` +
+		`<Container:Directory><rdf:Seq>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Mime="image/jpeg" Item:Semantic="Primary" Item:Length="0" Item:Padding="0"/></rdf:li>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Mime="video/mp4" Item:Semantic="MotionPhoto" Item:Length="` + strconv.Itoa(length) + `"/></rdf:li>` +
+		`</rdf:Seq></Container:Directory></rdf:Description></rdf:RDF></x:xmpmeta>`)
+}
+
+// splitWorkingCopy replaces the working copy of a motion photo with its still image, for the task to run
+// on, and keeps the video aside in the work directory
+func (tp *TaskProcessor) splitWorkingCopy(srcPath string) error {
+	data, err := os.ReadFile(srcPath)
+	if err != nil {
+		return fmt.Errorf("unable to read motion photo: %w", err)
+	}
+	still, video, err := splitMotionPhoto(data)
+	if err != nil {
+		return err
+	}
+
+	tp.motionVideo = filepath.Join(tp.tempWorkDir, "motion.mp4")
+	if err := os.WriteFile(tp.motionVideo, video, 0o600); err != nil {
+		return classifyTempError(fmt.Errorf("unable to write motion photo video: %w", err))
+	}
+	if err := os.WriteFile(srcPath, still, 0o600); err != nil {
+		return classifyTempError(fmt.Errorf("unable to write motion photo still: %w", err))
+	}
+	if err = os.Chtimes(srcPath, tp.OriginalModTime, tp.OriginalModTime); err != nil {
+		tp.logf("unable to set times of temp file: %v", err)
+	}
+	return nil
+}
+
+// reembedMotionVideo optimizes the video of a motion photo with the motion video command of the task, if
+// it has one, and embeds it into the primary output. A failing video command leaves the video as it was.
+func (tp *TaskProcessor) reembedMotionVideo(ctx context.Context, task *Task) error {
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+
+	video, err := os.ReadFile(tp.motionVideo)
+	if err != nil {
+		return fmt.Errorf("unable to read motion photo video: %w", err)
+	}
+	if task.motionVideoTask != nil {
+		optimized, err := tp.optimizeMotionVideo(ctx, task.motionVideoTask)
+		if err != nil {
+			tp.logf("task %s: keeping the motion photo video as it was: %v", task.Name, err)
+		} else if len(optimized) < len(video) {
+			tp.debugf("task %s: motion photo video optimized from %s to %s", task.Name, humanReadableSize(int64(len(video))), humanReadableSize(int64(len(optimized))))
+			video = optimized
+		}
+	}
+
+	image, err := os.ReadFile(output)
+	if err != nil {
+		return fmt.Errorf("unable to read optimized still: %w", err)
+	}
+	data, err := embedMotionVideo(image, video)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, data, 0o600); err != nil {
+		return classifyTempError(fmt.Errorf("unable to write motion photo: %w", err))
+	}
+	return nil
+}
+
+// optimizeMotionVideo runs the motion video command on the video of a motion photo, in a task processor
+// of its own sharing the slots, pools and limits of this one
+func (tp *TaskProcessor) optimizeMotionVideo(ctx context.Context, videoTask *Task) ([]byte, error) {
+	child, err := NewTaskProcessor(tp.motionVideo)
+	if err != nil {
+		return nil, err
+	}
+	defer child.Close()
+	child.logger, child.slots, child.interactive, child.pools = tp.logger, tp.slots, tp.interactive, tp.pools
+	child.timeout, child.resources, child.configDir, child.workDirs = tp.timeout, tp.resources, tp.configDir, tp.workDirs
+
+	if err := child.Process(ctx, []Task{*videoTask}); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(child.ProcessedFile.Name())
+}
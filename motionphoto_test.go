@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Box builds an ISO base media box of the given type around payload
+func mp4Box(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+// jpegWithXMP builds a minimal JPEG: an APP1 XMP segment when xmp is set, an APP0 segment and the scan
+func jpegWithXMP(xmp string) []byte {
+	image := []byte{0xFF, 0xD8}
+	if xmp != "" {
+		payload := append(append([]byte{}, xmpNamespace...), xmp...)
+		image = append(image, 0xFF, 0xE1, 0, 0)
+		binary.BigEndian.PutUint16(image[len(image)-2:], uint16(2+len(payload)))
+		image = append(image, payload...)
+	}
+	image = append(image, 0xFF, 0xE0, 0, 6, 'J', 'F', 'I', 'F')
+	return append(image, 0xFF, 0xDA, 0, 2, 0x11, 0x22, 0xFF, 0xD9)
+}
+
+var testMotionVideo = append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")), mp4Box("mdat", bytes.Repeat([]byte{7}, 100))...)
+
+func TestSplitMotionPhoto(t *testing.T) {
+	still := jpegWithXMP(`<x:xmpmeta GCamera:MotionPhoto="1"/>`)
+	samsungStill := jpegWithXMP("")
+	// The SEF trailer opens with a version that is not a box type
+	trailer := []byte("SEFH\x6b\x00\x00\x00\x01\x00\x00\x00MotionPhoto_Data SEFT")
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantStill []byte
+	}{
+		{"google", append(append([]byte{}, still...), testMotionVideo...), still},
+		{"samsung", append(append(append(append([]byte{}, samsungStill...), samsungMotionPhotoMarker...), testMotionVideo...), trailer...), samsungStill},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStill, gotVideo, err := splitMotionPhoto(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotStill, tt.wantStill) {
+				t.Errorf("still: got %d bytes, want %d", len(gotStill), len(tt.wantStill))
+			}
+			if !bytes.Equal(gotVideo, testMotionVideo) {
+				t.Errorf("video: got %d bytes, want %d", len(gotVideo), len(testMotionVideo))
+			}
+		})
+	}
+
+	for name, data := range map[string][]byte{
+		"plain jpeg":     still,
+		"ftyp in a scan": append(jpegWithXMP(""), "\x00\x00\x00\x04ftyp"...),
+	} {
+		if _, _, err := splitMotionPhoto(data); err == nil {
+			t.Errorf("%s: a video was found", name)
+		}
+	}
+}
+
+func TestSplitMotionPhotoLargeBoxSize(t *testing.T) {
+	// A 64 bit box size beyond the file ends the video at the end of the file
+	box := make([]byte, 16, 24)
+	binary.BigEndian.PutUint32(box, 1)
+	copy(box[4:], "mdat")
+	binary.BigEndian.PutUint64(box[8:], 1<<63+8)
+	box = append(box, "payload!"...)
+	video := append(mp4Box("ftyp", []byte("isom")), box...)
+
+	_, got, err := splitMotionPhoto(append(jpegWithXMP(""), video...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, video) {
+		t.Errorf("got %d bytes, want %d", len(got), len(video))
+	}
+}
+
+func TestEmbedMotionVideo(t *testing.T) {
+	image := jpegWithXMP(`<x:xmpmeta old="1"/>`)
+	result, err := embedMotionVideo(image, testMotionVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(result, []byte(`old="1"`)) {
+		t.Errorf("the previous XMP was kept")
+	}
+	if !bytes.Contains(result, []byte(`GCamera:MicroVideoOffset="124"`)) {
+		t.Errorf("the XMP does not give the length of the video")
+	}
+	if !bytes.HasSuffix(result, testMotionVideo) {
+		t.Errorf("the video is not at the end")
+	}
+
+	// The result is a motion photo again, which splits into the same video
+	path := filepath.Join(t.TempDir(), "PXL_0001.MP.jpg")
+	if err := os.WriteFile(path, result, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !isMotionPhoto(path) {
+		t.Errorf("the result is not detected as a motion photo")
+	}
+	still, video, err := splitMotionPhoto(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(video, testMotionVideo) || !bytes.HasSuffix(still, []byte{0xFF, 0xD9}) {
+		t.Errorf("split after embedding: %d byte still, %d byte video", len(still), len(video))
+	}
+
+	if _, err := embedMotionVideo([]byte("\x89PNG"), testMotionVideo); err == nil {
+		t.Errorf("a video was embedded in a PNG")
+	}
+}
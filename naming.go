@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultFilenameTemplate keeps the original name and only changes the extension
+const defaultFilenameTemplate = "{{.name}}.{{.extension}}"
+
+// parseFilenameTemplate parses the naming template for optimized files, making sure it renders a usable name
+func parseFilenameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse filename_template: %w", err)
+	}
+
+	name, err := renderFilename(tmpl, "IMG_0001", "jxl", "jpg")
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute filename_template: %w", err)
+	}
+	if name == "" || strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("filename_template must render a file name without folders, got %q", name)
+	}
+
+	return tmpl, nil
+}
+
+func renderFilename(tmpl *template.Template, name, extension, originalExtension string) (string, error) {
+	values := map[string]string{
+		"name":               name,
+		"extension":          extension,
+		"original_extension": originalExtension,
+	}
+
+	var filename bytes.Buffer
+	if err := tmpl.Execute(&filename, values); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(filename.String()), nil
+}
+
+// uploadFilename returns the name a file is uploaded to Immich with. Optimized files are named after the original
+// with the filename template; when another file in the same folder shares the original's name, as with IMG_1.jpg
+// and IMG_1.heic both becoming IMG_1.jxl, the original extension is kept in the name to tell them apart.
+func (c *Config) uploadFilename(originalFilePath, uploadFilePath string) string {
+	original := filepath.Base(originalFilePath)
+	if uploadFilePath == originalFilePath {
+		return sanitizeFilename(original)
+	}
+
+	originalExtension := filepath.Ext(original)
+	name := strings.TrimSuffix(original, originalExtension)
+	extension := filepath.Ext(uploadFilePath)
+	if !strings.EqualFold(extension, originalExtension) && hasSiblingWithStem(originalFilePath) {
+		name += "-" + normalizeExtension(originalExtension)
+	}
+
+	tmpl := c.filenameTemplate
+	if tmpl == nil {
+		tmpl = template.Must(parseFilenameTemplate(defaultFilenameTemplate))
+	}
+
+	filename, err := renderFilename(tmpl, name, strings.TrimPrefix(extension, "."), normalizeExtension(originalExtension))
+	if err != nil || filename == "" {
+		filename = name + extension
+	}
+	return sanitizeFilename(filename)
+}
+
+// hasSiblingWithStem reports whether another media file in the same folder has the same name up to the extension
+func hasSiblingWithStem(filePath string) bool {
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return false
+	}
+
+	base := filepath.Base(filePath)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == base || isSidecarFile(entry.Name()) {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), stem) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFilename normalizes a file name to NFC, as names coming from macOS are decomposed,
+// and drops control characters and path separators
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), r == unicode.ReplacementChar:
+			return -1
+		case r == '/' || r == '\\':
+			return '_'
+		default:
+			return r
+		}
+	}, norm.NFC.String(name))
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
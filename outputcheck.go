@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDurationTolerance is how much the duration of an optimized video may differ from the original
+const defaultDurationTolerance = time.Second
+
+// OutputValidation checks the result of every task before it replaces the original, failing the task
+// when the result is corrupt, so a flaky encoder does not silently replace a photo or video with a broken file
+type OutputValidation struct {
+	Enabled bool `mapstructure:"enabled"`
+	// DurationTolerance is how much the duration of an optimized video may differ from the original (default 1s)
+	DurationTolerance string `mapstructure:"duration_tolerance"`
+	durationTolerance time.Duration
+}
+
+func (v *OutputValidation) Init() (err error) {
+	v.durationTolerance = defaultDurationTolerance
+	if v.DurationTolerance != "" {
+		if v.durationTolerance, err = time.ParseDuration(v.DurationTolerance); err != nil || v.durationTolerance < 0 {
+			return fmt.Errorf("duration_tolerance: invalid duration %q", v.DurationTolerance)
+		}
+	}
+	return nil
+}
+
+// validateOutput checks the primary output of a task: it has to decode, a video has to have frames, and
+// a video or a recording has to last as long as the original, within the tolerance. The video and audio
+// checks are skipped when ffprobe is not installed.
+func (tp *TaskProcessor) validateOutput(task *Task) error {
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+
+	if _, err := decodeCheck(output); err != nil {
+		return fmt.Errorf("invalid output: %w", err)
+	}
+
+	mimeType, err := sniffMimeType(output)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mimeType, "audio/") {
+		return tp.validateDuration(output, "recording")
+	}
+	if !strings.HasPrefix(mimeType, "video/") {
+		return nil
+	}
+
+	frames, err := probeVideoFrames(output)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid output: %w", err)
+	}
+	if frames == 0 {
+		return fmt.Errorf("invalid output: the video has no frames")
+	}
+
+	if err := tp.validateDuration(output, "video"); err != nil {
+		return err
+	}
+	tp.debugf("task %s: output validated, %d frames", task.Name, frames)
+	return nil
+}
+
+// validateDuration checks that a video or audio output lasts as long as the original, within the tolerance
+func (tp *TaskProcessor) validateDuration(output, kind string) error {
+	original, optimized := tp.mediaDuration(), probeDuration(output)
+	if original > 0 && (optimized-original).Abs() > tp.validation.durationTolerance {
+		return fmt.Errorf("invalid output: the %s lasts %s instead of %s", kind, optimized.Round(time.Millisecond), original.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// probeVideoFrames asks ffprobe for the number of packets of the first video stream, which every frame
+// is stored in, without decoding them
+func probeVideoFrames(filePath string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-count_packets",
+		"-show_entries", "stream=nb_read_packets", "-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("unable to count the frames of the video: %w", err)
+	}
+
+	value := string(bytes.TrimSpace(output))
+	if value == "" {
+		return 0, nil
+	}
+	frames, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected ffprobe output %q", value)
+	}
+	return frames, nil
+}
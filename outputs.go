@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// OutputPrimary is the optimized file, uploaded in place of the original
+	OutputPrimary = "primary"
+	// OutputSidecar is uploaded as the XMP sidecar of the primary output
+	OutputSidecar = "sidecar"
+	// OutputStack is uploaded as an asset of its own and stacked below the primary output
+	OutputStack = "stack"
+	// OutputDiscard is left out of the upload
+	OutputDiscard = "discard"
+)
+
+// TaskOutput tells what becomes of the files a task writes whose name matches Pattern, such as *.mp4
+type TaskOutput struct {
+	Pattern string `mapstructure:"pattern"`
+	Role    string `mapstructure:"role"`
+}
+
+// ExtraOutput is a file a task wrote besides its primary output
+type ExtraOutput struct {
+	Path     string
+	Filename string // the name uploaded to Immich, after the original
+	Role     string
+}
+
+func (output *TaskOutput) Init() error {
+	switch output.Role {
+	case OutputPrimary, OutputSidecar, OutputStack, OutputDiscard:
+	default:
+		return fmt.Errorf("role must be one of %s, %s, %s, %s", OutputPrimary, OutputSidecar, OutputStack, OutputDiscard)
+	}
+	if _, err := filepath.Match(output.Pattern, ""); err != nil || output.Pattern == "" {
+		return fmt.Errorf("invalid pattern %q", output.Pattern)
+	}
+	return nil
+}
+
+// initOutputs checks the outputs of a task, of which exactly one has to describe the primary output
+func initOutputs(outputs []TaskOutput) error {
+	primaries := 0
+	for i := range outputs {
+		if err := outputs[i].Init(); err != nil {
+			return fmt.Errorf("outputs %d: %v", i+1, err)
+		}
+		if outputs[i].Role == OutputPrimary {
+			primaries++
+		}
+	}
+	if len(outputs) > 0 && primaries != 1 {
+		return fmt.Errorf("outputs must have exactly one %s output", OutputPrimary)
+	}
+	return nil
+}
+
+// outputRole returns the role of the first output whose pattern matches a file name, or an empty string
+func outputRole(outputs []TaskOutput, name string) string {
+	for _, output := range outputs {
+		if ok, _ := filepath.Match(strings.ToLower(output.Pattern), strings.ToLower(name)); ok {
+			return output.Role
+		}
+	}
+	return ""
+}
+
+// classifyOutputs returns the primary output of a task among the files in the destination folder, and the
+// others. A task without outputs has to write exactly one file. Otherwise every file has to match one of
+// the outputs, and exactly one the primary output.
+func (tp *TaskProcessor) classifyOutputs(task *Task) (string, []ExtraOutput, error) {
+	files, err := os.ReadDir(tp.tempWorkDirDst)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read temp directory: %w", err)
+	}
+
+	if len(task.Outputs) == 0 {
+		if len(files) != 1 {
+			return "", nil, fmt.Errorf("unexpected number of files in temp directory: %d", len(files))
+		}
+		return filepath.Join(tp.tempWorkDirDst, files[0].Name()), nil, nil
+	}
+
+	var primaries []string
+	var extras []ExtraOutput
+	sidecars := 0
+	for _, file := range files {
+		filePath := filepath.Join(tp.tempWorkDirDst, file.Name())
+		switch role := outputRole(task.Outputs, file.Name()); role {
+		case "":
+			return "", nil, fmt.Errorf("output %s matches none of the outputs of the task", file.Name())
+		case OutputPrimary:
+			primaries = append(primaries, filePath)
+		case OutputDiscard:
+		default:
+			if role == OutputSidecar {
+				sidecars++
+			}
+			extras = append(extras, ExtraOutput{Path: filePath, Role: role})
+		}
+	}
+	if len(primaries) != 1 {
+		return "", nil, fmt.Errorf("%d files match the primary output, expected 1", len(primaries))
+	}
+	if sidecars > 1 {
+		return "", nil, fmt.Errorf("%d files match the sidecar output, expected at most 1", sidecars)
+	}
+
+	// Outputs are named after the working copy of the original, file-123.mov giving e.g. file-123.mp4 and
+	// file-123-still.jpg; they are uploaded named after the original, IMG_1-still.jpg
+	stem := strings.TrimSuffix(filepath.Base(primaries[0]), filepath.Ext(primaries[0]))
+	originalStem := trimSuffixCaseInsensitive(tp.OriginalFilename, tp.OriginalExtension)
+	for i, extra := range extras {
+		name := filepath.Base(extra.Path)
+		if strings.HasPrefix(name, stem) {
+			name = originalStem + strings.TrimPrefix(name, stem)
+		}
+		extras[i].Filename = sanitizeFilename(name)
+	}
+	return primaries[0], extras, nil
+}
+
+// sidecarOutput returns the path of the sidecar the task wrote, or an empty string
+func (tp *TaskProcessor) sidecarOutput() string {
+	for _, extra := range tp.ExtraOutputs {
+		if extra.Role == OutputSidecar {
+			return extra.Path
+		}
+	}
+	return ""
+}
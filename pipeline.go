@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+const (
+	StepOnErrorFail = "fail"
+	StepOnErrorSkip = "skip"
+)
+
+// Step is one command of a task pipeline. It reads the output of the previous step, or the original for
+// the first step, from {{.src_folder}} and writes its own output to {{.dst_folder}}.
+type Step struct {
+	Command string `mapstructure:"command"`
+	// OnError is fail to fail the whole task when the step fails, or skip to pass its input on unchanged
+	OnError         string `mapstructure:"on_error"`
+	CommandTemplate *template.Template
+}
+
+func (step *Step) Init() (err error) {
+	if step.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+
+	switch step.OnError {
+	case "":
+		step.OnError = StepOnErrorFail
+	case StepOnErrorFail, StepOnErrorSkip:
+	default:
+		return fmt.Errorf("on_error must be one of %s, %s", StepOnErrorFail, StepOnErrorSkip)
+	}
+
+	step.CommandTemplate, err = parseCommandTemplate(step.Command)
+	return err
+}
+
+// runSteps runs the steps of a pipeline in order, moving the single file each step writes to the
+// destination folder into the source folder as the input of the next one. A step failing with
+// on_error: skip leaves its input to the next step. The input left after the last step is the result.
+func (tp *TaskProcessor) runSteps(ctx context.Context, task *Task, input string, timeout time.Duration, limits ResourceLimits) error {
+	for i, step := range task.Steps {
+		shell, err := tp.buildCommand(step.CommandTemplate, input)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		command := commandLine{shell: shell}
+		if err := tp.buildEnvironment(task, &command, input); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+
+		err = tp.executeCommand(ctx, command, task.PoolName(tp.Media), task.GPU, timeout, limits)
+		if err == nil {
+			input, err = tp.promoteOutput(input)
+		}
+		if err != nil {
+			if ctx.Err() != nil || step.OnError != StepOnErrorSkip {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+			tp.logf("task %s step %d failed, passing its input on: %v", task.Name, i+1, err)
+			if err := resetDir(tp.tempWorkDirDst); err != nil {
+				return classifyTempError(err)
+			}
+		}
+	}
+
+	if err := os.Rename(input, filepath.Join(tp.tempWorkDirDst, filepath.Base(input))); err != nil {
+		return fmt.Errorf("unable to move pipeline result: %w", err)
+	}
+	return nil
+}
+
+// promoteOutput replaces the input of a step with the file the step wrote and returns its new path
+func (tp *TaskProcessor) promoteOutput(input string) (string, error) {
+	files, err := os.ReadDir(tp.tempWorkDirDst)
+	if err != nil {
+		return "", fmt.Errorf("unable to read temp directory: %w", err)
+	}
+	if len(files) != 1 {
+		return "", fmt.Errorf("unexpected number of files in temp directory: %d", len(files))
+	}
+
+	if err := os.Remove(input); err != nil {
+		return "", fmt.Errorf("unable to remove step input: %w", err)
+	}
+	next := filepath.Join(tp.tempWorkDirSrc, files[0].Name())
+	if err := os.Rename(filepath.Join(tp.tempWorkDirDst, files[0].Name()), next); err != nil {
+		return "", fmt.Errorf("unable to move step output: %w", err)
+	}
+	return next, nil
+}
+
+// resetDir empties a folder, leaving the folder itself in place
+func resetDir(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Mkdir(dir, 0o700)
+}
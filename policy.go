@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	KeepOriginalNo    = "no"
+	KeepOriginalStack = "stack"
+
+	// PolicyDefault applies to every media type, for the fields the policy of the media type does not set
+	PolicyDefault = "default"
+	PolicyImage   = "image"
+	PolicyVideo   = "video"
+	PolicyAudio   = "audio"
+)
+
+// Policy decides what is uploaded once a task produced an optimized file.
+// Empty fields are inherited: from the media-type policy by a task, and from the defaults by a media-type policy.
+type Policy struct {
+	// MinSavings is how much smaller the optimized file must be to replace the original, e.g. 20%
+	MinSavings string `mapstructure:"min_savings"`
+	// MinSavingsSize is how many bytes the optimized file must save to replace the original, e.g. 100KB
+	MinSavingsSize string `mapstructure:"min_savings_size"`
+	// KeepOriginal set to stack also uploads the original and stacks it below the optimized asset
+	KeepOriginal string `mapstructure:"keep_original"`
+	// MinSSIM is the SSIM with the original, from 0 to 1, the optimized file must reach to replace it, e.g. 0.95
+	MinSSIM float64 `mapstructure:"min_ssim"`
+	// MinVMAF is the VMAF score with the original, from 0 to 100, the optimized file must reach to replace it
+	MinVMAF        float64 `mapstructure:"min_vmaf"`
+	minSavings     float64
+	minSavingsSize int64
+}
+
+func (p *Policy) Init() (err error) {
+	switch p.KeepOriginal {
+	case "", KeepOriginalNo, KeepOriginalStack:
+	default:
+		return fmt.Errorf("keep_original must be one of %s, %s", KeepOriginalNo, KeepOriginalStack)
+	}
+
+	if p.MinSSIM < 0 || p.MinSSIM > 1 {
+		return fmt.Errorf("min_ssim must be between 0 and 1")
+	}
+	if p.MinVMAF < 0 || p.MinVMAF > 100 {
+		return fmt.Errorf("min_vmaf must be between 0 and 100")
+	}
+
+	if p.MinSavings != "" {
+		if p.minSavings, err = parsePercentage(p.MinSavings); err != nil {
+			return fmt.Errorf("min_savings: %v", err)
+		}
+	}
+	if p.MinSavingsSize != "" {
+		if p.minSavingsSize, err = parseSize(p.MinSavingsSize); err != nil {
+			return fmt.Errorf("min_savings_size: %v", err)
+		}
+	}
+	return nil
+}
+
+// override returns the policy with the fields set in other taking precedence
+func (p Policy) override(other Policy) Policy {
+	if other.MinSavings != "" {
+		p.MinSavings, p.minSavings = other.MinSavings, other.minSavings
+	}
+	if other.MinSavingsSize != "" {
+		p.MinSavingsSize, p.minSavingsSize = other.MinSavingsSize, other.minSavingsSize
+	}
+	if other.KeepOriginal != "" {
+		p.KeepOriginal = other.KeepOriginal
+	}
+	if other.MinSSIM != 0 {
+		p.MinSSIM = other.MinSSIM
+	}
+	if other.MinVMAF != 0 {
+		p.MinVMAF = other.MinVMAF
+	}
+	return p
+}
+
+// Replaces reports whether an optimized file of processedSize bytes saves enough to replace the original,
+// both the percentage and the size of the savings have to be met
+func (p Policy) Replaces(originalSize, processedSize int64) bool {
+	if processedSize <= 0 || processedSize >= originalSize {
+		return false
+	}
+	saved := originalSize - processedSize
+	return float64(saved) >= p.minSavings*float64(originalSize) && saved >= p.minSavingsSize
+}
+
+// Stacks reports whether the original is kept in Immich, stacked below the optimized asset
+func (p Policy) Stacks() bool {
+	return p.KeepOriginal == KeepOriginalStack
+}
+
+// mediaPolicyKey returns the policies entry applying to a content type, or an empty string if none does
+func mediaPolicyKey(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return PolicyImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return PolicyVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return PolicyAudio
+	}
+	return ""
+}
+
+// parsePercentage parses values such as 20% or 20 into a fraction between 0 and 1
+func parsePercentage(value string) (float64, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "%")), 64)
+	if err != nil || number < 0 || number >= 100 {
+		return 0, fmt.Errorf("invalid percentage %q, expected a value such as 20%%", value)
+	}
+	return number / 100, nil
+}
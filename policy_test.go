@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func mustPolicy(t *testing.T, p Policy) Policy {
+	t.Helper()
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPolicyOverride(t *testing.T) {
+	base := mustPolicy(t, Policy{MinSavings: "20%", MinSavingsSize: "1KB", KeepOriginal: KeepOriginalNo, MinSSIM: 0.9})
+
+	got := base.override(mustPolicy(t, Policy{MinSavings: "50%", KeepOriginal: KeepOriginalStack}))
+	if got.MinSavings != "50%" || got.minSavings != 0.5 {
+		t.Errorf("min_savings: got %q (%v), want 50%%", got.MinSavings, got.minSavings)
+	}
+	if got.MinSavingsSize != "1KB" || got.minSavingsSize != 1024 {
+		t.Errorf("min_savings_size: got %q (%d), want the inherited 1KB", got.MinSavingsSize, got.minSavingsSize)
+	}
+	if !got.Stacks() {
+		t.Errorf("keep_original: got %q, want stack", got.KeepOriginal)
+	}
+	if got.MinSSIM != 0.9 {
+		t.Errorf("min_ssim: got %v, want the inherited 0.9", got.MinSSIM)
+	}
+
+	if got := base.override(Policy{}); got != base {
+		t.Errorf("an empty policy changed %+v into %+v", base, got)
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	c := &Config{Policies: map[string]Policy{
+		PolicyDefault: mustPolicy(t, Policy{MinSavings: "10%"}),
+		PolicyVideo:   mustPolicy(t, Policy{KeepOriginal: KeepOriginalStack}),
+	}}
+	task := &Task{Policy: mustPolicy(t, Policy{MinSavings: "30%"})}
+
+	tests := []struct {
+		name       string
+		task       *Task
+		mimeType   string
+		minSavings float64
+		stacks     bool
+	}{
+		{"image without a policy", nil, "image/jpeg", 0.1, false},
+		{"video policy", nil, "video/mp4", 0.1, true},
+		{"task over video policy", task, "video/mp4", 0.3, true},
+		{"unknown type", task, "application/octet-stream", 0.3, false},
+	}
+	for _, tt := range tests {
+		policy := c.policyFor(tt.task, MediaInfo{MimeType: tt.mimeType})
+		if policy.minSavings != tt.minSavings || policy.Stacks() != tt.stacks {
+			t.Errorf("%s: got min savings %v, stacks %v", tt.name, policy.minSavings, policy.Stacks())
+		}
+	}
+}
+
+func TestPolicyReplaces(t *testing.T) {
+	p := mustPolicy(t, Policy{MinSavings: "20%", MinSavingsSize: "100"})
+	tests := []struct {
+		original, processed int64
+		want                bool
+	}{
+		{1000, 800, true},
+		{1000, 801, false},
+		{400, 300, true},
+		{400, 301, false},
+		{1000, 0, false},
+		{1000, 1200, false},
+	}
+	for _, tt := range tests {
+		if got := p.Replaces(tt.original, tt.processed); got != tt.want {
+			t.Errorf("Replaces(%d, %d) = %v, want %v", tt.original, tt.processed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// gpuPool is the pool limiting the commands of tasks marked gpu to the configured gpu_sessions
+const gpuPool = "gpu"
+
+// Pools limits how many commands of each category run at once, on top of the global slots, so a few
+// long video transcodes cannot take every slot away from cheap image conversions.
+// A nil *Pools limits nothing.
+type Pools struct {
+	pools map[string]chan struct{}
+}
+
+// NewPools creates a pool per name allowing the given number of concurrent commands
+func NewPools(limits map[string]int) (*Pools, error) {
+	pools := make(map[string]chan struct{}, len(limits))
+	for name, limit := range limits {
+		if limit < 1 {
+			return nil, fmt.Errorf("pool %s must allow at least 1 command", name)
+		}
+		pools[name] = make(chan struct{}, limit)
+	}
+	return &Pools{pools: pools}, nil
+}
+
+// Acquire waits for a free slot in the named pool and returns the function releasing it.
+// Commands of a category without a pool are not limited.
+func (p *Pools) Acquire(ctx context.Context, name string) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	pool, ok := p.pools[name]
+	if !ok {
+		return func() {}, nil
+	}
+
+	select {
+	case pool <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func() { <-pool }, nil
+}
+
+// Has reports whether a pool with the given name exists
+func (p *Pools) Has(name string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.pools[name]
+	return ok
+}
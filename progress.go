@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressFunc receives the completion of a running command in percent and the estimated time left,
+// which is 0 while unknown
+type ProgressFunc func(percent float64, eta time.Duration)
+
+var (
+	// ffmpegDurationPattern matches the duration of the input file ffmpeg prints before encoding
+	ffmpegDurationPattern = regexp.MustCompile(`Duration: (\d+:\d+:\d+(?:\.\d+)?)`)
+	// ffmpegTimePattern matches the position reached in the stats line ffmpeg keeps rewriting
+	ffmpegTimePattern = regexp.MustCompile(`time=(\d+:\d+:\d+(?:\.\d+)?)`)
+)
+
+// progressParser follows the output of a command for ffmpeg progress, both the stats line written to
+// stderr by default and the key=value lines written with -progress pipe:1 or pipe:2, and reports the
+// position reached relative to the duration of the input
+type progressParser struct {
+	mu       sync.Mutex
+	duration time.Duration
+	started  time.Time
+	report   ProgressFunc
+	line     []byte
+	last     int
+}
+
+// newProgressParser reports progress against duration, or against the duration ffmpeg prints when it is 0
+func newProgressParser(duration time.Duration, report ProgressFunc) *progressParser {
+	return &progressParser{
+		duration: duration,
+		started:  time.Now(),
+		report:   report,
+		last:     -1,
+	}
+}
+
+// Write splits the output into lines, ended by a newline or by the carriage return ffmpeg rewrites its
+// stats line with
+func (p *progressParser) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range data {
+		if c != '\n' && c != '\r' {
+			p.line = append(p.line, c)
+			continue
+		}
+		p.parseLine(string(p.line))
+		p.line = p.line[:0]
+	}
+	return len(data), nil
+}
+
+func (p *progressParser) parseLine(line string) {
+	line = strings.TrimSpace(line)
+
+	// Lines written by -progress hold a single key=value pair, the stats line holds several separated by spaces
+	if key, value, found := strings.Cut(line, "="); found && !strings.Contains(line, " ") {
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// ffmpeg reports out_time_ms in microseconds as well
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				p.position(time.Duration(us) * time.Microsecond)
+			}
+		case "progress":
+			if value == "end" {
+				p.position(p.duration)
+			}
+		}
+		return
+	}
+
+	if p.duration == 0 {
+		if match := ffmpegDurationPattern.FindStringSubmatch(line); match != nil {
+			p.duration = parseFFmpegTime(match[1])
+		}
+	}
+	if match := ffmpegTimePattern.FindStringSubmatch(line); match != nil {
+		p.position(parseFFmpegTime(match[1]))
+	}
+}
+
+// position reports the position reached, once per whole percent
+func (p *progressParser) position(reached time.Duration) {
+	if p.duration <= 0 {
+		return
+	}
+
+	percent := min(100, 100*float64(reached)/float64(p.duration))
+	if int(percent) == p.last {
+		return
+	}
+	p.last = int(percent)
+
+	var eta time.Duration
+	if percent > 0 {
+		elapsed := time.Since(p.started)
+		eta = time.Duration(float64(elapsed) * (100 - percent) / percent).Round(time.Second)
+	}
+	p.report(percent, eta)
+}
+
+// parseFFmpegTime parses an ffmpeg position such as 00:01:02.50, returning 0 when it is invalid
+func parseFFmpegTime(value string) time.Duration {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+
+	var seconds float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// probeDuration asks ffprobe for the duration of a media file, returning 0 when it is unknown
+func probeDuration(filePath string) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
+	if err != nil {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(string(bytes.TrimSpace(output)), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// probeBitrate asks ffprobe for the overall bitrate of a media file in bits per second, returning 0 when it
+// is unknown
+func probeBitrate(filePath string) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), codecProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=bit_rate",
+		"-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
+	if err != nil {
+		return 0
+	}
+
+	bitrate, err := strconv.ParseInt(string(bytes.TrimSpace(output)), 10, 64)
+	if err != nil || bitrate <= 0 {
+		return 0
+	}
+	return bitrate
+}
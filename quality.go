@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ssimScore = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+	vmafScore = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+)
+
+// QualityGated reports whether the policy compares the optimized file with the original before it replaces it
+func (p Policy) QualityGated() bool {
+	return p.MinSSIM > 0 || p.MinVMAF > 0
+}
+
+// MeetsQuality compares the optimized file with the original using the metrics the policy sets a minimum
+// for, with ffmpeg, and reports whether every score reaches it. The scores are returned for logging. A
+// score that cannot be computed is an error, the original is then to be kept.
+func (tp *TaskProcessor) MeetsQuality(ctx context.Context, p Policy) (string, bool, error) {
+	var scores []string
+	ok := true
+
+	if p.MinSSIM > 0 {
+		score, err := tp.qualityScore(ctx, "ssim", ssimScore)
+		if err != nil {
+			return "", false, err
+		}
+		scores = append(scores, fmt.Sprintf("SSIM %.4f", score))
+		ok = ok && score >= p.MinSSIM
+	}
+	if p.MinVMAF > 0 {
+		score, err := tp.qualityScore(ctx, "libvmaf", vmafScore)
+		if err != nil {
+			return "", false, err
+		}
+		scores = append(scores, fmt.Sprintf("VMAF %.2f", score))
+		ok = ok && score >= p.MinVMAF
+	}
+	return strings.Join(scores, ", "), ok, nil
+}
+
+// qualityScore runs an ffmpeg filter comparing the optimized file, scaled to the size of the original,
+// with the original and parses the score it logs. It runs like a command of the task that produced the
+// file, in its pool and a slot, within its timeout and resource limits, but without a GPU session since
+// the filters run on the CPU.
+func (tp *TaskProcessor) qualityScore(ctx context.Context, filter string, score *regexp.Regexp) (float64, error) {
+	task := tp.ProcessedTask
+	if task == nil || tp.ProcessedFile == nil {
+		return 0, fmt.Errorf("unable to compute %s: no optimized file", filter)
+	}
+	timeout := task.timeout
+	if timeout == 0 {
+		timeout = tp.timeout
+	}
+
+	graph := fmt.Sprintf("[0:v][1:v]scale2ref=flags=bicubic[distorted][reference];[distorted][reference]%s", filter)
+	command := commandLine{args: []string{"ffmpeg", "-hide_banner", "-nostats", "-i", tp.ProcessedFile.Name(),
+		"-i", tp.OriginalFile.Name(), "-lavfi", graph, "-f", "null", "-"}}
+	output, err := tp.commandOutput(ctx, command, task.PoolName(tp.Media), false, timeout, tp.resources.override(task.Resources))
+	if err != nil {
+		return 0, fmt.Errorf("unable to compute %s: %w", filter, err)
+	}
+
+	match := score.FindSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("unable to compute %s: no score in the ffmpeg output", filter)
+	}
+	return strconv.ParseFloat(string(match[1]), 64)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PriorityRule raises or lowers the priority of the files it matches, so quick wins such as small images
+// are processed ahead of long video transcodes. Every criterion the rule sets must match.
+type PriorityRule struct {
+	Extensions []string `mapstructure:"extensions"`
+	MimeTypes  []string `mapstructure:"mime_types"`
+	MinSize    string   `mapstructure:"min_size"`
+	MaxSize    string   `mapstructure:"max_size"`
+	Priority   int      `mapstructure:"priority"`
+	minSize    int64
+	maxSize    int64
+}
+
+func (rule *PriorityRule) Init() (err error) {
+	for i, extension := range rule.Extensions {
+		rule.Extensions[i] = normalizeExtension(extension)
+	}
+	if rule.MinSize != "" {
+		if rule.minSize, err = parseSize(rule.MinSize); err != nil {
+			return fmt.Errorf("min_size: %v", err)
+		}
+	}
+	if rule.MaxSize != "" {
+		if rule.maxSize, err = parseSize(rule.MaxSize); err != nil {
+			return fmt.Errorf("max_size: %v", err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to the file
+func (rule *PriorityRule) Matches(media MediaInfo) bool {
+	if len(rule.Extensions) > 0 && !slices.Contains(rule.Extensions, media.Extension) {
+		return false
+	}
+	if len(rule.MimeTypes) > 0 && !matchesMimeType(rule.MimeTypes, media.MimeType) {
+		return false
+	}
+	if media.Size < rule.minSize {
+		return false
+	}
+	if rule.maxSize > 0 && media.Size > rule.maxSize {
+		return false
+	}
+	return true
+}
+
+// ErrQueueFull is returned when a file is turned away because the queue holds its maximum number of files
+var ErrQueueFull = errors.New("queue is full")
+
+// FileQueue holds the files waiting to be processed. Every source, the top-level folder of the watch
+// directory a file arrived in and usually one per device, waits in its own line: the next file is the one
+// with the highest priority, and among sources at the same priority the least recently served one goes
+// first, so a phone dumping thousands of photos does not hold up the uploads of another. Within a source
+// files are processed in arrival order. A file is queued once: queueing it again while it waits is
+// ignored, and while it is being processed it is queued again once done, since it was written to in the
+// meantime.
+type FileQueue struct {
+	mu         sync.Mutex
+	sources    map[string]*sourceQueue
+	waiting    int
+	queued     map[string]bool
+	processing map[string]string // files being processed, with their source
+	active     map[string]int    // number of files being processed per source
+	served     map[string]uint64 // turn each source was last served in
+	again      map[string]bool
+	seq        uint64
+	turn       uint64
+	ready      chan struct{}
+	limit      int
+	perSource  int
+	turnedAway map[string]uint64 // files turned away while the queue was full, with when
+	paused     QueuePauseStatus
+}
+
+// QueuePauseStatus describes whether the queue holds back its files
+type QueuePauseStatus struct {
+	Paused bool       `json:"paused"`
+	Reason string     `json:"reason,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// sourceQueue is the line of files waiting from one source
+type sourceQueue struct {
+	name  string
+	items queueItems
+}
+
+func NewFileQueue() *FileQueue {
+	return &FileQueue{
+		sources:    make(map[string]*sourceQueue),
+		queued:     make(map[string]bool),
+		processing: make(map[string]string),
+		active:     make(map[string]int),
+		served:     make(map[string]uint64),
+		again:      make(map[string]bool),
+		turnedAway: make(map[string]uint64),
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// SetLimit bounds the number of waiting files, 0 for no limit
+func (q *FileQueue) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limit = limit
+}
+
+// SetSourceLimit bounds the number of files of a single source processed at the same time, 0 for no limit
+func (q *FileQueue) SetSourceLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.perSource = limit
+	q.signal()
+}
+
+// Push queues a file from a source and reports whether it was added. It returns ErrQueueFull when the
+// queue holds its maximum number of files.
+func (q *FileQueue) Push(filePath, source string, priority int) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.queued[filePath] {
+		return false, nil
+	}
+	if _, ok := q.processing[filePath]; ok {
+		q.again[filePath] = true
+		return false, nil
+	}
+	if q.limit > 0 && q.waiting >= q.limit {
+		if _, ok := q.turnedAway[filePath]; !ok {
+			q.seq++
+			q.turnedAway[filePath] = q.seq
+		}
+		return false, ErrQueueFull
+	}
+	delete(q.turnedAway, filePath)
+
+	sq, ok := q.sources[source]
+	if !ok {
+		sq = &sourceQueue{name: source}
+		q.sources[source] = sq
+	}
+	q.seq++
+	heap.Push(&sq.items, queueItem{path: filePath, source: source, priority: priority, seq: q.seq})
+	q.queued[filePath] = true
+	q.waiting++
+	q.signal()
+	return true, nil
+}
+
+// Pop waits for the next file and marks it as being processed. It returns false once ctx is cancelled.
+func (q *FileQueue) Pop(ctx context.Context) (string, bool) {
+	for {
+		q.mu.Lock()
+		if sq := q.next(); sq != nil {
+			item := heap.Pop(&sq.items).(queueItem)
+			if sq.items.Len() == 0 {
+				delete(q.sources, item.source)
+			}
+			q.turn++
+			q.served[item.source] = q.turn
+			q.waiting--
+			delete(q.queued, item.path)
+			q.processing[item.path] = item.source
+			q.active[item.source]++
+			if q.waiting > 0 {
+				q.signal()
+			}
+			q.mu.Unlock()
+			return item.path, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+}
+
+// next returns the source to serve next, or nil if none may be served, the caller holds q.mu
+func (q *FileQueue) next() *sourceQueue {
+	if q.paused.Paused {
+		return nil
+	}
+
+	var best *sourceQueue
+	for source, sq := range q.sources {
+		if q.perSource > 0 && q.active[source] >= q.perSource {
+			continue
+		}
+		if best == nil || q.before(sq, best) {
+			best = sq
+		}
+	}
+	return best
+}
+
+// before reports whether a source is to be served ahead of another: its next file has a higher
+// priority, or the same priority and the source was served less recently, the caller holds q.mu
+func (q *FileQueue) before(sq, other *sourceQueue) bool {
+	head, otherHead := sq.items[0], other.items[0]
+	if head.priority != otherHead.priority {
+		return head.priority > otherHead.priority
+	}
+	if q.served[sq.name] != q.served[other.name] {
+		return q.served[sq.name] < q.served[other.name]
+	}
+	return head.seq < otherHead.seq
+}
+
+// Pause stops handing out files, files being processed are finished and new files keep being queued.
+// The original start time is kept if it was already paused.
+func (q *FileQueue) Pause(reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.paused.Paused {
+		now := time.Now()
+		q.paused.Since = &now
+	}
+	q.paused.Paused = true
+	q.paused.Reason = reason
+}
+
+// Resume hands out files again
+func (q *FileQueue) Resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paused = QueuePauseStatus{}
+	q.signal()
+}
+
+// PauseStatus returns whether the queue is paused
+func (q *FileQueue) PauseStatus() QueuePauseStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.paused
+}
+
+// Done marks a file as processed and reports whether it has to be queued again
+func (q *FileQueue) Done(filePath string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if source, ok := q.processing[filePath]; ok {
+		delete(q.processing, filePath)
+		if q.active[source]--; q.active[source] <= 0 {
+			delete(q.active, source)
+		}
+		// The source may have been held back by its limit
+		q.signal()
+	}
+	again := q.again[filePath]
+	delete(q.again, filePath)
+	return again
+}
+
+// Pending returns the files being processed followed by the waiting ones in arrival order
+func (q *FileQueue) Pending() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files := slices.Sorted(maps.Keys(q.processing))
+	var waiting []queueItem
+	for _, sq := range q.sources {
+		waiting = append(waiting, sq.items...)
+	}
+	slices.SortFunc(waiting, func(a, b queueItem) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	for _, item := range waiting {
+		files = append(files, item.path)
+	}
+	return files
+}
+
+// Drained returns, once the queue is down to half its limit again, the files turned away while it was full
+// and not queued since, in the order they were turned away
+func (q *FileQueue) Drained() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.turnedAway) == 0 || q.waiting > q.limit/2 {
+		return nil
+	}
+	files := slices.SortedFunc(maps.Keys(q.turnedAway), func(a, b string) int {
+		return cmp.Compare(q.turnedAway[a], q.turnedAway[b])
+	})
+	clear(q.turnedAway)
+	return files
+}
+
+// Limit returns the maximum number of waiting files, 0 if there is none
+func (q *FileQueue) Limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.limit
+}
+
+// Processing returns the number of files being processed
+func (q *FileQueue) Processing() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.processing)
+}
+
+// Len returns the number of files waiting
+func (q *FileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.waiting
+}
+
+// Sources returns the number of files waiting per source, the watch directory itself being ""
+func (q *FileQueue) Sources() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	sources := make(map[string]int, len(q.sources))
+	for source, sq := range q.sources {
+		sources[source] = sq.items.Len()
+	}
+	return sources
+}
+
+// signal wakes a waiting Pop without blocking
+func (q *FileQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+type queueItem struct {
+	path     string
+	source   string
+	priority int
+	seq      uint64
+}
+
+// queueItems implements heap.Interface
+type queueItems []queueItem
+
+func (items queueItems) Len() int { return len(items) }
+
+func (items queueItems) Less(i, j int) bool {
+	if items[i].priority != items[j].priority {
+		return items[i].priority > items[j].priority
+	}
+	return items[i].seq < items[j].seq
+}
+
+func (items queueItems) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items *queueItems) Push(x any) { *items = append(*items, x.(queueItem)) }
+
+func (items *queueItems) Pop() any {
+	old := *items
+	item := old[len(old)-1]
+	*items = old[:len(old)-1]
+	return item
+}
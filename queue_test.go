@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type queuedFile struct {
+	path     string
+	source   string
+	priority int
+}
+
+// popAll pops every file the queue hands out without waiting, marking each as done
+func popAll(t *testing.T, q *FileQueue) []string {
+	t.Helper()
+	var order []string
+	for q.Len() > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		path, ok := q.Pop(ctx)
+		cancel()
+		if !ok {
+			t.Fatalf("Pop blocked with %d files waiting", q.Len())
+		}
+		order = append(order, path)
+		q.Done(path)
+	}
+	return order
+}
+
+func TestFileQueueOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []queuedFile
+		want  []string
+	}{
+		{
+			name:  "arrival order within a source",
+			files: []queuedFile{{"a1", "a", 0}, {"a2", "a", 0}, {"a3", "a", 0}},
+			want:  []string{"a1", "a2", "a3"},
+		},
+		{
+			name:  "higher priority first",
+			files: []queuedFile{{"video", "a", -10}, {"photo", "a", 10}, {"other", "a", 0}},
+			want:  []string{"photo", "other", "video"},
+		},
+		{
+			name: "sources take turns",
+			files: []queuedFile{
+				{"phone1", "phone", 0}, {"phone2", "phone", 0}, {"phone3", "phone", 0},
+				{"camera1", "camera", 0}, {"camera2", "camera", 0},
+			},
+			want: []string{"phone1", "camera1", "phone2", "camera2", "phone3"},
+		},
+		{
+			name: "priority beats turns",
+			files: []queuedFile{
+				{"phone1", "phone", 0}, {"phone2", "phone", 5}, {"camera1", "camera", 0},
+			},
+			want: []string{"phone2", "camera1", "phone1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewFileQueue()
+			for _, file := range tt.files {
+				if added, err := q.Push(file.path, file.source, file.priority); !added || err != nil {
+					t.Fatalf("Push %s: %v %v", file.path, added, err)
+				}
+			}
+			if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileQueueRequeue(t *testing.T) {
+	q := NewFileQueue()
+	q.Push("a.jpg", "", 0)
+	if added, _ := q.Push("a.jpg", "", 0); added {
+		t.Errorf("a waiting file was queued twice")
+	}
+
+	path, _ := q.Pop(context.Background())
+	if added, _ := q.Push(path, "", 0); added {
+		t.Errorf("a file being processed was queued")
+	}
+	if !q.Done(path) {
+		t.Errorf("a file written to while processed is not queued again")
+	}
+	if q.Done(path) {
+		t.Errorf("Done reported the file twice")
+	}
+}
+
+func TestFileQueueLimit(t *testing.T) {
+	q := NewFileQueue()
+	q.SetLimit(4)
+	for _, path := range []string{"1", "2", "3", "4"} {
+		if _, err := q.Push(path, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"6", "5", "7", "6"} {
+		if _, err := q.Push(path, "", 0); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("got %v, want ErrQueueFull", err)
+		}
+	}
+
+	ctx := context.Background()
+	q.Pop(ctx)
+	if files := q.Drained(); files != nil {
+		t.Errorf("drained with 3 of 4 files waiting: %v", files)
+	}
+	// A file turned away and queued since, from an inotify event, is not handed back
+	q.Push("7", "", 0)
+	q.Pop(ctx)
+	q.Pop(ctx)
+	if got, want := q.Drained(), []string{"6", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if files := q.Drained(); files != nil {
+		t.Errorf("drained reported twice: %v", files)
+	}
+}
+
+func TestFileQueueSourceLimit(t *testing.T) {
+	q := NewFileQueue()
+	q.SetSourceLimit(1)
+	q.Push("phone1", "phone", 0)
+	q.Push("phone2", "phone", 10)
+	q.Push("camera1", "camera", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first, _ := q.Pop(ctx)
+	second, _ := q.Pop(ctx)
+	if first != "phone2" || second != "camera1" {
+		t.Fatalf("got %s, %s, want phone2, camera1", first, second)
+	}
+	if path, ok := q.Pop(ctx); ok {
+		t.Fatalf("got %s while phone is at its limit", path)
+	}
+
+	q.Done("phone2")
+	if path, ok := q.Pop(context.Background()); !ok || path != "phone1" {
+		t.Errorf("got %s, want phone1 once phone2 is done", path)
+	}
+}
+
+func TestFileQueuePause(t *testing.T) {
+	q := NewFileQueue()
+	q.Pause("maintenance")
+	q.Push("a.jpg", "", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if path, ok := q.Pop(ctx); ok {
+		t.Fatalf("got %s while paused", path)
+	}
+	if status := q.PauseStatus(); !status.Paused || status.Reason != "maintenance" || status.Since == nil {
+		t.Errorf("got %+v", status)
+	}
+
+	popped := make(chan string)
+	go func() {
+		path, _ := q.Pop(context.Background())
+		popped <- path
+	}()
+	q.Resume()
+	select {
+	case path := <-popped:
+		if path != "a.jpg" {
+			t.Errorf("got %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not wake up on Resume")
+	}
+}
+
+func TestFileQueuePending(t *testing.T) {
+	q := NewFileQueue()
+	q.Push("b", "phone", 0)
+	q.Push("a", "camera", 5)
+	q.Push("c", "phone", 0)
+	q.Push("d", "camera", 0)
+
+	path, _ := q.Pop(context.Background())
+	if path != "a" {
+		t.Fatalf("got %s, want a", path)
+	}
+	if got, want := q.Pending(), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := q.Sources(), map[string]int{"phone": 2, "camera": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileQueuePopCancelled(t *testing.T) {
+	q := NewFileQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := q.Pop(ctx); ok {
+		t.Errorf("Pop returned a file from an empty queue")
+	}
+}
+
+func TestPriorityRuleMatches(t *testing.T) {
+	rule := PriorityRule{Extensions: []string{".JPG"}, MimeTypes: []string{"image/*"}, MaxSize: "1MB", Priority: 10}
+	if err := rule.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		media MediaInfo
+		want  bool
+	}{
+		{MediaInfo{Extension: "jpg", MimeType: "image/jpeg", Size: 1000}, true},
+		{MediaInfo{Extension: "jpg", MimeType: "image/jpeg", Size: 10 << 20}, false},
+		{MediaInfo{Extension: "png", MimeType: "image/png", Size: 1000}, false},
+		{MediaInfo{Extension: "jpg", MimeType: "video/mp4", Size: 1000}, false},
+	}
+	for _, tt := range tests {
+		if got := rule.Matches(tt.media); got != tt.want {
+			t.Errorf("Matches(%+v) = %v, want %v", tt.media, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRawPairTimeDifference = 5 * time.Second
+	// rawPairRetention is how long an uploaded half of a pair waits for the other one
+	rawPairRetention = time.Hour
+)
+
+var (
+	defaultRawExtensions  = []string{"3fr", "arw", "cr2", "cr3", "crw", "dng", "erf", "iiq", "kdc", "mrw", "nef", "nrw", "orf", "pef", "raf", "raw", "rw2", "rwl", "sr2", "srf", "srw", "x3f"}
+	rawPairJPEGExtensions = []string{"jpg", "jpeg"}
+)
+
+// RawPairs handles the RAW and JPEG files a camera writes for the same shot: the RAW is uploaded as-is,
+// only the JPEG is optimized, and the two are stacked in Immich with the JPEG on top. Files are paired by
+// folder and name, IMG_1.CR3 with IMG_1.JPG, and must have been modified within MaxTimeDifference.
+type RawPairs struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Extensions are those of RAW files (default the common camera RAW formats and DNG)
+	Extensions []string `mapstructure:"extensions"`
+	// MaxTimeDifference is how far apart the modification times of the two files may be (default 5s)
+	MaxTimeDifference string `mapstructure:"max_time_difference"`
+	maxTimeDifference time.Duration
+}
+
+func (p *RawPairs) Init() (err error) {
+	if p.Extensions == nil {
+		p.Extensions = defaultRawExtensions
+	}
+	extensions := make([]string, len(p.Extensions))
+	for i, extension := range p.Extensions {
+		extensions[i] = normalizeExtension(extension)
+	}
+	p.Extensions = extensions
+
+	p.maxTimeDifference = defaultRawPairTimeDifference
+	if p.MaxTimeDifference != "" {
+		if p.maxTimeDifference, err = time.ParseDuration(p.MaxTimeDifference); err != nil || p.maxTimeDifference < 0 {
+			return fmt.Errorf("max_time_difference: invalid duration %q", p.MaxTimeDifference)
+		}
+	}
+	return nil
+}
+
+// isRaw reports whether a file is the RAW half of a pair
+func (p RawPairs) isRaw(filePath string) bool {
+	return slices.Contains(p.Extensions, normalizeExtension(filepath.Ext(filePath)))
+}
+
+// isJPEG reports whether a file is the JPEG half of a pair
+func (p RawPairs) isJPEG(filePath string) bool {
+	return slices.Contains(rawPairJPEGExtensions, normalizeExtension(filepath.Ext(filePath)))
+}
+
+// close reports whether two files were modified close enough in time to be a pair
+func (p RawPairs) close(a, b time.Time) bool {
+	return a.Sub(b).Abs() <= p.maxTimeDifference
+}
+
+// rawPairKey identifies the pair a file belongs to: its folder and name without extension, ignoring case
+func rawPairKey(filePath string) string {
+	return strings.ToLower(strings.TrimSuffix(filePath, filepath.Ext(filePath)))
+}
+
+// rawPair is the half of a pair uploaded so far
+type rawPair struct {
+	filePath   string
+	assetID    string
+	modTime    time.Time
+	raw        bool
+	uploadedAt time.Time
+}
+
+// RawPairRegistry remembers the uploaded halves of RAW and JPEG pairs until the other half is uploaded
+type RawPairRegistry struct {
+	mu    sync.Mutex
+	pairs map[string]rawPair
+}
+
+func NewRawPairRegistry() *RawPairRegistry {
+	return &RawPairRegistry{pairs: make(map[string]rawPair)}
+}
+
+// uploadedJPEG returns the JPEG half of a RAW file when it was uploaded already
+func (r *RawPairRegistry) uploadedJPEG(config RawPairs, rawPath string, modTime time.Time) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pair, ok := r.pairs[rawPairKey(rawPath)]
+	if !ok || pair.raw || !config.close(pair.modTime, modTime) {
+		return "", false
+	}
+	return pair.filePath, true
+}
+
+// uploaded records the upload of one half of a pair and returns the assets of the JPEG and of the RAW once
+// both halves are uploaded
+func (r *RawPairRegistry) uploaded(config RawPairs, filePath, assetID string, modTime time.Time) (jpegID, rawID string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, pair := range r.pairs {
+		if now.Sub(pair.uploadedAt) > rawPairRetention {
+			delete(r.pairs, key)
+		}
+	}
+
+	key := rawPairKey(filePath)
+	half := rawPair{filePath: filePath, assetID: assetID, modTime: modTime, raw: config.isRaw(filePath), uploadedAt: now}
+	other, found := r.pairs[key]
+	if !found || other.raw == half.raw || !config.close(other.modTime, modTime) {
+		r.pairs[key] = half
+		return "", "", false
+	}
+
+	delete(r.pairs, key)
+	if half.raw {
+		return other.assetID, half.assetID, true
+	}
+	return half.assetID, other.assetID, true
+}
+
+// rawPairJPEG returns the JPEG a RAW file was shot with, waiting in the watch directory or uploaded
+// already, or an empty string when there is none
+func (fw *FileWatcher) rawPairJPEG(rawPath string) string {
+	config := fw.config().RawPairs
+	if !config.Enabled || !config.isRaw(rawPath) {
+		return ""
+	}
+
+	info, err := os.Stat(rawPath)
+	if err != nil {
+		return ""
+	}
+	if jpegPath, ok := fw.rawPairs.uploadedJPEG(config, rawPath, info.ModTime()); ok {
+		return jpegPath
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(rawPath))
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		jpegPath := filepath.Join(filepath.Dir(rawPath), entry.Name())
+		if !config.isJPEG(jpegPath) || rawPairKey(jpegPath) != rawPairKey(rawPath) {
+			continue
+		}
+		if jpegInfo, err := entry.Info(); err == nil && config.close(jpegInfo.ModTime(), info.ModTime()) {
+			return jpegPath
+		}
+	}
+	return ""
+}
+
+// stackRawPair records the upload of a RAW or JPEG file and stacks the RAW below the JPEG once both halves
+// of a pair are uploaded, whichever came first
+func (fw *FileWatcher) stackRawPair(filePath string, asset AssetUploadResult) {
+	config := fw.config().RawPairs
+	if !config.Enabled || !config.isRaw(filePath) && !config.isJPEG(filePath) {
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	jpegID, rawID, ok := fw.rawPairs.uploaded(config, filePath, asset.ID, info.ModTime())
+	if !ok {
+		return
+	}
+
+	if err := fw.immichClient.CreateStack(jpegID, rawID); err != nil {
+		fw.logger.Errorf("Error stacking the RAW file of %s below its JPEG: %v", filePath, err)
+		return
+	}
+	fw.logger.Printf("Stacked the RAW file of %s below its JPEG", filePath)
+}
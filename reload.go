@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the tasks file and the files it includes are checked for changes
+const configPollInterval = 5 * time.Second
+
+// fileStamp is what tells a file changed
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+// ConfigReloadStatus describes the configuration in use and the last reload attempt
+type ConfigReloadStatus struct {
+	File       string     `json:"file"`
+	Tasks      int        `json:"tasks"`
+	LoadedAt   time.Time  `json:"loaded_at"`
+	LastError  string     `json:"last_error,omitempty"`
+	LastFailed *time.Time `json:"last_failed,omitempty"`
+}
+
+// ConfigReloader holds the configuration of the tasks file and swaps in a new one when the file or one it
+// includes changes, on SIGHUP or on request. Files already being processed finish with the configuration they started with
+// parts of, files started afterwards use the new one. An invalid file is logged and the previous
+// configuration kept.
+type ConfigReloader struct {
+	file    string
+	logger  *customLogger
+	current atomic.Pointer[Config]
+	signals chan os.Signal
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	status ConfigReloadStatus
+	stamps map[string]fileStamp
+}
+
+func NewConfigReloader(file string, config *Config) *ConfigReloader {
+	r := &ConfigReloader{
+		file:   file,
+		status: ConfigReloadStatus{File: file, Tasks: len(config.Tasks), LoadedAt: time.Now()},
+	}
+	r.current.Store(config)
+	r.stamps = stampFiles(config.Files())
+	return r
+}
+
+// stampFiles records the current state of the files, those that cannot be read are left out
+func stampFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{modified: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Config returns the configuration in use
+func (r *ConfigReloader) Config() *Config {
+	return r.current.Load()
+}
+
+// Start reloads the tasks file in the background whenever it or a file it includes changes or SIGHUP is
+// received, until Stop
+func (r *ConfigReloader) Start(logger *customLogger) {
+	r.logger = logger
+	r.signals = make(chan os.Signal, 1)
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	signal.Notify(r.signals, syscall.SIGHUP)
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-r.signals:
+				r.logger.Printf("Reloading %s on SIGHUP", r.file)
+				r.Reload()
+			case <-ticker.C:
+				if r.changed() {
+					r.logger.Printf("%s changed, reloading", r.file)
+					r.Reload()
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends watching the tasks file
+func (r *ConfigReloader) Stop() {
+	signal.Stop(r.signals)
+	close(r.stop)
+	<-r.done
+}
+
+// changed reports whether the tasks file or a file it includes was modified since it was last loaded
+func (r *ConfigReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for file, stamp := range r.stamps {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(stamp.modified) || info.Size() != stamp.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reads the tasks file again and swaps in the new configuration if it is valid
+func (r *ConfigReloader) Reload() (ConfigReloadStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Remember the files as loaded even when they are invalid, so a broken file is reported once
+	r.stamps = stampFiles(append([]string{r.file}, r.current.Load().Files()...))
+
+	config, err := readConfig(r.file)
+	if err != nil {
+		now := time.Now()
+		r.status.LastError, r.status.LastFailed = err.Error(), &now
+		if r.logger != nil {
+			r.logger.Errorf("Keeping the previous configuration, %v", err)
+		}
+		return r.status, err
+	}
+
+	r.current.Store(config)
+	// Watch the files the new configuration includes, which may differ from the previous ones
+	r.stamps = stampFiles(config.Files())
+	r.status = ConfigReloadStatus{File: r.file, Tasks: len(config.Tasks), LoadedAt: time.Now()}
+	if r.logger != nil {
+		r.logger.Printf("Loaded %d tasks from %s", len(config.Tasks), r.file)
+		logVariants(r.logger, config.Tasks)
+	}
+	return r.status, nil
+}
+
+// Status returns the configuration in use and the last failed reload
+func (r *ConfigReloader) Status() ConfigReloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
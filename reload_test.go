@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTasksFile(t *testing.T, path, content string, modified time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Set the time explicitly, a rewrite within the same clock tick would otherwise go unnoticed
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigReloaderWatchesIncludes(t *testing.T) {
+	dir := t.TempDir()
+	tasksFile := filepath.Join(dir, "tasks.yaml")
+	included := filepath.Join(dir, "images.yaml")
+	start := time.Now().Add(-time.Hour)
+	writeTasksFile(t, tasksFile, "include: images.yaml\ntimeout: 1m\n", start)
+	writeTasksFile(t, included, "tasks:\n- name: jpeg\n  command: cp {{.src}} {{.dst}}\n  extensions: [jpg]\n", start)
+
+	config, err := readConfig(tasksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Files(); len(got) != 2 || got[1] != included {
+		t.Fatalf("got files %v", got)
+	}
+
+	r := NewConfigReloader(tasksFile, config)
+	if r.changed() {
+		t.Fatalf("changed before anything was written")
+	}
+
+	writeTasksFile(t, included, "tasks:\n- name: jpeg\n  command: cp {{.src}} {{.dst}}\n  extensions: [jpg]\n- name: png\n  command: cp {{.src}} {{.dst}}\n  extensions: [png]\n", start.Add(time.Minute))
+	if !r.changed() {
+		t.Fatalf("a change of the included file went unnoticed")
+	}
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Config().Tasks) != 2 {
+		t.Errorf("got %d tasks after the reload, want 2", len(r.Config().Tasks))
+	}
+	if r.changed() {
+		t.Errorf("changed right after a reload")
+	}
+}
+
+func TestConfigEnvOverridesOnReload(t *testing.T) {
+	t.Setenv("IUO_TIMEOUT", "5m")
+	tasksFile := filepath.Join(t.TempDir(), "tasks.yaml")
+	writeTasksFile(t, tasksFile, "timeout: 1m\ntasks:\n- name: jpeg\n  command: cp {{.src}} {{.dst}}\n  extensions: [jpg]\n", time.Now())
+
+	config, err := NewConfig(&tasksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.timeout != 5*time.Minute {
+		t.Errorf("got timeout %s on startup, want the 5m of IUO_TIMEOUT", config.timeout)
+	}
+
+	r := NewConfigReloader(tasksFile, config)
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Config().timeout; got != 5*time.Minute {
+		t.Errorf("got timeout %s after a reload, want the 5m of IUO_TIMEOUT", got)
+	}
+}
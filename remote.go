@@ -0,0 +1,313 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// workerPathPrefix is where a remote worker serves its tasks
+	workerPathPrefix = "/_immich-upload-optimizer/worker"
+	// Headers describing the original sent to a remote worker, and the result sent back
+	workerFilenameHeader  = "X-IUO-Filename"
+	workerModifiedHeader  = "X-IUO-Modified"
+	workerExtensionHeader = "X-IUO-Extension"
+
+	// remoteWorkerTimeout bounds a whole exchange with the remote worker, transfers included, for tasks
+	// without a timeout of their own
+	remoteWorkerTimeout = 2 * time.Hour
+)
+
+// RemoteWorker runs tasks marked remote on another machine, e.g. one with a GPU, which serves them with
+// the worker subcommand. A nil *RemoteWorker runs every task locally.
+type RemoteWorker struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewRemoteWorker(workerURL, token string) (*RemoteWorker, error) {
+	parsed, err := url.Parse(workerURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("remote worker URL must be an http or https URL")
+	}
+
+	return &RemoteWorker{
+		url:    strings.TrimSuffix(workerURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: remoteWorkerTimeout},
+	}, nil
+}
+
+// Run sends an original to the worker to be processed by the task of the same name in its tasks file and
+// writes the result into dstDir
+func (rw *RemoteWorker) Run(ctx context.Context, taskName string, original io.Reader, filename string, modTime time.Time, dstDir string) error {
+	endpoint := rw.url + workerPathPrefix + "/tasks/" + url.PathEscape(taskName)
+	// The client closes bodies it is given, the original stays open for further tasks
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, io.NopCloser(original))
+	if err != nil {
+		return fmt.Errorf("unable to create remote worker request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+rw.token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(workerFilenameHeader, url.PathEscape(filename))
+	req.Header.Set(workerModifiedHeader, modTime.UTC().Format(time.RFC3339Nano))
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach remote worker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("remote worker returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	extension := filepath.Base(resp.Header.Get(workerExtensionHeader))
+	if !strings.HasPrefix(extension, ".") {
+		return fmt.Errorf("remote worker returned no file extension")
+	}
+
+	result, err := os.CreateTemp(dstDir, "file-*"+extension)
+	if err != nil {
+		return fmt.Errorf("unable to create result file: %w", err)
+	}
+	if _, err := io.Copy(result, resp.Body); err != nil {
+		result.Close()
+		return fmt.Errorf("unable to receive result from remote worker: %w", err)
+	}
+	if err := result.Close(); err != nil {
+		return fmt.Errorf("unable to write result file: %w", err)
+	}
+	return nil
+}
+
+// runRemote has the remote worker process the original with the task, waiting for the pool of the task
+// first so a single machine is not sent more than it is configured to take
+func (tp *TaskProcessor) runRemote(ctx context.Context, task *Task, timeout time.Duration) error {
+	releasePool, err := tp.pools.Acquire(ctx, task.PoolName(tp.Media))
+	if err != nil {
+		return err
+	}
+	defer releasePool()
+
+	if _, err := tp.OriginalFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek beginning of file: %w", err)
+	}
+
+	tp.logf("running task %s on remote worker %s", task.Name, tp.remote.url)
+
+	requestCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err = tp.remote.Run(requestCtx, task.Name, tp.OriginalFile, tp.OriginalFilename, tp.OriginalModTime, tp.tempWorkDirDst)
+	if err != nil && ctx.Err() == nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s on the remote worker: %w", ErrTaskTimeout, timeout, err)
+	}
+	return err
+}
+
+// workerServer runs the tasks of its tasks file for a coordinator
+type workerServer struct {
+	config    *Config
+	configDir string
+	token     string
+	maxBody   int64
+	slots     *Slots
+	logger    *customLogger
+}
+
+// runWorker implements the worker subcommand: it serves the tasks of a tasks file over HTTP, so the
+// watcher on another machine can offload the tasks marked remote to this one
+func runWorker(args []string) int {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	listen := flags.String("listen", cmp.Or(os.Getenv("IUO_WORKER_LISTEN"), ":2285"), "Address the worker listens on")
+	token := flags.String("token", os.Getenv("IUO_WORKER_TOKEN"), "Bearer token the coordinator authenticates with, at least 16 characters")
+	tasksFile := flags.String("tasks_file", cmp.Or(os.Getenv("IUO_TASKS_FILE"), "tasks.yaml"), "Path to the configuration file, with the tasks the coordinator marks remote")
+	concurrency := flags.Int("max_concurrency", 2, "Maximum number of task commands running at the same time")
+	maxBodySize := flags.String("max_body_size", cmp.Or(os.Getenv("IUO_WORKER_MAX_BODY_SIZE"), "4GB"), "Largest original the worker accepts, e.g. 4GB")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s worker [flags]\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(*token) < 16 {
+		fmt.Fprintln(os.Stderr, "Error: -token must be at least 16 characters")
+		return 2
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -max_concurrency must be at least 1")
+		return 2
+	}
+
+	maxBody, err := parseSize(*maxBodySize)
+	if err != nil || maxBody <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -max_body_size must be a size such as 4GB")
+		return 2
+	}
+
+	config, err := NewConfig(tasksFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config file: %v\n", err)
+		return 1
+	}
+
+	ws := &workerServer{
+		config:    config,
+		configDir: filepath.Dir(*tasksFile),
+		token:     *token,
+		maxBody:   maxBody,
+		slots:     NewSlots(*concurrency, 0),
+		logger:    newCustomLogger(log.New(os.Stdout, "", log.LstdFlags), "worker: ").Subsystem(logTasks),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+workerPathPrefix+"/tasks/{name}", ws.handleRun)
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	ws.logger.Printf("Serving %d tasks on %s", len(config.Tasks), *listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// handleRun processes the original in the request body with the named task and responds with the result
+func (ws *workerServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ws.token)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+
+	var task *Task
+	for i := range ws.config.Tasks {
+		if ws.config.Tasks[i].Name == r.PathValue("name") {
+			task = &ws.config.Tasks[i]
+			break
+		}
+	}
+	if task == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no task named %q", r.PathValue("name")))
+		return
+	}
+
+	filename, err := url.PathUnescape(r.Header.Get(workerFilenameHeader))
+	if err == nil {
+		filename, err = sampleFilename(filename)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing or invalid "+workerFilenameHeader+" header")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "worker-*")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create temp folder: %v", err))
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	originalPath := filepath.Join(dir, filename)
+	body := http.MaxBytesReader(w, r.Body, ws.maxBody)
+	if err := receiveFile(body, originalPath, r.Header.Get(workerModifiedHeader)); err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	tp, err := NewTaskProcessor(originalPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tp.Close()
+	tp.SetLogger(newCustomLogger(ws.logger, fmt.Sprintf("file %s: ", filepath.Base(filename))))
+	tp.SetSlots(ws.slots, false)
+	tp.SetPools(ws.config.pools)
+	tp.SetLimits(ws.config.Limits)
+	tp.SetTimeout(ws.config.timeout)
+	tp.SetResources(ws.config.Resources)
+	tp.SetBuiltin(ws.config.Builtin)
+	tp.SetOutputValidation(ws.config.ValidateOutput)
+	tp.SetLivePhotos(ws.config.LivePhotos)
+	tp.SetConfigDir(ws.configDir)
+
+	if err := tp.Process(r.Context(), []Task{*task}); err != nil {
+		ws.logger.Errorf("Error processing %s with task %s: %v", filename, task.Name, err)
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(tp.ProcessedSize, 10))
+	w.Header().Set(workerExtensionHeader, tp.ProcessedExtension)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, tp.ProcessedFile); err != nil {
+		ws.logger.Errorf("Error sending result of %s: %v", filename, err)
+		return
+	}
+	ws.logger.Printf("Processed %s with task %s: %s -> %s", filename, task.Name,
+		humanReadableSize(tp.OriginalSize), humanReadableSize(tp.ProcessedSize))
+}
+
+// receiveFile writes an uploaded original to path with the modification time sent along, if any
+func receiveFile(body io.Reader, path, modified string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %w", err)
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to receive file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write file: %w", err)
+	}
+
+	if modTime, err := time.Parse(time.RFC3339Nano, modified); err == nil {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return fmt.Errorf("unable to set file times: %w", err)
+		}
+	}
+	return nil
+}
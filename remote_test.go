@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWorkerRejectsInvalidUploads(t *testing.T) {
+	const token = "0123456789abcdef"
+	ws := &workerServer{
+		config:  &Config{Tasks: []Task{{Name: "jpeg"}}},
+		token:   token,
+		maxBody: 16,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+workerPathPrefix+"/tasks/{name}", ws.handleRun)
+
+	tests := []struct {
+		name     string
+		filename string
+		body     string
+		want     int
+	}{
+		{"no filename", "", "data", http.StatusBadRequest},
+		{"dot", "..", "data", http.StatusBadRequest},
+		{"root", "%2F", "data", http.StatusBadRequest},
+		{"too large", "a.jpg", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, workerPathPrefix+"/tasks/jpeg", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(workerFilenameHeader, tt.filename)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResultCache keeps optimized files on disk by the content of their original and the task that produced
+// them, so an original seen again, e.g. when a phone resyncs after a reinstall, is not transcoded twice.
+// Entries expire after ttl and the oldest are evicted once the cache exceeds maxSize.
+// A nil *ResultCache caches nothing.
+type ResultCache struct {
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	mu      sync.Mutex
+}
+
+func NewResultCache(dir string, maxSize int64, ttl time.Duration) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create result cache directory: %w", err)
+	}
+	return &ResultCache{dir: dir, maxSize: maxSize, ttl: ttl}, nil
+}
+
+// Key identifies the result of a task for an original by its XXH64 and size, the size making a collision
+// of the 64 bit digests even less likely. Changing the command of the task changes the key, so results of
+// an older configuration are not replayed.
+func (c *ResultCache) Key(sum string, size int64, task *Task) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%s", sum, size, task.Name, task.commandKey())))
+	return hex.EncodeToString(hash[:])
+}
+
+// Load copies the cached result for key into dir and reports whether there was one
+func (c *ResultCache) Load(key, dir string) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := filepath.Join(c.dir, key)
+	info, err := os.Stat(entry)
+	if err != nil {
+		return false, nil
+	}
+	if time.Since(info.ModTime()) > c.ttl {
+		os.RemoveAll(entry)
+		return false, nil
+	}
+
+	files, err := os.ReadDir(entry)
+	if err != nil || len(files) != 1 {
+		os.RemoveAll(entry)
+		return false, nil
+	}
+
+	if err := copyFilePreservingTimes(filepath.Join(entry, files[0].Name()), filepath.Join(dir, files[0].Name())); err != nil {
+		return false, fmt.Errorf("unable to copy cached result: %w", err)
+	}
+	return true, nil
+}
+
+// Store caches the result file for key and evicts expired and, beyond the size budget, the oldest entries
+func (c *ResultCache) Store(key, filePath string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	staging, err := os.MkdirTemp(c.dir, partialPrefix)
+	if err != nil {
+		return fmt.Errorf("unable to create cache entry: %w", err)
+	}
+	if err := copyFilePreservingTimes(filePath, filepath.Join(staging, filepath.Base(filePath))); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	entry := filepath.Join(c.dir, key)
+	os.RemoveAll(entry)
+	if err := os.Rename(staging, entry); err != nil {
+		os.RemoveAll(staging)
+		return fmt.Errorf("unable to store cache entry: %w", err)
+	}
+
+	c.evict()
+	return nil
+}
+
+// Shrink evicts the oldest entries until the cache takes at most size bytes and returns its size
+func (c *ResultCache) Shrink(size int64) int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.evictTo(size)
+}
+
+// evict removes expired entries, leftovers of interrupted stores and the oldest entries beyond maxSize
+func (c *ResultCache) evict() {
+	c.evictTo(c.maxSize)
+}
+
+// evictTo removes expired entries, leftovers of interrupted stores and the oldest entries beyond maxSize,
+// returning the size left, the caller holds c.mu
+func (c *ResultCache) evictTo(maxSize int64) int64 {
+	type cacheEntry struct {
+		path    string
+		size    int64
+		created time.Time
+	}
+
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0
+	}
+
+	var entries []cacheEntry
+	var total int64
+	for _, dir := range dirs {
+		path := filepath.Join(c.dir, dir.Name())
+		info, err := dir.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(dir.Name(), partialPrefix) && time.Since(info.ModTime()) > time.Hour || time.Since(info.ModTime()) > c.ttl {
+			os.RemoveAll(path)
+			continue
+		}
+
+		var size int64
+		files, _ := os.ReadDir(path)
+		for _, file := range files {
+			if fileInfo, err := file.Info(); err == nil {
+				size += fileInfo.Size()
+			}
+		}
+		entries = append(entries, cacheEntry{path: path, size: size, created: info.ModTime()})
+		total += size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].created.Before(entries[j].created)
+	})
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+		os.RemoveAll(entry.path)
+		total -= entry.size
+	}
+	return total
+}
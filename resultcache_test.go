@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultCacheKey(t *testing.T) {
+	c := &ResultCache{}
+	task := &Task{Name: "jpeg", Command: "cjpeg {{.src}}"}
+	key := c.Key("44bc2cf5ad770999", 3, task)
+
+	others := map[string]string{
+		"content": c.Key("d24ec4f1a98c6e5b", 3, task),
+		"size":    c.Key("44bc2cf5ad770999", 4, task),
+		"name":    c.Key("44bc2cf5ad770999", 3, &Task{Name: "webp", Command: task.Command}),
+		"command": c.Key("44bc2cf5ad770999", 3, &Task{Name: "jpeg", Command: "cjpeg -q 80 {{.src}}"}),
+	}
+	for change, other := range others {
+		if other == key {
+			t.Errorf("changing the %s kept the key", change)
+		}
+	}
+	if c.Key("44bc2cf5ad770999", 3, task) != key {
+		t.Errorf("key is not stable")
+	}
+}
+
+func TestResultCacheStoreLoad(t *testing.T) {
+	c, err := NewResultCache(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := filepath.Join(t.TempDir(), "file-1.jpg")
+	if err := os.WriteFile(result, []byte("optimized"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key := c.Key("44bc2cf5ad770999", 3, &Task{Name: "jpeg"})
+	if err := c.Store(key, result); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if ok, err := c.Load(key, dst); !ok || err != nil {
+		t.Fatalf("got %v %v, want the cached result", ok, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "file-1.jpg")); err != nil || string(data) != "optimized" {
+		t.Errorf("got %q %v", data, err)
+	}
+	if ok, _ := c.Load("unknown", t.TempDir()); ok {
+		t.Errorf("loaded a result that was never stored")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily range of local time, such as 02:00-06:00.
+// A window whose end is before its start spans midnight.
+type TimeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// ParseTimeWindow parses a window written as HH:MM-HH:MM
+func ParseTimeWindow(value string) (*TimeWindow, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", value)
+	}
+
+	start, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %w", value, err)
+	}
+	end, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %w", value, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid time window %q, start and end are equal", value)
+	}
+
+	return &TimeWindow{start: start, end: end}, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls inside the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	offset := sinceMidnight(t)
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// NextStart returns the next time the window opens after t
+func (w *TimeWindow) NextStart(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	next := midnight.Add(w.start)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(w.start)
+	}
+	return next
+}
+
+func (w *TimeWindow) String() string {
+	return fmt.Sprintf("%s-%s", formatClock(w.start), formatClock(w.end))
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+func formatClock(offset time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionRetention is how long upload sessions are reported after their last file finished
+const sessionRetention = 24 * time.Hour
+
+// UploadSession groups the files a source folder, usually one per device, delivered in one go
+type UploadSession struct {
+	ID             string    `json:"id"`
+	Source         string    `json:"source"`
+	StartedAt      time.Time `json:"started_at"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	Files          int       `json:"files"`
+	Processed      int       `json:"processed"`
+	Done           int       `json:"done"`
+	Failed         int       `json:"failed"`
+	Cancelled      int       `json:"cancelled"`
+	OriginalBytes  int64     `json:"original_bytes"`
+	UploadedBytes  int64     `json:"uploaded_bytes"`
+	SavedBytes     int64     `json:"saved_bytes"`
+	Summary        string    `json:"summary"`
+
+	// outcomes holds the last finished job of every file, files queued again are pending until it finishes
+	outcomes map[string]*Job
+}
+
+// update recounts the session from the outcomes of its files
+func (s *UploadSession) update() {
+	s.Files = len(s.outcomes)
+	s.Processed, s.Done, s.Failed, s.Cancelled = 0, 0, 0, 0
+	s.OriginalBytes, s.UploadedBytes, s.SavedBytes = 0, 0, 0
+	for _, job := range s.outcomes {
+		if job == nil {
+			continue
+		}
+		s.Processed++
+		switch job.State {
+		case JobDone:
+			s.Done++
+		case JobFailed:
+			s.Failed++
+		case JobCancelled:
+			s.Cancelled++
+		}
+		s.OriginalBytes += job.OriginalSize
+		s.UploadedBytes += job.UploadedSize
+		s.SavedBytes += job.SavedBytes
+	}
+
+	s.Summary = fmt.Sprintf("%s: %d/%d files processed, %s saved", s.label(), s.Processed, s.Files, humanReadableSize(s.SavedBytes))
+}
+
+// label names the source of the session, files directly in the watch directory have none
+func (s *UploadSession) label() string {
+	if s.Source == "" {
+		return "(watch directory)"
+	}
+	return s.Source
+}
+
+// Sessions groups jobs into upload sessions: files arriving from the same source folder belong to the same
+// session until none arrived for the session window. A nil *Sessions groups nothing.
+type Sessions struct {
+	window      time.Duration
+	logger      *customLogger
+	events      <-chan JobEvent
+	unsubscribe func()
+	done        chan struct{}
+
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[string]*UploadSession
+	open     map[string]*UploadSession
+}
+
+func NewSessions(window time.Duration, jobs *JobRegistry, logger *customLogger) *Sessions {
+	events, unsubscribe := jobs.Subscribe()
+	return &Sessions{
+		window:      window,
+		logger:      logger,
+		events:      events,
+		unsubscribe: unsubscribe,
+		done:        make(chan struct{}),
+		sessions:    make(map[string]*UploadSession),
+		open:        make(map[string]*UploadSession),
+	}
+}
+
+// Start counts finished jobs in the background until Stop
+func (s *Sessions) Start() {
+	go func() {
+		defer close(s.done)
+
+		for event := range s.events {
+			if event.Type == JobEventState && event.Job.Finished() {
+				s.finish(event.Job)
+			}
+		}
+	}()
+}
+
+// Stop ends the subscription
+func (s *Sessions) Stop() {
+	s.unsubscribe()
+	<-s.done
+}
+
+// Join adds a queued file to the open session of its source, starting a new one when the last file of the
+// source arrived longer than the window ago, and returns the session ID
+func (s *Sessions) Join(source, filePath string) string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session, ok := s.open[source]
+	if !ok || now.Sub(session.LastActivityAt) > s.window {
+		s.prune(now)
+		s.nextID++
+		session = &UploadSession{
+			ID:        strconv.FormatUint(s.nextID, 10),
+			Source:    source,
+			StartedAt: now,
+			outcomes:  make(map[string]*Job),
+		}
+		s.sessions[session.ID] = session
+		s.open[source] = session
+		s.logger.Printf("Upload session %s started for %s", session.ID, session.label())
+	}
+
+	session.LastActivityAt = now
+	session.outcomes[filePath] = nil
+	session.update()
+	return session.ID
+}
+
+// finish records the outcome of a job and logs the summary once every file of its session is processed
+func (s *Sessions) finish(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[job.Session]
+	if !ok {
+		return
+	}
+	if _, ok := session.outcomes[job.Path]; !ok {
+		return
+	}
+
+	session.outcomes[job.Path] = &job
+	session.LastActivityAt = time.Now()
+	session.update()
+	if session.Processed == session.Files {
+		s.logger.Printf("Upload session %s, %s", session.ID, session.Summary)
+	}
+}
+
+// List returns the sessions, most recently started first
+func (s *Sessions) List() []UploadSession {
+	if s == nil {
+		return []UploadSession{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	sessions := make([]UploadSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+	return sessions
+}
+
+// prune forgets the sessions that have been processed completely and idle for the retention period,
+// the caller holds s.mu
+func (s *Sessions) prune(now time.Time) {
+	for id, session := range s.sessions {
+		if session.Processed < session.Files || now.Sub(session.LastActivityAt) <= sessionRetention {
+			continue
+		}
+		delete(s.sessions, id)
+		if s.open[session.Source] == session {
+			delete(s.open, session.Source)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "context"
+
+// Slots limits how many task commands run at once. Batch jobs, such as files from the watch directory,
+// may only take the slots that are not reserved, so interactive jobs never queue behind a backlog.
+type Slots struct {
+	total chan struct{}
+	batch chan struct{}
+}
+
+// NewSlots allows total concurrent commands, reserved of which only interactive jobs may use
+func NewSlots(total, reserved int) *Slots {
+	return &Slots{
+		total: make(chan struct{}, total),
+		batch: make(chan struct{}, max(total-reserved, 1)),
+	}
+}
+
+// Acquire waits for a free slot and returns the function releasing it
+func (s *Slots) Acquire(ctx context.Context, interactive bool) (func(), error) {
+	if !interactive {
+		select {
+		case s.batch <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	select {
+	case s.total <- struct{}{}:
+	case <-ctx.Done():
+		if !interactive {
+			<-s.batch
+		}
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-s.total
+		if !interactive {
+			<-s.batch
+		}
+	}, nil
+}
+
+// InUse returns the number of slots taken by running commands
+func (s *Slots) InUse() int {
+	return len(s.total)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Spherical describes the projection of a 360° photo or video, which Immich shows in its panorama viewer
+type Spherical struct {
+	Projection string // e.g. equirectangular, empty for flat media
+	Stereo     string // GSpherical stereo mode of a video: mono, top-bottom or left-right
+}
+
+// sphericalStereoModes maps the stereo 3D types of ffprobe to the stereo modes of GSpherical
+var sphericalStereoModes = map[string]string{
+	"2D":             "mono",
+	"top and bottom": "top-bottom",
+	"side by side":   "left-right",
+}
+
+// probeSpherical returns the projection of a 360° file, or a zero Spherical for flat media. The projection is
+// read with exiftool, like Immich does, from the GPano XMP of images and the GSpherical XMP of videos; for
+// videos carrying only st3d and sv3d boxes, from the spherical mapping ffprobe reports. Without the tools, no
+// file is taken for spherical.
+func probeSpherical(ctx context.Context, filePath, mimeType string) (Spherical, error) {
+	if !strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "video/") {
+		return Spherical{}, nil
+	}
+
+	tags, err := readTags(ctx, []string{"ProjectionType", "StereoMode"}, filePath)
+	if err != nil && !errors.Is(err, exec.ErrNotFound) {
+		return Spherical{}, err
+	}
+	if err == nil {
+		projection, _ := tags[0]["ProjectionType"].(string)
+		stereo, _ := tags[0]["StereoMode"].(string)
+		if projection != "" || !strings.HasPrefix(mimeType, "video/") {
+			return Spherical{Projection: projection, Stereo: stereo}, nil
+		}
+	}
+
+	spherical, err := probeSphericalVideo(ctx, filePath)
+	if errors.Is(err, exec.ErrNotFound) {
+		return Spherical{}, nil
+	}
+	return spherical, err
+}
+
+// probeSphericalVideo reads the spherical mapping and stereo 3D side data of a video with ffprobe
+func probeSphericalVideo(ctx context.Context, filePath string) (Spherical, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream_side_data=side_data_type,projection,type", "-of", "json", filePath).Output()
+	if err != nil {
+		return Spherical{}, fmt.Errorf("unable to probe spherical video: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			SideData []struct {
+				Type       string `json:"side_data_type"`
+				Projection string `json:"projection"`
+				Stereo     string `json:"type"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return Spherical{}, fmt.Errorf("unable to parse ffprobe output: %w", err)
+	}
+
+	var spherical Spherical
+	for _, stream := range probe.Streams {
+		for _, sideData := range stream.SideData {
+			switch sideData.Type {
+			case "Spherical Mapping":
+				spherical.Projection = sideData.Projection
+			case "Stereo 3D":
+				spherical.Stereo = sphericalStereoModes[sideData.Stereo]
+			}
+		}
+	}
+	if spherical.Projection == "" {
+		return Spherical{}, nil
+	}
+	return spherical, nil
+}
+
+// preserveSpherical makes sure the primary output of a task is still a 360° photo or video when the original
+// is one, writing the projection with exiftool when the command dropped it: the GPano XMP of the original
+// in images, the GSpherical XMP in videos. The task fails when it is lost anyway, so the result is not shown
+// as a flat, distorted picture.
+func (tp *TaskProcessor) preserveSpherical(ctx context.Context, task *Task) error {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	original, err := probeSpherical(ctx, tp.OriginalFile.Name(), tp.Media.MimeType)
+	if err != nil {
+		tp.logf("task %s: unable to tell whether the original is spherical: %v", task.Name, err)
+		return nil
+	}
+	if original.Projection == "" {
+		return nil
+	}
+
+	output, _, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+	mimeType, err := sniffMimeType(output)
+	if err != nil {
+		return err
+	}
+	// Without exiftool, the projection of the optimized file can neither be checked nor restored
+	if projection, err := readProjection(ctx, output); projection != "" || errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+
+	tp.debugf("task %s: restoring the %s projection", task.Name, original.Projection)
+	args := []string{"-q", "-q", "-overwrite_original"}
+	if strings.HasPrefix(mimeType, "video/") {
+		stereo := original.Stereo
+		if stereo == "" {
+			stereo = "mono"
+		}
+		args = append(args, "-XMP-GSpherical:Spherical=true", "-XMP-GSpherical:Stitched=true",
+			"-XMP-GSpherical:ProjectionType="+original.Projection, "-XMP-GSpherical:StereoMode="+stereo)
+	} else {
+		args = append(args, "-tagsFromFile", tp.OriginalFile.Name(), "-XMP-GPano:all")
+	}
+	if result, err := exec.CommandContext(ctx, "exiftool", append(args, output)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to restore the spherical projection with exiftool: %w\nOutput:\n%s", err, result)
+	}
+
+	if projection, _ := readProjection(ctx, output); projection == "" {
+		return fmt.Errorf("the optimized file lost the %s projection", original.Projection)
+	}
+	return nil
+}
+
+// readProjection returns the projection exiftool, and so Immich, reads from a file, or an empty string
+func readProjection(ctx context.Context, filePath string) (string, error) {
+	tags, err := readTags(ctx, []string{"ProjectionType"}, filePath)
+	if err != nil {
+		return "", err
+	}
+	projection, _ := tags[0]["ProjectionType"].(string)
+	return projection, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// unmatchedHintThreshold is the number of files of one unmatched extension after which a hint is surfaced
+const unmatchedHintThreshold = 10
+
+// ExtensionStats aggregates the files seen for a single extension
+type ExtensionStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// UserStats aggregates the uploads attributed to a single Immich user
+type UserStats struct {
+	Files         int64 `json:"files"`
+	OriginalBytes int64 `json:"original_bytes"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	SavedBytes    int64 `json:"saved_bytes"`
+}
+
+// StatsSnapshot is a point-in-time copy of the collected statistics
+type StatsSnapshot struct {
+	Users     map[string]UserStats      `json:"users"`
+	Unmatched map[string]ExtensionStats `json:"unmatched_extensions"`
+	Hints     []string                  `json:"hints,omitempty"`
+	Temp      *WorkDirUsage             `json:"temp,omitempty"`
+	Budget    *TempBudgetUsage          `json:"temp_budget,omitempty"`
+	Queue     *QueueStats               `json:"queue,omitempty"`
+}
+
+// QueueStats reports how many files wait to be processed and how many workers are busy with one
+type QueueStats struct {
+	Waiting    int            `json:"waiting"`
+	Limit      int            `json:"limit,omitempty"`
+	Processing int            `json:"processing"`
+	Workers    int            `json:"workers"`
+	Sources    map[string]int `json:"sources,omitempty"`
+	Paused     bool           `json:"paused"`
+}
+
+// Stats collects runtime statistics. A nil *Stats discards everything recorded.
+type Stats struct {
+	mu        sync.Mutex
+	users     map[string]*UserStats
+	unmatched map[string]*ExtensionStats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		users:     make(map[string]*UserStats),
+		unmatched: make(map[string]*ExtensionStats),
+	}
+}
+
+// RecordUpload attributes an uploaded file and the bytes it saved to an Immich user
+func (s *Stats) RecordUpload(user string, originalSize, uploadedSize int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.users[user]
+	if !ok {
+		entry = &UserStats{}
+		s.users[user] = entry
+	}
+	entry.Files++
+	entry.OriginalBytes += originalSize
+	entry.UploadedBytes += uploadedSize
+	entry.SavedBytes += originalSize - uploadedSize
+}
+
+// RecordUnmatched counts a file whose extension matched no task and returns the new count for that extension
+func (s *Stats) RecordUnmatched(extension string, size int64) int64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := extensionStatsKey(extension)
+	entry, ok := s.unmatched[key]
+	if !ok {
+		entry = &ExtensionStats{}
+		s.unmatched[key] = entry
+	}
+	entry.Files++
+	entry.Bytes += size
+
+	return entry.Files
+}
+
+// Snapshot returns a copy of the statistics including configuration hints
+func (s *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Users:     make(map[string]UserStats),
+		Unmatched: make(map[string]ExtensionStats),
+	}
+	if s == nil {
+		return snapshot
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for user, entry := range s.users {
+		snapshot.Users[user] = *entry
+	}
+
+	for extension, entry := range s.unmatched {
+		snapshot.Unmatched[extension] = *entry
+		if entry.Files >= unmatchedHintThreshold {
+			snapshot.Hints = append(snapshot.Hints, unmatchedHint(extension, entry.Files))
+		}
+	}
+	sort.Strings(snapshot.Hints)
+
+	return snapshot
+}
+
+func extensionStatsKey(extension string) string {
+	key := normalizeExtension(extension)
+	if key == "" {
+		return "(none)"
+	}
+	return key
+}
+
+func unmatchedHint(extension string, files int64) string {
+	return fmt.Sprintf("received %d .%s files with no matching task, consider adding one", files, extension)
+}
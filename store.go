@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout is how long opening a file store waits for another process to release it
+const boltOpenTimeout = 5 * time.Second
+
+// Store persists small JSON documents grouped in named buckets.
+// Implementations must be safe for concurrent use; remote ones let several instances share state.
+type Store interface {
+	// Get returns the document stored under key, reporting whether it exists
+	Get(bucket, key string) ([]byte, bool, error)
+	// Put stores a JSON document under key, replacing any previous value
+	Put(bucket, key string, value []byte) error
+	// Delete removes key from the bucket, succeeding if it does not exist
+	Delete(bucket, key string) error
+	// List returns every document in the bucket
+	List(bucket string) (map[string][]byte, error)
+	Close() error
+}
+
+// NewStore opens the store described by rawURL:
+//
+//	memory:                      process-local, lost on restart
+//	file:///var/lib/iuo/state.db  a bbolt database file, used by a single process at a time
+//	redis://:password@host:6379/0 shared by every instance using the same server
+func NewStore(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewBoltStore(u.Path)
+	case "redis":
+		return NewRedisStore(u)
+	default:
+		return nil, fmt.Errorf("unsupported store scheme %q, expected memory, file or redis", u.Scheme)
+	}
+}
+
+// openStateStore opens the store configured with -store or -hash_db and returns the bucket holding uploaded hashes.
+// It returns a nil store when neither is set.
+func openStateStore(storeURL, hashDBFile string) (Store, string, error) {
+	switch {
+	case storeURL != "":
+		store, err := NewStore(storeURL)
+		if err != nil {
+			return nil, "", fmt.Errorf("error opening store: %v", err)
+		}
+		return store, hashesBucket, nil
+	case hashDBFile != "":
+		// A plain file path keeps the hashes in a bbolt database of their own
+		store, err := NewBoltStore(hashDBFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("error opening hash database: %v", err)
+		}
+		return store, hashesBucket, nil
+	default:
+		return nil, "", nil
+	}
+}
+
+// MemoryStore keeps buckets in memory
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) Get(bucket, key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.buckets[bucket][key]
+	return value, ok, nil
+}
+
+func (s *MemoryStore) Put(bucket, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.buckets[bucket][key] = value
+	return nil
+}
+
+func (s *MemoryStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStore) List(bucket string) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return maps.Clone(s.buckets[bucket]), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// BoltStore keeps each bucket as a bbolt bucket in a single database file, so every change writes only the
+// pages it touches and a crash never loses what was committed before
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file store requires a database path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("unable to create store directory: %w", err)
+	}
+
+	// bbolt locks the file, fail rather than wait forever when another process holds it
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s, is another instance using it? %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(bucket, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			// Values are only valid during the transaction
+			if data := b.Get([]byte(key)); data != nil {
+				value = bytes.Clone(data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read %s/%s: %w", bucket, key, err)
+	}
+	return value, value != nil, nil
+}
+
+func (s *BoltStore) Put(bucket, key string, value []byte) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) Delete(bucket, key string) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) List(bucket string) (map[string][]byte, error) {
+	list := make(map[string][]byte)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key, value []byte) error {
+			list[string(key)] = bytes.Clone(value)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s: %w", bucket, err)
+	}
+	return list, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "immich-optimizer:"
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 10 * time.Second
+	// redisMaxBulkLength is the largest bulk string Redis accepts, anything longer is a corrupt reply
+	redisMaxBulkLength = 512 << 20
+)
+
+// RedisStore keeps each bucket as a Redis hash, so several instances pointing at the same server share state.
+// It speaks the small subset of RESP it needs over a single connection, reconnecting after errors.
+type RedisStore struct {
+	address  string
+	username string
+	password string
+	database int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply sent by the server, as opposed to a connection failure
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisStore(u *url.URL) (*RedisStore, error) {
+	s := &RedisStore{
+		address:  u.Host,
+		username: u.User.Username(),
+	}
+	if !strings.Contains(s.address, ":") {
+		s.address += ":6379"
+	}
+	s.password, _ = u.User.Password()
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		var err error
+		if s.database, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	// Fail at startup rather than on the first upload
+	if _, err := s.do("PING"); err != nil {
+		return nil, fmt.Errorf("unable to reach redis at %s: %w", s.address, err)
+	}
+
+	return s, nil
+}
+
+func (s *RedisStore) Get(bucket, key string) ([]byte, bool, error) {
+	reply, err := s.do("HGET", redisKeyPrefix+bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected HGET reply %T", reply)
+	}
+	return value, true, nil
+}
+
+func (s *RedisStore) Put(bucket, key string, value []byte) error {
+	_, err := s.do("HSET", redisKeyPrefix+bucket, key, string(value))
+	return err
+}
+
+func (s *RedisStore) Delete(bucket, key string) error {
+	_, err := s.do("HDEL", redisKeyPrefix+bucket, key)
+	return err
+}
+
+func (s *RedisStore) List(bucket string) (map[string][]byte, error) {
+	reply, err := s.do("HGETALL", redisKeyPrefix+bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("redis: unexpected HGETALL reply %T", reply)
+	}
+
+	list := make(map[string][]byte, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		key, _ := items[i].([]byte)
+		value, _ := items[i+1].([]byte)
+		list[string(key)] = value
+	}
+	return list, nil
+}
+
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.disconnect()
+}
+
+// do sends a command and returns its reply, dropping the connection after any transport error
+func (s *RedisStore) do(args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	reply, err := s.roundTrip(args...)
+	if _, serverError := err.(redisError); err != nil && !serverError {
+		s.disconnect()
+	}
+	return reply, err
+}
+
+func (s *RedisStore) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, redisDialTimeout)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.password != "" {
+		auth := []string{"AUTH", s.password}
+		if s.username != "" {
+			auth = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := s.roundTrip(auth...); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+
+	if s.database != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.database)); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *RedisStore) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+	return err
+}
+
+func (s *RedisStore) roundTrip(args ...string) (any, error) {
+	s.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, command.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	return s.readReply()
+}
+
+// readReply parses one RESP2 reply: simple strings and bulk strings become []byte, arrays []any,
+// integers int64 and null replies nil
+func (s *RedisStore) readReply() (any, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid integer %q", line)
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 || size > redisMaxBulkLength {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, fmt.Errorf("redis: bulk string of %d bytes not terminated by CRLF", size)
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < -1 {
+			return nil, fmt.Errorf("redis: invalid array length %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		// Grow the array as items arrive, a corrupt length must not allocate the memory it claims
+		items := make([]any, 0, min(count, 1024))
+		var replyErr error
+		for range count {
+			item, err := s.readReply()
+			if _, serverError := err.(redisError); err != nil && !serverError {
+				return nil, err
+			}
+			// An error reply inside the array is returned once the rest of the array is read, so the
+			// connection stays in step for the next command
+			if err != nil && replyErr == nil {
+				replyErr = err
+			}
+			items = append(items, item)
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := store.Get("hashes", "missing"); ok || err != nil {
+		t.Fatalf("Get of a missing bucket: ok %v, err %v", ok, err)
+	}
+	if err := store.Delete("hashes", "missing"); err != nil {
+		t.Fatalf("Delete of a missing bucket: %v", err)
+	}
+
+	for i := range 100 {
+		if err := store.Put("hashes", fmt.Sprint(i), []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("other", "1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("hashes", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything committed survives reopening the file
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	value, ok, err := store.Get("hashes", "7")
+	if err != nil || !ok || string(value) != `{"n":7}` {
+		t.Errorf("Get: %q %v %v", value, ok, err)
+	}
+	list, err := store.List("hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 99 {
+		t.Errorf("List: got %d documents, want 99", len(list))
+	}
+	if _, ok := list["42"]; ok {
+		t.Errorf("deleted document was listed")
+	}
+}
+
+func TestBoltStoreConcurrentUse(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				key := fmt.Sprintf("%d-%d", worker, i)
+				if err := store.Put("hashes", key, []byte(`{}`)); err != nil {
+					t.Error(err)
+				}
+				if _, ok, err := store.Get("hashes", key); !ok || err != nil {
+					t.Errorf("Get %s: %v %v", key, ok, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if list, _ := store.List("hashes"); len(list) != 200 {
+		t.Errorf("got %d documents, want 200", len(list))
+	}
+}
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    any
+		wantErr string
+	}{
+		{"simple string", "+OK\r\n", []byte("OK"), ""},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), ""},
+		{"binary bulk string", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"null bulk string", "$-1\r\n", nil, ""},
+		{"null array", "*-1\r\n", nil, ""},
+		{"array", "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", []any{[]byte("a"), int64(1), nil}, ""},
+		{"nested array", "*1\r\n*1\r\n+x\r\n", []any{[]any{[]byte("x")}}, ""},
+		{"server error", "-WRONGTYPE bad key\r\n", nil, "redis: WRONGTYPE bad key"},
+		{"empty line", "\r\n", nil, "empty reply"},
+		{"unknown type", "?1\r\n", nil, "unexpected reply"},
+		{"invalid integer", ":x\r\n", nil, "invalid integer"},
+		{"invalid bulk length", "$x\r\n", nil, "invalid bulk length"},
+		{"negative bulk length", "$-2\r\n", nil, "invalid bulk length"},
+		{"oversized bulk length", "$99999999999\r\n", nil, "invalid bulk length"},
+		{"invalid array length", "*x\r\n", nil, "invalid array length"},
+		{"negative array length", "*-2\r\n", nil, "invalid array length"},
+		{"bulk string without CRLF", "$3\r\nabcXY", nil, "not terminated by CRLF"},
+		{"truncated line", "+OK", nil, "EOF"},
+		{"truncated bulk string", "$10\r\nabc", nil, "unexpected EOF"},
+		{"truncated array", "*2\r\n$1\r\na\r\n", nil, "EOF"},
+		{"huge truncated array", "*2000000000\r\n:1\r\n", nil, "EOF"},
+		{"error inside array", "*2\r\n:1\r\n-ERR boom\r\n", nil, "redis: ERR boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &RedisStore{reader: bufio.NewReader(strings.NewReader(tt.reply))}
+			got, err := s.readReply()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisReadReplyDrainsArrayAfterError(t *testing.T) {
+	s := &RedisStore{reader: bufio.NewReader(strings.NewReader("*3\r\n-ERR first\r\n$1\r\na\r\n-ERR second\r\n+NEXT\r\n"))}
+	if _, err := s.readReply(); err == nil || err.Error() != "redis: ERR first" {
+		t.Fatalf("got %v, want the first error reply", err)
+	}
+	// The next reply is the one following the array, not its leftovers
+	got, err := s.readReply()
+	if err != nil || string(got.([]byte)) != "NEXT" {
+		t.Errorf("got %q %v after the array", got, err)
+	}
+}
+
+// fakeRedis serves the hash commands RedisStore sends from a map, replying to the commands listed in
+// broken with a truncated bulk string
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	broken   map[string]bool
+	conns    int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, hashes: make(map[string]map[string]string), broken: make(map[string]bool)}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		s := &RedisStore{reader: reader}
+		request, err := s.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range request.([]any) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if _, err := conn.Write([]byte(f.reply(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.broken[args[0]] {
+		return "$10\r\nabc"
+	}
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "HSET":
+		if f.hashes[args[1]] == nil {
+			f.hashes[args[1]] = make(map[string]string)
+		}
+		f.hashes[args[1]][args[2]] = args[3]
+		return ":1\r\n"
+	case "HGET":
+		value, ok := f.hashes[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "HDEL":
+		delete(f.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case "HGETALL":
+		reply := fmt.Sprintf("*%d\r\n", 2*len(f.hashes[args[1]]))
+		for key, value := range f.hashes[args[1]] {
+			reply += bulk(key) + bulk(value)
+		}
+		return reply
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	fake := newFakeRedis(t)
+	store, err := NewRedisStore(&url.URL{Scheme: "redis", Host: fake.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, ok, err := store.Get("hashes", "a"); ok || err != nil {
+		t.Fatalf("Get of a missing key: %v %v", ok, err)
+	}
+	value := `{"filename":"a\r\nb.jpg"}`
+	if err := store.Put("hashes", "a", []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("hashes", "b", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := store.Get("hashes", "a"); !ok || err != nil || string(got) != value {
+		t.Errorf("Get: %q %v %v", got, ok, err)
+	}
+	if err := store.Delete("hashes", "b"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List("hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || string(list["a"]) != value {
+		t.Errorf("List: %q", list)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.hashes[redisKeyPrefix+"hashes"]; !ok {
+		t.Errorf("buckets are not stored under %q", redisKeyPrefix)
+	}
+}
+
+func TestRedisStoreReconnectsAfterBrokenReply(t *testing.T) {
+	fake := newFakeRedis(t)
+	store, err := NewRedisStore(&url.URL{Scheme: "redis", Host: fake.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// A server error keeps the connection
+	if _, err := store.do("UNKNOWN"); !errors.As(err, new(redisError)) {
+		t.Fatalf("got %v, want a server error", err)
+	}
+
+	fake.mu.Lock()
+	fake.broken["HGET"] = true
+	fake.mu.Unlock()
+	if _, _, err := store.Get("hashes", "a"); err == nil {
+		t.Fatal("truncated reply was accepted")
+	}
+
+	fake.mu.Lock()
+	fake.broken["HGET"] = false
+	fake.mu.Unlock()
+	if _, _, err := store.Get("hashes", "a"); err != nil {
+		t.Fatalf("Get after a broken reply: %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.conns != 2 {
+		t.Errorf("got %d connections, want 2", fake.conns)
+	}
+}
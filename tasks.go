@@ -2,22 +2,47 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
 )
 
+// tempSpaceSafetyMargin is the free space that must remain on the temp filesystem after copying a file into it
+const tempSpaceSafetyMargin = 64 << 20
+
+// tempSpaceRetryDelay is how long a file refused for lack of temp space waits before it is tried again
+const tempSpaceRetryDelay = 5 * time.Minute
+
+// ErrInsufficientTempSpace is returned when the temp filesystem cannot hold a working copy of the file
+var ErrInsufficientTempSpace = errors.New("insufficient free space on temp filesystem")
+
+// ErrNoMatchingTask is returned when none of the tasks applies to the file
+var ErrNoMatchingTask = errors.New("no task found")
+
+// ErrTaskTimeout is returned when a command ran longer than the timeout of its task and was killed
+var ErrTaskTimeout = errors.New("task timed out")
+
+// ErrTempUnavailable is returned when the temp filesystem is full or read-only, so no task can run at all
+var ErrTempUnavailable = errors.New("temp filesystem unavailable")
+
 type TaskProcessor struct {
 	OriginalFilename  string
 	OriginalFile      *os.File
 	OriginalExtension string
 	OriginalSize      int64
+	OriginalModTime   time.Time
+	Media             MediaInfo
 
 	tempFileOriginalFile string
 
@@ -25,14 +50,35 @@ type TaskProcessor struct {
 	ProcessedFile      *os.File
 	ProcessedExtension string
 	ProcessedSize      int64
+	ProcessedTask      *Task
+	ExtraOutputs       []ExtraOutput // files the task wrote besides the optimized file, see TaskOutput
 
 	tempWorkDir    string
 	tempWorkDirSrc string
 	tempWorkDirDst string
 
-	logger    *customLogger
-	semaphore chan struct{}
-	configDir string
+	logger      *customLogger
+	slots       *Slots
+	interactive bool
+	pools       *Pools
+	timeout     time.Duration
+	cache       *ResultCache
+	contentSum  string
+	progress    ProgressFunc
+	remote      *RemoteWorker
+	resources   ResourceLimits
+	duration    *time.Duration
+	bitrate     *int64
+	limits      MediaLimits
+	configDir   string
+	workDirs    *WorkDirGC
+	budget      *TempBudget
+	release     func()
+	builtin     BuiltinEncoder
+	quality     any // quality of the ladder step being run, see QualityLadder
+	validation  OutputValidation
+	livePhotos  string
+	motionVideo string // video of the motion photo being optimized, split from the working copy
 }
 
 func NewTaskProcessor(filename string) (tp *TaskProcessor, err error) {
@@ -49,11 +95,18 @@ func NewTaskProcessor(filename string) (tp *TaskProcessor, err error) {
 	originalSize := stat.Size()
 	originalExtension := strings.ToLower(path.Ext(filename))
 
+	media, err := DetectMedia(filename, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to detect file type: %w", err)
+	}
+
 	tp = &TaskProcessor{
 		OriginalFilename:  filepath.Base(filename),
 		OriginalFile:      originalFile,
 		OriginalExtension: originalExtension,
 		OriginalSize:      originalSize,
+		OriginalModTime:   stat.ModTime(),
+		Media:             media,
 	}
 
 	return
@@ -63,48 +116,199 @@ func (tp *TaskProcessor) SetLogger(logger *customLogger) {
 	tp.logger = logger
 }
 
-func (tp *TaskProcessor) SetSemaphore(semaphore chan struct{}) {
-	tp.semaphore = semaphore
+// SetSlots limits the commands run concurrently; interactive jobs may also use the reserved slots
+func (tp *TaskProcessor) SetSlots(slots *Slots, interactive bool) {
+	tp.slots = slots
+	tp.interactive = interactive
+}
+
+// SetPools additionally limits the commands run concurrently per category, such as images and videos
+func (tp *TaskProcessor) SetPools(pools *Pools) {
+	tp.pools = pools
+}
+
+// SetTimeout kills commands running longer than timeout, unless their task sets its own
+func (tp *TaskProcessor) SetTimeout(timeout time.Duration) {
+	tp.timeout = timeout
+}
+
+// SetResultCache replays results cached for an original with the given XXH64 instead of running the task,
+// and caches new ones
+func (tp *TaskProcessor) SetResultCache(cache *ResultCache, sum string) {
+	tp.cache = cache
+	tp.contentSum = sum
+}
+
+// SetProgress reports the progress of commands printing ffmpeg progress, relative to the duration of the file
+func (tp *TaskProcessor) SetProgress(progress ProgressFunc) {
+	tp.progress = progress
+}
+
+// SetResources runs commands in a cgroup with the limits, which tasks may override
+func (tp *TaskProcessor) SetResources(resources ResourceLimits) {
+	tp.resources = resources
+}
+
+// SetRemote runs the tasks marked remote on a remote worker instead of locally
+func (tp *TaskProcessor) SetRemote(remote *RemoteWorker) {
+	tp.remote = remote
 }
 
 func (tp *TaskProcessor) SetConfigDir(configDir string) {
 	tp.configDir = configDir
 }
 
+func (tp *TaskProcessor) SetWorkDirGC(workDirs *WorkDirGC) {
+	tp.workDirs = workDirs
+}
+
+// SetTempBudget accounts the temp space of the file against the budget, refusing it when it does not fit
+func (tp *TaskProcessor) SetTempBudget(budget *TempBudget) {
+	tp.budget = budget
+}
+
+// SetLimits rejects files whose decoded size exceeds the limits before any task runs
+func (tp *TaskProcessor) SetLimits(limits MediaLimits) {
+	tp.limits = limits
+}
+
+// SetBuiltin re-encodes images with the built-in encoder when the tool of a task is not installed
+func (tp *TaskProcessor) SetBuiltin(builtin BuiltinEncoder) {
+	tp.builtin = builtin
+}
+
+// SetOutputValidation checks the result of every task before it replaces the original
+func (tp *TaskProcessor) SetOutputValidation(validation OutputValidation) {
+	tp.validation = validation
+}
+
+// SetLivePhotos sets how the halves of a Live Photo are optimized, see LivePhotosPreserve
+func (tp *TaskProcessor) SetLivePhotos(mode string) {
+	tp.livePhotos = mode
+}
+
+// SetMedia replaces the detected file type, e.g. with one that includes the probed video codec
+func (tp *TaskProcessor) SetMedia(media MediaInfo) {
+	tp.Media = media
+}
+
 func (tp *TaskProcessor) logf(str string, args ...any) {
 	if tp.logger != nil {
 		tp.logger.Printf(str, args...)
 	}
 }
 
-func (tp *TaskProcessor) Process(tasks []Task) (err error) {
-	err = fmt.Errorf("no task found for file extension %s", tp.OriginalExtension)
-	var errors []error
+func (tp *TaskProcessor) debugf(str string, args ...any) {
+	if tp.logger != nil {
+		tp.logger.Debugf(str, args...)
+	}
+}
+
+// Process runs the first task matching the file that succeeds.
+// Cancelling ctx kills the running command and stops trying further tasks.
+func (tp *TaskProcessor) Process(ctx context.Context, tasks []Task) (err error) {
+	if err = tp.checkTempSpace(); err != nil {
+		return err
+	}
+
+	// The working copy and the optimized file are assumed to take the size of the original each
+	if tp.release, err = tp.budget.Reserve(2 * tp.OriginalSize); err != nil {
+		return err
+	}
+
+	if err = tp.checkLimits(); err != nil {
+		return err
+	}
+
+	if needsCodec(tasks) && tp.Media.Codec == "" && strings.HasPrefix(tp.Media.MimeType, "video/") {
+		if tp.Media.Codec, err = probeVideoCodec(tp.OriginalFile.Name()); err != nil {
+			tp.logf("%v", err)
+		}
+	}
+	if needsDimensions(tasks) && tp.Media.Width == 0 {
+		if tp.Media, err = probeMediaDimensions(tp.OriginalFile.Name(), tp.Media); err != nil {
+			tp.logf("%v", err)
+		}
+	}
+	if needsColor(tasks) && tp.Media.Color == "" {
+		if tp.Media, err = probeMediaColor(tp.OriginalFile.Name(), tp.Media); err != nil {
+			tp.logf("%v", err)
+		}
+	}
+
+	err = fmt.Errorf("%w for file extension %s (%s)", ErrNoMatchingTask, tp.OriginalExtension, tp.Media.MimeType)
+	var taskErrors []error
 
 	for _, task := range tasks {
-		if !slices.Contains(task.Extensions, normalizeExtension(tp.OriginalExtension)) {
+		if !task.Matches(tp.Media) {
 			continue
 		}
 
-		convErr := tp.run(task.CommandTemplate)
+		convErr := tp.run(ctx, &task)
+		if ctx.Err() != nil {
+			tp.cleanWorkDir()
+			return fmt.Errorf("task %s interrupted: %w", task.Name, ctx.Err())
+		}
+		if errors.Is(convErr, ErrTempUnavailable) {
+			tp.cleanWorkDir()
+			return convErr
+		}
 		if convErr != nil {
-			errors = append(errors, fmt.Errorf("\ntask %s failed: %w", task.Name, convErr))
+			taskErrors = append(taskErrors, fmt.Errorf("\ntask %s failed: %w", task.Name, convErr))
 			tp.cleanWorkDir()
 			continue
 		}
+		tp.ProcessedTask = &task
 		err = nil
 		break
 	}
 
-	if len(errors) > 1 {
-		err = fmt.Errorf("errors: %v", errors)
-	} else if len(errors) == 1 {
-		err = errors[0]
+	if len(taskErrors) > 1 {
+		err = fmt.Errorf("errors: %v", taskErrors)
+	} else if len(taskErrors) == 1 {
+		err = taskErrors[0]
 	}
 
 	return
 }
 
+// checkLimits probes the decoded size of the file when limits are configured and rejects it when too large
+func (tp *TaskProcessor) checkLimits() error {
+	if !tp.limits.Enabled() {
+		return nil
+	}
+
+	dimensions, ok, err := probeDimensions(tp.OriginalFile.Name(), tp.Media.MimeType)
+	if err != nil {
+		tp.logf("unable to check limits: %v", err)
+		return nil
+	}
+	if !ok {
+		tp.debugf("unable to determine dimensions of %s, limits not checked", tp.Media.MimeType)
+		return nil
+	}
+	tp.debugf("dimensions %dx%d, %d frames at %.2f fps", dimensions.Width, dimensions.Height, dimensions.Frames, dimensions.FPS)
+
+	return tp.limits.Check(dimensions)
+}
+
+// checkTempSpace fails early when the temp filesystem cannot hold a copy of the file plus a safety margin,
+// instead of failing mid-transcode and leaving partial work directories behind
+func (tp *TaskProcessor) checkTempSpace() error {
+	available, err := availableDiskSpace(os.TempDir())
+	if err != nil {
+		tp.logf("unable to check free temp space: %v", err)
+		return nil
+	}
+
+	required := tp.OriginalSize + tempSpaceSafetyMargin
+	if available < required {
+		return fmt.Errorf("%w: %s available, %s required", ErrInsufficientTempSpace, humanReadableSize(available), humanReadableSize(required))
+	}
+
+	return nil
+}
+
 func (tp *TaskProcessor) Close() (err error) {
 	err = tp.OriginalFile.Close()
 	if err != nil {
@@ -119,6 +323,9 @@ func (tp *TaskProcessor) Close() (err error) {
 	}
 
 	tp.cleanWorkDir()
+	if tp.release != nil {
+		tp.release()
+	}
 
 	return
 }
@@ -129,35 +336,162 @@ func (tp *TaskProcessor) cleanWorkDir() (err error) {
 		if err != nil {
 			tp.logf("unable to clean temp folder: %v", err)
 		}
+		tp.workDirs.Untrack(tp.tempWorkDir)
 	}
 
 	tp.tempWorkDir = ""
+	tp.motionVideo = ""
 	tp.tempWorkDirSrc = ""
 	tp.tempWorkDirDst = ""
 
 	return
 }
 
-func (tp *TaskProcessor) run(commandTemplate *template.Template) error {
+func (tp *TaskProcessor) run(ctx context.Context, task *Task) error {
 	if err := tp.setupWorkDirectories(); err != nil {
+		return classifyTempError(err)
+	}
+
+	if tp.loadCachedResult(task) {
+		return tp.processResults(task)
+	}
+
+	timeout := task.timeout
+	if timeout == 0 {
+		timeout = tp.timeout
+	}
+
+	// The result of the built-in encoder is not cached, so the task runs once its tool is installed
+	cacheable := true
+	if task.Remote && tp.remote != nil {
+		if err := tp.runRemote(ctx, task, timeout); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if task.Ladder != nil {
+			cacheable, err = tp.runLadder(ctx, task, timeout)
+		} else {
+			cacheable, err = tp.runLocal(ctx, task, timeout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if task.PreserveMetadata {
+		if err := tp.preserveMetadata(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	if tp.livePhotos == LivePhotosPreserve {
+		if err := tp.preserveLivePhoto(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	if err := tp.preserveSpherical(ctx, task); err != nil {
 		return err
 	}
 
+	if tp.motionVideo != "" {
+		if err := tp.reembedMotionVideo(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	if tp.Media.Animated {
+		if err := tp.validateAnimation(task); err != nil {
+			return err
+		}
+	}
+
+	if tp.validation.Enabled {
+		if err := tp.validateOutput(task); err != nil {
+			return err
+		}
+	}
+
+	if err := tp.processResults(task); err != nil {
+		return err
+	}
+	if cacheable {
+		tp.storeCachedResult(task)
+	}
+	return nil
+}
+
+// runLocal copies the original into the source folder and runs the steps or the command of the task on
+// it, falling back to the built-in encoder when a tool is missing. It reports whether the result may be
+// cached, which a result of the built-in encoder may not.
+func (tp *TaskProcessor) runLocal(ctx context.Context, task *Task, timeout time.Duration) (cacheable bool, err error) {
 	tempFile, err := tp.copySourceFile()
 	if err != nil {
-		return err
+		return false, classifyTempError(err)
+	}
+	if task.MotionPhoto == MotionPhotoReembed && tp.Media.MotionPhoto {
+		if err := tp.splitWorkingCopy(tempFile.Name()); err != nil {
+			return false, err
+		}
+	}
+
+	limits := tp.resources.override(task.Resources)
+	if len(task.Steps) > 0 {
+		return true, tp.runSteps(ctx, task, tempFile.Name(), timeout, limits)
 	}
 
-	command, err := tp.buildCommand(commandTemplate, tempFile)
+	command, err := tp.buildCommandLine(task, tempFile.Name())
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if err := tp.executeCommand(command); err != nil {
-		return err
+	err = tp.executeCommand(ctx, command, task.PoolName(tp.Media), task.GPU, timeout, limits)
+	if err != nil && (!isCommandNotFound(err) || !tp.builtin.Supports(tp.Media.MimeType)) {
+		return false, err
+	}
+	if err != nil {
+		tp.logf("task %s: %v", task.Name, err)
+		return false, tp.runBuiltin(ctx, task, tempFile.Name())
+	}
+	return true, nil
+}
+
+// loadCachedResult puts the result cached for the task into the destination folder and reports whether
+// there was one
+func (tp *TaskProcessor) loadCachedResult(task *Task) bool {
+	if tp.cache == nil || tp.contentSum == "" || len(task.Outputs) > 0 {
+		return false
+	}
+
+	ok, err := tp.cache.Load(tp.cache.Key(tp.contentSum, tp.OriginalSize, task), tp.tempWorkDirDst)
+	if err != nil {
+		tp.logf("unable to use cached result: %v", err)
+		return false
+	}
+	if ok {
+		tp.logf("task %s: using the cached result of an identical file", task.Name)
+	}
+	return ok
+}
+
+func (tp *TaskProcessor) storeCachedResult(task *Task) {
+	// Only the optimized file is cached, not the other outputs
+	if tp.cache == nil || tp.contentSum == "" || len(task.Outputs) > 0 {
+		return
+	}
+
+	if err := tp.cache.Store(tp.cache.Key(tp.contentSum, tp.OriginalSize, task), tp.ProcessedFile.Name()); err != nil {
+		tp.logf("unable to cache result: %v", err)
 	}
+}
 
-	return tp.processResults()
+// classifyTempError marks errors caused by a full or read-only temp filesystem as ErrTempUnavailable
+func classifyTempError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("%w: %w", ErrTempUnavailable, err)
+	}
+	return err
 }
 
 func (tp *TaskProcessor) setupWorkDirectories() error {
@@ -168,6 +502,7 @@ func (tp *TaskProcessor) setupWorkDirectories() error {
 	if err != nil {
 		return fmt.Errorf("unable to create temp folder: %w", err)
 	}
+	tp.workDirs.Track(tp.tempWorkDir)
 
 	tp.tempWorkDirSrc = path.Join(tp.tempWorkDir, "src")
 	if err = os.Mkdir(tp.tempWorkDirSrc, 0o700); err != nil {
@@ -197,60 +532,253 @@ func (tp *TaskProcessor) copySourceFile() (*os.File, error) {
 	}
 	tempFile.Close()
 
+	// Commands that carry file dates over, e.g. with touch -r or exiftool, see those of the original
+	if err = os.Chtimes(tempFile.Name(), tp.OriginalModTime, tp.OriginalModTime); err != nil {
+		tp.logf("unable to set times of temp file: %v", err)
+	}
+
 	return tempFile, nil
 }
 
-func (tp *TaskProcessor) buildCommand(commandTemplate *template.Template, tempFile *os.File) (string, error) {
-	basename := path.Base(tempFile.Name())
+func (tp *TaskProcessor) buildCommand(commandTemplate *template.Template, srcPath string) (string, error) {
+	basename := path.Base(srcPath)
 	extension := path.Ext(basename)
-	values := map[string]string{
+	values := map[string]any{
 		"src_folder": tp.tempWorkDirSrc,
 		"dst_folder": tp.tempWorkDirDst,
 		"name":       strings.TrimSuffix(basename, extension),
 		"extension":  strings.TrimPrefix(extension, "."),
 	}
+	if tp.quality != nil {
+		values["quality"] = tp.quality
+	}
+
+	// The template is shared by every file, the functions probing the file are bound to a copy of it
+	commandTemplate, err := commandTemplate.Clone()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate command to be run: %w", err)
+	}
 
 	var cmdLine bytes.Buffer
-	if err := commandTemplate.Execute(&cmdLine, values); err != nil {
+	if err := commandTemplate.Funcs(commandFuncs(tp)).Execute(&cmdLine, values); err != nil {
 		return "", fmt.Errorf("unable to generate command to be run: %w", err)
 	}
 
 	return cmdLine.String(), nil
 }
 
-func (tp *TaskProcessor) executeCommand(command string) error {
+// buildCommandLine renders the args of a task, each of them one argument however it is quoted, or its
+// shell command
+func (tp *TaskProcessor) buildCommandLine(task *Task, srcPath string) (commandLine, error) {
+	var command commandLine
+	if len(task.ArgsTemplates) == 0 {
+		shell, err := tp.buildCommand(task.CommandTemplate, srcPath)
+		if err != nil {
+			return command, err
+		}
+		command.shell = shell
+	} else {
+		command.args = make([]string, len(task.ArgsTemplates))
+		for i, argTemplate := range task.ArgsTemplates {
+			var err error
+			if command.args[i], err = tp.buildCommand(argTemplate, srcPath); err != nil {
+				return command, err
+			}
+		}
+	}
+	return command, tp.buildEnvironment(task, &command, srcPath)
+}
+
+// buildEnvironment renders the env and workdir of a task into the command, a relative workdir being
+// relative to the folder of the tasks file
+func (tp *TaskProcessor) buildEnvironment(task *Task, command *commandLine, srcPath string) error {
+	for _, name := range slices.Sorted(maps.Keys(task.envTemplates)) {
+		value, err := tp.buildCommand(task.envTemplates[name], srcPath)
+		if err != nil {
+			return err
+		}
+		command.env = append(command.env, name+"="+value)
+	}
+
+	if task.workdirTemplate != nil {
+		dir, err := tp.buildCommand(task.workdirTemplate, srcPath)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(dir) && tp.configDir != "" {
+			dir = filepath.Join(tp.configDir, dir)
+		}
+		command.dir = dir
+	}
+	return nil
+}
+
+// acquire waits for the pool, the GPU session and the slot a command needs, returning the function releasing them
+func (tp *TaskProcessor) acquire(ctx context.Context, pool string, gpu bool) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, release := range slices.Backward(releases) {
+			release()
+		}
+	}
+
+	// Wait for the pool of the category first, so commands queued behind it do not hold a global slot
+	releasePool, err := tp.pools.Acquire(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	releases = append(releases, releasePool)
+
+	// Then for a GPU session, so CPU tasks keep running while GPU tasks wait for the hardware encoder
+	if gpu {
+		releaseGPU, err := tp.pools.Acquire(ctx, gpuPool)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, releaseGPU)
+	}
+
 	// Limit the number of concurrent tasks running
-	if tp.semaphore != nil {
-		tp.semaphore <- struct{}{}
-		defer func() { <-tp.semaphore }()
+	if tp.slots != nil {
+		releaseSlot, err := tp.slots.Acquire(ctx, tp.interactive)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, releaseSlot)
+	}
+
+	return release, nil
+}
+
+// commandLine is a command run with sh -c, or, when args is set, an executable run directly with its arguments
+type commandLine struct {
+	shell string
+	args  []string
+	// env is added to the environment of the optimizer, dir replaces the folder of the tasks file
+	env []string
+	dir string
+}
+
+func (c commandLine) String() string {
+	if len(c.args) == 0 {
+		return c.shell
+	}
+	words := make([]string, len(c.args))
+	for i, arg := range c.args {
+		words[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]#~") {
+			words[i] = shellQuote(arg)
+		}
 	}
+	return strings.Join(words, " ")
+}
+
+func (c commandLine) command(ctx context.Context) *exec.Cmd {
+	if len(c.args) == 0 {
+		return exec.CommandContext(ctx, "sh", "-c", c.shell)
+	}
+	return exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+}
+
+func (tp *TaskProcessor) executeCommand(ctx context.Context, command commandLine, pool string, gpu bool, timeout time.Duration, limits ResourceLimits) error {
+	_, err := tp.commandOutput(ctx, command, pool, gpu, timeout, limits)
+	return err
+}
+
+// commandOutput runs a command once the pool, the GPU session and the slot it needs are free, within the
+// timeout and the resource limits, and returns what it printed
+func (tp *TaskProcessor) commandOutput(ctx context.Context, command commandLine, pool string, gpu bool, timeout time.Duration, limits ResourceLimits) ([]byte, error) {
+	release, err := tp.acquire(ctx, pool, gpu)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	tp.logf("running: %s", command)
 
-	cmd := exec.Command("sh", "-c", command)
+	// The timeout starts once the command runs, waiting for a slot does not count
+	commandCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		commandCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := command.command(commandCtx)
 	if tp.configDir != "" {
 		cmd.Dir = tp.configDir
 	}
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, command, string(output))
+	if command.dir != "" {
+		cmd.Dir = command.dir
+	}
+	if len(command.env) > 0 {
+		cmd.Env = append(os.Environ(), command.env...)
+	}
+	// Run the command in its own process group so cancelling also kills the tools spawned by the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
 
-	return nil
-}
+	var cgroup *commandCgroup
+	if limits.Enabled() {
+		if cgroup, err = newCommandCgroup(limits); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := cgroup.Remove(); err != nil {
+				tp.logf("unable to remove cgroup: %v", err)
+			}
+		}()
+		cgroup.Apply(cmd.SysProcAttr)
+	}
 
-func (tp *TaskProcessor) processResults() error {
-	files, err := os.ReadDir(tp.tempWorkDirDst)
+	var output bytes.Buffer
+	var writer io.Writer = &output
+	if tp.progress != nil {
+		writer = io.MultiWriter(&output, newProgressParser(tp.mediaDuration(), tp.progress))
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err = cmd.Run()
+	if err != nil && cgroup != nil && cgroup.OOMKilled() {
+		return nil, fmt.Errorf("%w, memory_max is %s, the command was killed:\n%s\nOutput:\n%s", ErrMemoryLimitExceeded, limits.MemoryMax, command, output.String())
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(commandCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w after %s, the command was killed:\n%s\nOutput:\n%s", ErrTaskTimeout, timeout, command, output.String())
+	}
 	if err != nil {
-		return fmt.Errorf("unable to read temp directory: %w", err)
+		return nil, fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, command, output.String())
+	}
+	if output.Len() > 0 {
+		tp.debugf("command output:\n%s", output.String())
 	}
 
-	if len(files) != 1 {
-		return fmt.Errorf("unexpected number of files in temp directory: %d", len(files))
+	return output.Bytes(), nil
+}
+
+// mediaDuration returns the duration of a video or audio original, probed once, or 0 when it is unknown
+// so progress falls back to the duration ffmpeg prints
+func (tp *TaskProcessor) mediaDuration() time.Duration {
+	if tp.duration == nil {
+		var duration time.Duration
+		if strings.HasPrefix(tp.Media.MimeType, "video/") || strings.HasPrefix(tp.Media.MimeType, "audio/") {
+			duration = probeDuration(tp.OriginalFile.Name())
+		}
+		tp.duration = &duration
 	}
+	return *tp.duration
+}
 
-	processedFileName := files[0].Name()
-	processedFile := path.Join(tp.tempWorkDirDst, processedFileName)
+func (tp *TaskProcessor) processResults(task *Task) error {
+	processedFile, extras, err := tp.classifyOutputs(task)
+	if err != nil {
+		return err
+	}
+	processedFileName := path.Base(processedFile)
+	tp.ExtraOutputs = extras
 
 	tp.ProcessedFile, err = os.Open(processedFile)
 	if err != nil {
@@ -259,6 +787,12 @@ func (tp *TaskProcessor) processResults() error {
 
 	tp.ProcessedExtension = strings.ToLower(path.Ext(processedFileName))
 
+	// Immich falls back to the file dates when the optimized file carries no capture date, and the upload
+	// sends them as fileCreatedAt and fileModifiedAt, so they must be those of the original
+	if err = os.Chtimes(processedFile, tp.OriginalModTime, tp.OriginalModTime); err != nil {
+		return fmt.Errorf("unable to preserve file times: %w", err)
+	}
+
 	stat, err := os.Stat(processedFile)
 	if err != nil {
 		return fmt.Errorf("unable to get file size: %w", err)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tempBudgetRetryDelay is how long a file refused for the temp budget waits before it is tried again
+const tempBudgetRetryDelay = time.Minute
+
+// ErrTempBudgetExceeded is returned when a file would take more temp space than is left of the budget
+var ErrTempBudgetExceeded = errors.New("temp budget exceeded")
+
+// TempBudgetUsage reports the temp space accounted for against the budget
+type TempBudgetUsage struct {
+	Budget        int64 `json:"budget"`
+	ReservedBytes int64 `json:"reserved_bytes"`
+	Jobs          int   `json:"jobs"`
+	CacheBytes    int64 `json:"cache_bytes"`
+	RefusedTotal  int64 `json:"refused_total"`
+}
+
+// TempBudget caps the disk used by work folders and the result cache together. Every job reserves twice the
+// size of its original, for the working copy and the optimized file, before its first command runs; the
+// oldest cached results are evicted to make room, and a job that still does not fit is refused until
+// running ones release their space. A nil *TempBudget accounts for nothing.
+type TempBudget struct {
+	budget int64
+	cache  *ResultCache
+
+	mu       sync.Mutex
+	reserved int64
+	jobs     int
+	refused  int64
+}
+
+func NewTempBudget(budget int64, cache *ResultCache) *TempBudget {
+	return &TempBudget{budget: budget, cache: cache}
+}
+
+// Reserve accounts for size bytes of temp space until the returned function is called
+func (b *TempBudget) Reserve(size int64) (release func(), err error) {
+	if b == nil {
+		return func() {}, nil
+	}
+
+	if size > b.budget {
+		return nil, fmt.Errorf("the file needs %s of temp space, more than the whole temp budget of %s",
+			humanReadableSize(size), humanReadableSize(b.budget))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.reserved+size > b.budget {
+		b.refused++
+		return nil, fmt.Errorf("%w: %s required, %s of %s reserved by %d running jobs", ErrTempBudgetExceeded,
+			humanReadableSize(size), humanReadableSize(b.reserved), humanReadableSize(b.budget), b.jobs)
+	}
+	b.cache.Shrink(b.budget - b.reserved - size)
+	b.reserved += size
+	b.jobs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.reserved -= size
+			b.jobs--
+		})
+	}, nil
+}
+
+// Usage returns the reserved space and the size of the result cache
+func (b *TempBudget) Usage() TempBudgetUsage {
+	b.mu.Lock()
+	usage := TempBudgetUsage{
+		Budget:        b.budget,
+		ReservedBytes: b.reserved,
+		Jobs:          b.jobs,
+		RefusedTotal:  b.refused,
+	}
+	b.mu.Unlock()
+
+	// Shrinking to the whole budget only drops expired entries and what could never fit
+	usage.CacheBytes = b.cache.Shrink(b.budget)
+	return usage
+}
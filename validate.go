@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// versionProbeTimeout bounds running a tool with --version while validating
+const versionProbeTimeout = 10 * time.Second
+
+// shellBuiltins are the commands sh runs itself, which are not looked up as tools
+var shellBuiltins = []string{"cd", "echo", "exit", "export", "false", "printf", "set", "test", "true", "[", ":", "."}
+
+// commandSeparators split a shell command into the simple commands whose first word runs a tool
+var commandSeparators = regexp.MustCompile(`&&|\|\||[;|&\n()]`)
+
+// validation collects the findings of the validate subcommand
+type validation struct {
+	out    io.Writer
+	errors int
+}
+
+func (v *validation) errorf(format string, args ...any) {
+	v.errors++
+	fmt.Fprintf(v.out, "  error:   "+format+"\n", args...)
+}
+
+func (v *validation) warnf(format string, args ...any) {
+	fmt.Fprintf(v.out, "  warning: "+format+"\n", args...)
+}
+
+func (v *validation) okf(format string, args ...any) {
+	fmt.Fprintf(v.out, "  ok:      "+format+"\n", args...)
+}
+
+// runValidate implements the validate subcommand: it loads a tasks file, renders every command with sample
+// values, checks the tools the commands run are installed and reports extensions claimed by several tasks
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	tasksFile := flags.String("tasks_file", cmp.Or(os.Getenv("IUO_TASKS_FILE"), "tasks.yaml"), "Path to the configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [flags]\n\nChecks a tasks file without starting the watcher.\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := readConfig(*tasksFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	v := &validation{out: os.Stdout}
+	v.validateConfig(config, filepath.Dir(*tasksFile))
+	if v.errors > 0 {
+		fmt.Fprintf(os.Stdout, "%s: %d errors\n", *tasksFile, v.errors)
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "%s: valid, %d tasks\n", *tasksFile, len(config.Tasks))
+	return 0
+}
+
+func (v *validation) validateConfig(config *Config, configDir string) {
+	versions := make(map[string]string)
+	for _, task := range config.Tasks {
+		fmt.Fprintf(v.out, "task %s\n", task.Name)
+		if task.hwaccel != "" {
+			v.okf("runs its %s variant", task.hwaccel)
+		}
+
+		var commands []string
+		switch {
+		case len(task.ArgsTemplates) > 0:
+			var args []string
+			for _, argTemplate := range task.ArgsTemplates {
+				args = append(args, renderSample(argTemplate))
+			}
+			v.okf("args: %s", commandLine{args: args})
+			v.checkTool(args[0], configDir, versions)
+		case len(task.Steps) > 0:
+			for i, step := range task.Steps {
+				command := renderSample(step.CommandTemplate)
+				v.okf("step %d: %s", i+1, command)
+				commands = append(commands, command)
+			}
+		case task.Command == "":
+			v.okf("empty command")
+		default:
+			command := renderSample(task.CommandTemplate)
+			v.okf("command: %s", command)
+			commands = append(commands, command)
+		}
+
+		for _, command := range commands {
+			for _, tool := range commandTools(command) {
+				v.checkTool(tool, configDir, versions)
+			}
+		}
+	}
+
+	v.checkTaskNames(config.Tasks)
+	v.checkExtensions(config.Tasks)
+}
+
+// renderSample renders a command template with the sample values used when the tasks file is loaded
+func renderSample(commandTemplate *template.Template) string {
+	var command bytes.Buffer
+	commandTemplate.Execute(&command, map[string]any{
+		"src_folder": "/tmp/processing/src",
+		"dst_folder": "/tmp/processing/dst",
+		"name":       "file",
+		"extension":  "jpg",
+		"quality":    80,
+	})
+	return command.String()
+}
+
+// commandTools returns the tools a shell command runs, the first word of every simple command it consists
+// of. Variable assignments and shell builtins are skipped.
+func commandTools(command string) []string {
+	var tools []string
+	for _, simple := range commandSeparators.Split(command, -1) {
+		for _, word := range strings.Fields(simple) {
+			if strings.Contains(word, "=") && !strings.HasPrefix(word, "=") {
+				continue
+			}
+			word = strings.Trim(word, `"'`)
+			if !slices.Contains(shellBuiltins, word) && !slices.Contains(tools, word) && !strings.ContainsAny(word, "<>$`") {
+				tools = append(tools, word)
+			}
+			break
+		}
+	}
+	return tools
+}
+
+// checkTool reports whether a tool is installed and the first line it prints for --version
+func (v *validation) checkTool(tool, configDir string, versions map[string]string) {
+	if version, ok := versions[tool]; ok {
+		v.okf("%s %s", tool, version)
+		return
+	}
+
+	path := tool
+	if strings.Contains(tool, "/") {
+		if !filepath.IsAbs(tool) {
+			path = filepath.Join(configDir, tool)
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() || info.Mode()&0o111 == 0 {
+			v.errorf("%s is not an executable file", path)
+			return
+		}
+	} else if _, err := exec.LookPath(tool); err != nil {
+		v.errorf("%s is not installed", tool)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), versionProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.Dir = configDir
+	output, err := cmd.CombinedOutput()
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	if err != nil || line == "" {
+		v.warnf("%s is installed, but %s --version failed", tool, tool)
+		versions[tool] = "(installed)"
+		return
+	}
+
+	versions[tool] = strings.TrimSpace(line)
+	v.okf("%s %s", tool, versions[tool])
+}
+
+// checkTaskNames reports tasks sharing a name, which overrides, remote workers and cached results confuse
+func (v *validation) checkTaskNames(tasks []Task) {
+	seen := make(map[string]bool)
+	for _, task := range tasks {
+		if seen[task.Name] {
+			fmt.Fprintln(v.out, "tasks")
+			v.errorf("more than one task is named %q", task.Name)
+		}
+		seen[task.Name] = true
+	}
+}
+
+// checkExtensions lists extensions several tasks claim, which are tried in order until one succeeds, and
+// warns about tasks that can never run because an earlier task without conditions always takes their files
+func (v *validation) checkExtensions(tasks []Task) {
+	claims := make(map[string][]string)
+	var extensions []string
+	for _, task := range tasks {
+		for _, extension := range task.Extensions {
+			if _, ok := claims[extension]; !ok {
+				extensions = append(extensions, extension)
+			}
+			if !slices.Contains(claims[extension], task.Name) {
+				claims[extension] = append(claims[extension], task.Name)
+			}
+		}
+	}
+
+	header := false
+	for _, extension := range extensions {
+		if names := claims[extension]; len(names) > 1 {
+			if !header {
+				fmt.Fprintln(v.out, "extensions")
+				header = true
+			}
+			v.okf(".%s is tried with %s in this order", extension, strings.Join(names, ", "))
+		}
+	}
+
+	for i, task := range tasks {
+		for _, earlier := range tasks[:i] {
+			if earlier.Command == "" && len(earlier.Args) == 0 && len(earlier.Steps) == 0 && earlier.unconditional() && covers(earlier.Extensions, task.Extensions) {
+				fmt.Fprintln(v.out, "extensions")
+				v.warnf("task %s never runs, the empty command of task %s comes first for all of its extensions", task.Name, earlier.Name)
+				break
+			}
+		}
+	}
+}
+
+// unconditional reports whether the task takes every file with one of its extensions
+func (task *Task) unconditional() bool {
+	return len(task.MimeTypes) == 0 && len(task.Codecs) == 0 && len(task.ExcludeCodecs) == 0 && len(task.Sources) == 0 && task.minSize == 0 &&
+		task.maxSize == 0 && !task.needsDimensions() && task.window == nil
+}
+
+// covers reports whether every extension of b is one of a
+func covers(a, b []string) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, extension := range b {
+		if !slices.Contains(a, extension) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replacementsBucket is the store bucket holding the assets uploaded in place of their original
+	replacementsBucket = "replacements"
+	// verifyWindow is how long replaced assets remain candidates for verification
+	verifyWindow = 7 * 24 * time.Hour
+)
+
+// ReplacementRecord describes an asset Immich received in optimized form
+type ReplacementRecord struct {
+	AssetID          string    `json:"asset_id"`
+	Filename         string    `json:"filename"`
+	UploadedFilename string    `json:"uploaded_filename"`
+	Checksum         string    `json:"checksum"`
+	Size             int64     `json:"size"`
+	UploadedAt       time.Time `json:"uploaded_at"`
+}
+
+// VerificationResult is the outcome of checking a single asset
+type VerificationResult struct {
+	AssetID  string `json:"asset_id"`
+	Filename string `json:"filename"`
+	OK       bool   `json:"ok"`
+	Decoder  string `json:"decoder"`
+	Error    string `json:"error,omitempty"`
+}
+
+// VerificationReport summarizes one verification run
+type VerificationReport struct {
+	StartedAt  time.Time            `json:"started_at"`
+	Candidates int                  `json:"candidates"`
+	Checked    int                  `json:"checked"`
+	Failed     int                  `json:"failed"`
+	Results    []VerificationResult `json:"results"`
+}
+
+// Verifier periodically downloads a random sample of recently replaced assets back from Immich and checks
+// that they still match the uploaded checksum and decode, guarding against encoder or upload corruption.
+// A nil *Verifier records and verifies nothing.
+type Verifier struct {
+	client   *ImmichClient
+	store    Store
+	logger   *customLogger
+	interval time.Duration
+	sample   int
+	stop     chan struct{}
+
+	mu      sync.Mutex
+	last    *VerificationReport
+	stopped bool
+	running sync.Mutex
+}
+
+func NewVerifier(client *ImmichClient, store Store, interval time.Duration, sample int, logger *customLogger) *Verifier {
+	return &Verifier{
+		client:   client,
+		store:    store,
+		logger:   logger,
+		interval: interval,
+		sample:   sample,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start verifies a sample every interval in the background
+func (v *Verifier) Start() {
+	go func() {
+		ticker := time.NewTicker(v.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				v.Run()
+			case <-v.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends background verification
+func (v *Verifier) Stop() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.stopped {
+		close(v.stop)
+		v.stopped = true
+	}
+}
+
+// RecordReplacement remembers an asset uploaded in optimized form so it can be sampled later
+func (v *Verifier) RecordReplacement(originalFilePath string, asset AssetUploadResult) {
+	if v == nil || asset.ID == "" {
+		return
+	}
+
+	record := ReplacementRecord{
+		AssetID:          asset.ID,
+		Filename:         filepath.Base(originalFilePath),
+		UploadedFilename: asset.Filename,
+		Checksum:         asset.Checksum,
+		Size:             asset.Size,
+		UploadedAt:       time.Now(),
+	}
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = v.store.Put(replacementsBucket, asset.ID, data)
+	}
+	if err != nil {
+		v.logger.Errorf("Error recording replaced asset %s: %v", asset.ID, err)
+	}
+}
+
+// LastReport returns the report of the most recent run, or nil if none completed yet
+func (v *Verifier) LastReport() *VerificationReport {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.last
+}
+
+// Run verifies a random sample of the assets replaced within the verification window, forgetting older ones
+func (v *Verifier) Run() VerificationReport {
+	v.running.Lock()
+	defer v.running.Unlock()
+
+	report := VerificationReport{StartedAt: time.Now()}
+
+	candidates, err := v.candidates()
+	if err != nil {
+		v.logger.Errorf("Error listing replaced assets: %v", err)
+		return report
+	}
+	report.Candidates = len(candidates)
+
+	for _, i := range rand.Perm(len(candidates))[:min(v.sample, len(candidates))] {
+		result := v.verify(candidates[i])
+		report.Checked++
+		if !result.OK {
+			report.Failed++
+			v.logger.Errorf("!!! ALERT: verification of asset %s (%s) failed: %s", result.AssetID, result.Filename, result.Error)
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	if report.Checked > 0 {
+		v.logger.Printf("Verified %d of %d recently replaced assets, %d failed", report.Checked, report.Candidates, report.Failed)
+	}
+
+	v.mu.Lock()
+	v.last = &report
+	v.mu.Unlock()
+
+	return report
+}
+
+// candidates returns the replaced assets still within the verification window, oldest first
+func (v *Verifier) candidates() ([]ReplacementRecord, error) {
+	documents, err := v.store.List(replacementsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ReplacementRecord
+	for key, data := range documents {
+		var record ReplacementRecord
+		if err := json.Unmarshal(data, &record); err != nil || time.Since(record.UploadedAt) > verifyWindow {
+			if err := v.store.Delete(replacementsBucket, key); err != nil {
+				v.logger.Errorf("Error forgetting replaced asset %s: %v", key, err)
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UploadedAt.Before(records[j].UploadedAt)
+	})
+	return records, nil
+}
+
+// verify downloads an asset and checks its checksum, size and that it decodes
+func (v *Verifier) verify(record ReplacementRecord) VerificationResult {
+	result := VerificationResult{AssetID: record.AssetID, Filename: record.Filename}
+
+	fail := func(err error) VerificationResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	file, err := os.CreateTemp("", "verify-*"+filepath.Ext(record.UploadedFilename))
+	if err != nil {
+		return fail(fmt.Errorf("unable to create temp file: %w", err))
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha1.New()
+	if err := v.client.DownloadOriginal(record.AssetID, io.MultiWriter(file, hash)); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		return fail(fmt.Errorf("unable to write temp file: %w", err))
+	}
+
+	if info, err := os.Stat(file.Name()); err == nil && record.Size > 0 && info.Size() != record.Size {
+		return fail(fmt.Errorf("size mismatch: uploaded %d bytes, stored %d bytes", record.Size, info.Size()))
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); record.Checksum != "" && checksum != record.Checksum {
+		return fail(fmt.Errorf("checksum mismatch: uploaded %s, stored %s", record.Checksum, checksum))
+	}
+
+	result.Decoder, err = decodeCheck(file.Name())
+	if err != nil {
+		return fail(err)
+	}
+
+	result.OK = true
+	return result
+}
+
+// decodeCheck makes sure a file decodes, fully with the standard library for JPEG, PNG and GIF and with
+// ffprobe for everything else. It returns the decoder used, or "none" when no decoder is available.
+func decodeCheck(filePath string) (string, error) {
+	mimeType, err := sniffMimeType(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		file, err := os.Open(filePath)
+		if err != nil {
+			return "", fmt.Errorf("unable to open file: %w", err)
+		}
+		defer file.Close()
+
+		if _, _, err := image.Decode(file); err != nil {
+			return "image", fmt.Errorf("%s does not decode: %w", mimeType, err)
+		}
+		return "image", nil
+	}
+
+	output, err := exec.Command("ffprobe", "-v", "error", filePath).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "none", nil
+	}
+	if err != nil {
+		return "ffprobe", fmt.Errorf("%s does not decode: %w: %s", mimeType, err, strings.TrimSpace(string(output)))
+	}
+	if len(output) > 0 {
+		return "ffprobe", fmt.Errorf("%s does not decode: %s", mimeType, strings.TrimSpace(string(output)))
+	}
+	return "ffprobe", nil
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
@@ -16,39 +17,64 @@ const (
 
 // FileWatcher monitors directory changes using inotify and processes files
 type FileWatcher struct {
-	fd           int            // inotify file descriptor
-	watchDir     string         // root directory to watch
-	immichClient *ImmichClient  // client for uploading to Immich
-	config       *Config        // processing configuration
-	logger       *log.Logger    // logger instance
-	watchMap     map[string]int // maps directory paths to watch descriptors
-	bufferSize   int            // buffer size for reading inotify events
-	appConfig    *AppConfig     // application configuration
+	fd           int                      // inotify file descriptor
+	watchDir     string                   // root directory to watch
+	immichClient *ImmichClient            // client for uploading to Immich
+	tasks        *ConfigReloader          // processing configuration
+	logger       *customLogger            // logger instance
+	watchMap     map[string]int           // maps directory paths to watch descriptors
+	bufferSize   int                      // buffer size for reading inotify events
+	appConfig    *AppConfig               // application configuration
+	ctx          context.Context          // cancelled when the watcher stops, aborting running tasks
+	cancel       context.CancelFunc       // cancels ctx
+	inflight     sync.WaitGroup           // files currently being processed
+	deferredMu   sync.Mutex               // guards deferred
+	deferred     map[string]*deferredFile // files waiting for the active hours of their tasks or a retry
+	queue        *FileQueue               // files waiting to be processed, by priority
+	contentMu    sync.Mutex               // guards contents
+	contents     map[string]*contentClaim // content of the files being processed, see claimContent
+	rawPairs     *RawPairRegistry         // uploaded halves of RAW and JPEG pairs, see RawPairs
+	stopOnce     sync.Once                // makes Stop run once, whichever of the shutdown paths calls it first
 }
 
 // NewFileWatcher creates a new file watcher instance
-func NewFileWatcher(watchDir string, immichClient *ImmichClient, config *Config, logger *log.Logger, bufferSize int) (*FileWatcher, error) {
+func NewFileWatcher(watchDir string, immichClient *ImmichClient, tasks *ConfigReloader, logger *customLogger, bufferSize int) (*FileWatcher, error) {
 	fd, err := unix.InotifyInit()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create inotify instance: %w", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	fw := &FileWatcher{
+		ctx:          ctx,
+		cancel:       cancel,
 		fd:           fd,
 		watchDir:     watchDir,
 		immichClient: immichClient,
-		config:       config,
+		tasks:        tasks,
 		logger:       logger,
 		watchMap:     make(map[string]int),
+		deferred:     make(map[string]*deferredFile),
+		queue:        NewFileQueue(),
+		contents:     make(map[string]*contentClaim),
+		rawPairs:     NewRawPairRegistry(),
 		bufferSize:   bufferSize,
 	}
 
 	return fw, nil
 }
 
+// config returns the processing configuration in use, which changes when the tasks file is reloaded
+func (fw *FileWatcher) config() *Config {
+	return fw.tasks.Config()
+}
+
 // Start begins monitoring the directory for file changes
 func (fw *FileWatcher) Start(config *AppConfig) error {
 	fw.appConfig = config
+	fw.queue.SetLimit(config.MaxQueue)
+	fw.queue.SetSourceLimit(config.MaxJobsPerSource)
 	fw.logger.Printf("Starting recursive file watcher on directory: %s", fw.watchDir)
 
 	// Add watches recursively
@@ -57,7 +83,12 @@ func (fw *FileWatcher) Start(config *AppConfig) error {
 		return fmt.Errorf("failed to add recursive watches: %w", err)
 	}
 
-	// Process existing files in all directories
+	for range max(config.Workers, 1) {
+		go fw.runQueue()
+	}
+
+	// Resume the files left queued by the last shutdown, then process existing files in all directories
+	fw.resumePending()
 	fw.processExistingFilesRecursive(fw.watchDir)
 
 	// Start watching for new files
@@ -66,12 +97,20 @@ func (fw *FileWatcher) Start(config *AppConfig) error {
 	return nil
 }
 
-// Stop closes the file watcher and cleans up resources
+// Stop closes the file watcher, aborts running tasks and waits for them to clean up. Later calls do nothing,
+// so they neither overwrite the saved pending files nor close the inotify descriptor again.
 func (fw *FileWatcher) Stop() {
-	for _, wd := range fw.watchMap {
-		unix.InotifyRmWatch(fw.fd, uint32(wd))
-	}
-	unix.Close(fw.fd)
+	fw.stopOnce.Do(func() {
+		pending := fw.queue.Pending()
+		fw.cancel()
+		deferred := fw.stopDeferred()
+		fw.inflight.Wait()
+		fw.savePending(pending, deferred)
+		for _, wd := range fw.watchMap {
+			unix.InotifyRmWatch(fw.fd, uint32(wd))
+		}
+		unix.Close(fw.fd)
+	})
 }
 
 // addWatchRecursive adds inotify watches to all directories recursively
@@ -95,6 +134,12 @@ func (fw *FileWatcher) addDirectoryWatch(path string) error {
 	if err != nil {
 		return fmt.Errorf("failed to add watch for %s: %w", path, err)
 	}
+	// A directory renamed within the watch directory keeps its watch descriptor, drop its old path
+	for dir, watchDescriptor := range fw.watchMap {
+		if watchDescriptor == wd && dir != path {
+			delete(fw.watchMap, dir)
+		}
+	}
 	fw.watchMap[path] = wd
 	fw.logger.Printf("Added watch for directory: %s", path)
 	return nil
@@ -104,12 +149,12 @@ func (fw *FileWatcher) addDirectoryWatch(path string) error {
 func (fw *FileWatcher) processExistingFilesRecursive(dir string) {
 	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
-			fw.logger.Printf("Error walking directory %s: %v", path, err)
+			fw.logger.Errorf("Error walking directory %s: %v", path, err)
 			return nil
 		}
 
 		if !d.IsDir() {
-			fw.processFile(path)
+			fw.enqueue(path)
 		}
 
 		return nil
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// deadLetter returns where files failing processing repeatedly are moved, or nil if failed files are not retried
+func (fw *FileWatcher) deadLetter() *DeadLetter {
+	if fw.appConfig == nil {
+		return nil
+	}
+	return fw.appConfig.DeadLetter
+}
+
+// retryOrDeadLetter processes a failed file again after a backoff, or once it failed too many times moves
+// it to the dead-letter folder, forwarding the original unmodified first if configured
+func (fw *FileWatcher) retryOrDeadLetter(filePath string, hashes FileHashes, err error) {
+	dl := fw.deadLetter()
+	attempts, exhausted := dl.Fail(filePath)
+	if !exhausted {
+		fw.deferFile(filePath, time.Now().Add(dl.Backoff(attempts)), fmt.Sprintf("retrying after %d of %d failed attempts", attempts, dl.maxAttempts))
+		return
+	}
+
+	record := DeadLetterRecord{
+		Attempts:       attempts,
+		Error:          err.Error(),
+		DeadLetteredAt: time.Now(),
+	}
+
+	if dl.forward {
+		fw.logger.Printf("Forwarding original file %s unmodified after %d failed attempts", filePath, attempts)
+		asset, ok := fw.uploadToImmich(filePath, filePath)
+		if !ok {
+			// The upload error was handled, the file stays in place and is retried on the next start
+			return
+		}
+		fw.recordUpload(hashes, filePath, asset)
+		record.Forwarded = true
+		record.AssetID = asset.ID
+	}
+
+	if moveErr := dl.Move(filePath, fw.watchDir, record); moveErr != nil {
+		fw.logger.Errorf("Error moving file %s to the dead-letter directory: %v", filePath, moveErr)
+		return
+	}
+	fw.logger.Errorf("Moved file %s to the dead-letter directory after %d failed attempts", filePath, attempts)
+	if !dl.forward {
+		fw.jobs().SetResult(filePath, fmt.Sprintf("moved to the dead-letter directory after %d failed attempts", attempts))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+// hashDB returns the shared database of uploaded hashes, or nil if deduplication is disabled
+func (fw *FileWatcher) hashDB() *HashDB {
+	if fw.appConfig == nil {
+		return nil
+	}
+	return fw.appConfig.HashDB
+}
+
+// jobs returns the registry the progress of every file is reported to, or nil if there is none
+func (fw *FileWatcher) jobs() *JobRegistry {
+	if fw.appConfig == nil {
+		return nil
+	}
+	return fw.appConfig.Jobs
+}
+
+// sessions returns the upload sessions queued files are grouped into, or nil if there are none
+func (fw *FileWatcher) sessions() *Sessions {
+	if fw.appConfig == nil {
+		return nil
+	}
+	return fw.appConfig.Sessions
+}
+
+// lookupUploadedHash hashes the file with every configured algorithm and reports whether its content
+// was already uploaded
+func (fw *FileWatcher) lookupUploadedHash(filePath string) (FileHashes, bool) {
+	db := fw.hashDB()
+	if db == nil {
+		return nil, false
+	}
+
+	hashes, err := hashFile(filePath, fw.appConfig.HashAlgorithms)
+	if err != nil {
+		fw.logger.Errorf("Error hashing file %s: %v", filePath, err)
+		return nil, false
+	}
+
+	record, ok, err := db.Lookup(hashes.SHA1())
+	if err != nil {
+		fw.logger.Errorf("Error looking up hash of %s: %v", filePath, err)
+		return hashes, false
+	}
+	if ok {
+		fw.logger.Printf("Skipping file %s (already uploaded as %s on %s)", filePath, record.Filename, record.UploadedAt.Format(time.RFC3339))
+		return hashes, true
+	}
+
+	return hashes, false
+}
+
+// contentSum returns the XXH64 of a file for the result cache, hashing it unless it was already hashed
+// with it for deduplication
+func (fw *FileWatcher) contentSum(filePath string, hashes FileHashes) string {
+	if sum := hashes.XXH64(); sum != "" {
+		return sum
+	}
+
+	hashes, err := hashFile(filePath, []string{hashXXH64})
+	if err != nil {
+		fw.logger.Errorf("Error hashing file %s: %v", filePath, err)
+		return ""
+	}
+	return hashes.XXH64()
+}
+
+// withContentSum returns the hashes of a file with its XXH64 added when no SHA-1 identifies its content,
+// i.e. without a hash database, so identical files are still told apart cheaply
+func (fw *FileWatcher) withContentSum(filePath string, hashes FileHashes) FileHashes {
+	if hashes.SHA1() != "" || hashes.XXH64() != "" {
+		return hashes
+	}
+	sum := fw.contentSum(filePath, hashes)
+	if sum == "" {
+		return hashes
+	}
+	with := FileHashes{hashXXH64: sum}
+	for algorithm, digest := range hashes {
+		with[algorithm] = digest
+	}
+	return with
+}
+
+// contentKey identifies the content of a file among the files being processed, by its SHA-1 when it was
+// computed, by its XXH64 otherwise
+func contentKey(hashes FileHashes) string {
+	if sum := hashes.SHA1(); sum != "" {
+		return hashSHA1 + ":" + sum
+	}
+	if sum := hashes.XXH64(); sum != "" {
+		return hashXXH64 + ":" + sum
+	}
+	return ""
+}
+
+// contentClaim is held by the file whose content is being processed, files with the same content wait
+// for done and then read how it ended
+type contentClaim struct {
+	done     chan struct{}
+	uploaded string // name of the file that reached Immich with the content, empty if none did
+}
+
+// claimContent makes sure files with identical content are optimized once, so a file copied again into the
+// watch directory while its first copy is processed, e.g. by a sync app retrying, joins that job. While
+// another file with the same content is processed it waits for it, then reports whether that file reached
+// Immich so this one can be skipped. Otherwise it returns the function to call once the file is done.
+func (fw *FileWatcher) claimContent(ctx context.Context, filePath string, hashes FileHashes) (release func(), uploaded bool) {
+	key := contentKey(hashes)
+	if key == "" {
+		return func() {}, false
+	}
+
+	for {
+		fw.contentMu.Lock()
+		claim, busy := fw.contents[key]
+		if !busy {
+			claim = &contentClaim{done: make(chan struct{})}
+			fw.contents[key] = claim
+			fw.contentMu.Unlock()
+
+			return func() {
+				fw.contentMu.Lock()
+				delete(fw.contents, key)
+				fw.contentMu.Unlock()
+				close(claim.done)
+			}, false
+		}
+		fw.contentMu.Unlock()
+
+		fw.logger.Printf("Waiting for a file with the same content as %s to finish", filePath)
+		select {
+		case <-claim.done:
+		case <-ctx.Done():
+			return func() {}, false
+		}
+
+		if claim.uploaded != "" {
+			fw.logger.Printf("Skipping file %s (identical to %s, uploaded meanwhile)", filePath, claim.uploaded)
+			return func() {}, true
+		}
+		// Another instance sharing the store may have uploaded it
+		if db := fw.hashDB(); db != nil && hashes.SHA1() != "" {
+			if record, ok, err := db.Lookup(hashes.SHA1()); err == nil && ok {
+				fw.logger.Printf("Skipping file %s (identical to %s, uploaded meanwhile)", filePath, record.Filename)
+				return func() {}, true
+			}
+		}
+	}
+}
+
+// recordUploadedContent tells the files waiting for the claim on the content of a file that it reached Immich
+func (fw *FileWatcher) recordUploadedContent(hashes FileHashes, filePath string) {
+	key := contentKey(hashes)
+	if key == "" {
+		return
+	}
+
+	fw.contentMu.Lock()
+	defer fw.contentMu.Unlock()
+	if claim, ok := fw.contents[key]; ok {
+		claim.uploaded = filepath.Base(filePath)
+	}
+}
+
+// recordUploadedHash stores the hashes of an original whose content reached Immich,
+// mapped to the hashes of the file that was actually uploaded
+func (fw *FileWatcher) recordUploadedHash(hashes FileHashes, filePath string, asset AssetUploadResult) {
+	db := fw.hashDB()
+	if db == nil || hashes.SHA1() == "" {
+		return
+	}
+
+	record := HashRecord{
+		Filename:         filepath.Base(filePath),
+		UploadedAt:       time.Now(),
+		AssetID:          asset.ID,
+		UploadedChecksum: asset.Hashes.SHA1(),
+		Hashes:           hashes,
+		UploadedHashes:   asset.Hashes,
+	}
+	if err := db.Add(hashes.SHA1(), record); err != nil {
+		fw.logger.Errorf("Error recording hash for %s: %v", filePath, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWatcher() *FileWatcher {
+	return &FileWatcher{
+		ctx:      context.Background(),
+		logger:   newCustomLogger(log.New(io.Discard, "", 0), ""),
+		contents: make(map[string]*contentClaim),
+	}
+}
+
+func TestClaimContentWithoutHashDB(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "phone", "IMG_0001.jpg"), filepath.Join(dir, "resync", "IMG_0001.jpg")
+	for _, path := range []string{first, second} {
+		writeTestFile(t, path, "same content")
+	}
+
+	fw := newTestWatcher()
+	firstHashes := fw.withContentSum(first, nil)
+	secondHashes := fw.withContentSum(second, nil)
+	if firstHashes.XXH64() == "" || contentKey(firstHashes) != contentKey(secondHashes) {
+		t.Fatalf("got %v and %v, want the same XXH64", firstHashes, secondHashes)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		uploaded bool
+	}{
+		{"first copy uploaded", true},
+		{"first copy failed", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			release, uploaded := fw.claimContent(context.Background(), first, firstHashes)
+			if uploaded {
+				t.Fatal("the first copy was reported uploaded")
+			}
+
+			result := make(chan bool)
+			go func() {
+				release, uploaded := fw.claimContent(context.Background(), second, secondHashes)
+				release()
+				result <- uploaded
+			}()
+
+			select {
+			case <-result:
+				t.Fatal("the second copy did not wait for the first")
+			case <-time.After(50 * time.Millisecond):
+			}
+			if tt.uploaded {
+				fw.recordUploadedContent(firstHashes, first)
+			}
+			release()
+
+			select {
+			case uploaded := <-result:
+				if uploaded != tt.uploaded {
+					t.Errorf("second copy: got uploaded %v, want %v", uploaded, tt.uploaded)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the second copy kept waiting")
+			}
+		})
+	}
+}
+
+func TestClaimContentUnknownContent(t *testing.T) {
+	fw := newTestWatcher()
+	path := filepath.Join(t.TempDir(), "missing.jpg")
+	hashes := fw.withContentSum(path, nil)
+	if _, err := os.Stat(path); err == nil || contentKey(hashes) != "" {
+		t.Fatalf("got key %q for a missing file", contentKey(hashes))
+	}
+	release, uploaded := fw.claimContent(context.Background(), path, hashes)
+	release()
+	if uploaded {
+		t.Errorf("a file without hashes was reported uploaded")
+	}
+}
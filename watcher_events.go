@@ -16,7 +16,7 @@ func (fw *FileWatcher) watchLoop() {
 	for {
 		n, err := unix.Read(fw.fd, buf)
 		if err != nil {
-			fw.logger.Printf("Error reading inotify events: %v", err)
+			fw.logger.Errorf("Error reading inotify events: %v", err)
 			return
 		}
 
@@ -56,18 +56,33 @@ func (fw *FileWatcher) handleInotifyEvent(event *unix.InotifyEvent, name, watche
 	}
 
 	filePath := filepath.Join(watchedDir, name)
+	fw.logger.Debugf("inotify event %#x for %s", event.Mask, filePath)
 
 	if event.Mask&unix.IN_CREATE != 0 {
 		fw.handleDirectoryCreation(filePath)
 	}
 
+	if event.Mask&unix.IN_MOVED_TO != 0 && event.Mask&unix.IN_ISDIR != 0 {
+		fw.handleDirectoryMove(filePath)
+		return
+	}
+
 	if event.Mask&unix.IN_CLOSE_WRITE != 0 || event.Mask&unix.IN_MOVED_TO != 0 {
 		if watchedDir != "" {
-			fw.processFile(filePath)
+			fw.enqueue(filePath)
 		}
 	}
 }
 
+// handleDirectoryMove watches a directory moved into the watch directory and processes the files it
+// already contains, which were complete when it was moved
+func (fw *FileWatcher) handleDirectoryMove(path string) {
+	if err := fw.addWatchRecursive(path); err != nil {
+		fw.logger.Errorf("Error watching moved directory %s: %v", path, err)
+	}
+	fw.processExistingFilesRecursive(path)
+}
+
 // handleDirectoryCreation handles the creation of new directories
 func (fw *FileWatcher) handleDirectoryCreation(path string) {
 	if info, err := os.Stat(path); err == nil && info.IsDir() {
@@ -1,37 +1,290 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// skipMarkerFile opts every file in its folder and subfolders out of optimization
+const skipMarkerFile = ".immich-optimizer-skip"
+
+// partialPrefix marks files and folders the optimizer is still writing into the watch directory,
+// such as imports and removable media ingests, which are renamed once complete
+const partialPrefix = ".iuo-partial-"
+
+// enqueue queues a file for processing with the priority of the first matching rule
+func (fw *FileWatcher) enqueue(originalFilePath string) {
+	if fw.ctx.Err() != nil {
+		return
+	}
+
+	if !fw.validateFile(originalFilePath) {
+		return
+	}
+
+	if filepath.Base(originalFilePath) == skipMarkerFile || isPartialPath(originalFilePath, fw.watchDir) {
+		return
+	}
+
+	if isSidecarFile(originalFilePath) {
+		fw.logger.Printf("Sidecar %s will be uploaded together with its asset", originalFilePath)
+		return
+	}
+
+	if fw.isDeferred(originalFilePath) {
+		fw.logger.Debugf("Leaving %s in the watch directory until it is due", originalFilePath)
+		return
+	}
+
+	priority := 0
+	if len(fw.config().Priorities) > 0 {
+		if media, err := DetectMedia(originalFilePath, false); err == nil {
+			priority = fw.config().priorityFor(media)
+		}
+	}
+
+	source := sourceFolder(originalFilePath, fw.watchDir)
+	added, err := fw.queue.Push(originalFilePath, source, priority)
+	if errors.Is(err, ErrQueueFull) {
+		fw.logger.Debugf("Leaving %s in the watch directory, the queue is full", originalFilePath)
+		return
+	}
+	if added {
+		fw.jobs().Start(fw.ctx, originalFilePath)
+		session := fw.sessions().Join(source, originalFilePath)
+		fw.jobs().Update(originalFilePath, func(job *Job) {
+			job.Source = source
+			job.Session = session
+		})
+		waiting := fw.queue.Len()
+		fw.logger.Debugf("Queued %s with priority %d, %d files waiting", originalFilePath, priority, waiting)
+		if waiting == fw.queue.Limit() {
+			fw.logger.Printf("The queue is full with %d files, further files wait in the watch directory until it drains", waiting)
+		}
+	}
+}
+
+// runQueue is a worker processing queued files one at a time, highest priority first, until the watcher
+// stops. Start runs one per -workers.
+func (fw *FileWatcher) runQueue() {
+	for {
+		filePath, ok := fw.queue.Pop(fw.ctx)
+		if !ok {
+			return
+		}
+
+		fw.processFile(filePath)
+
+		if fw.queue.Done(filePath) {
+			fw.enqueue(filePath)
+		}
+		// Only the files turned away are queued again, the others left in the watch directory were handled
+		if turnedAway := fw.queue.Drained(); len(turnedAway) > 0 {
+			fw.logger.Printf("The queue has room again, queueing the %d files left waiting", len(turnedAway))
+			for _, path := range turnedAway {
+				fw.enqueue(path)
+			}
+		}
+	}
+}
+
 // processFile handles the complete file processing workflow
 func (fw *FileWatcher) processFile(originalFilePath string) {
+	defer fw.jobs().Finish(originalFilePath)
+
+	if fw.ctx.Err() != nil {
+		return
+	}
+	fw.inflight.Add(1)
+	defer fw.inflight.Done()
+
 	if !fw.validateFile(originalFilePath) {
 		return
 	}
 
 	fw.logger.Printf("Processing file: %s", originalFilePath)
+	ctx := fw.jobs().Context(fw.ctx, originalFilePath)
+
+	hashes, uploaded := fw.lookupUploadedHash(originalFilePath)
+	if uploaded {
+		fw.jobs().SetResult(originalFilePath, "skipped, already uploaded")
+		return
+	}
 
-	if !fw.shouldOptimizeFile(originalFilePath) {
-		fw.uploadToImmich(originalFilePath)
+	hashes = fw.withContentSum(originalFilePath, hashes)
+	release, uploaded := fw.claimContent(ctx, originalFilePath, hashes)
+	defer release()
+	if uploaded {
+		fw.jobs().SetResult(originalFilePath, "skipped, identical file uploaded meanwhile")
+		return
+	}
+
+	if cancelled, forward := fw.jobs().Cancelled(originalFilePath); cancelled {
+		fw.handleCancelledJob(originalFilePath, hashes, forward)
+		return
+	}
+
+	if fw.inMaintenance() {
+		fw.logger.Printf("Maintenance mode enabled, uploading %s without optimization", originalFilePath)
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	if hasSkipMarker(originalFilePath, fw.watchDir) {
+		fw.logger.Printf("Uploading %s without optimization (opted out by %s)", originalFilePath, skipMarkerFile)
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	if jpegPath := fw.rawPairJPEG(originalFilePath); jpegPath != "" {
+		fw.logger.Printf("Uploading %s without optimization (RAW file of %s)", originalFilePath, filepath.Base(jpegPath))
+		fw.jobs().SetResult(originalFilePath, "skipped, RAW file of a JPEG")
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	media, err := DetectMedia(originalFilePath, needsCodec(fw.config().Tasks) || fw.config().SkipEfficient.Enabled)
+	if err != nil {
+		fw.logger.Errorf("Error detecting type of %s: %v", originalFilePath, err)
+	}
+	media.Source = sourceFolder(originalFilePath, fw.watchDir)
+	if needsDimensions(fw.config().Tasks) {
+		if media, err = probeMediaDimensions(originalFilePath, media); err != nil {
+			fw.logger.Errorf("Error probing dimensions of %s: %v", originalFilePath, err)
+		}
+	}
+	if needsColor(fw.config().Tasks) {
+		if media, err = probeMediaColor(originalFilePath, media); err != nil {
+			fw.logger.Errorf("Error probing color of %s: %v", originalFilePath, err)
+		}
+	}
+
+	if fw.config().belowMinSize(media) {
+		fw.logger.Printf("Uploading %s without optimization (%s is below min_size)", originalFilePath, humanReadableSize(media.Size))
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	if fw.config().failsConditions(media) {
+		if media.Color != "" && media.Color != ColorSDR {
+			fw.logger.Printf("Uploading %s without optimization (it meets the conditions of no task, its color is %s)", originalFilePath, media.Color)
+		} else {
+			fw.logger.Printf("Uploading %s without optimization (it meets the conditions of no task)", originalFilePath)
+		}
+		fw.jobs().SetResult(originalFilePath, "meets the conditions of no task")
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	if !fw.shouldOptimizeFile(originalFilePath, media) {
+		fw.handleUnmatchedFile(originalFilePath, hashes)
+		return
+	}
+
+	if reason, ok := fw.config().SkipEfficient.Efficient(originalFilePath, media); ok {
+		fw.logger.Printf("Uploading %s without optimization (already efficient, %s)", originalFilePath, reason)
+		fw.jobs().SetResult(originalFilePath, "skipped, already efficient")
+		if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			fw.recordUpload(hashes, originalFilePath, asset)
+		}
+		return
+	}
+
+	if fw.config().LivePhotos == LivePhotosPassthrough {
+		if id, err := livePhotoID(ctx, originalFilePath, media); err != nil {
+			fw.logger.Errorf("Error reading the ContentIdentifier of %s: %v", originalFilePath, err)
+		} else if id != "" {
+			fw.logger.Printf("Uploading %s without optimization (part of Live Photo %s)", originalFilePath, id)
+			fw.jobs().SetResult(originalFilePath, "skipped, part of a Live Photo")
+			if asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+				fw.recordUpload(hashes, originalFilePath, asset)
+			}
+			return
+		}
+	}
+
+	tasks, next := scheduledTasks(fw.config().Tasks, media, fw.config().activeWindow(media), time.Now())
+	if !next.IsZero() {
+		fw.deferFile(originalFilePath, next, "no matching task is within its active hours")
 		return
 	}
 
 	tp, err := fw.createTaskProcessor(originalFilePath)
 	if err != nil {
-		fw.logger.Printf("Error creating task processor for %s: %v", originalFilePath, err)
+		fw.logger.Errorf("Error creating task processor for %s: %v", originalFilePath, err)
+		fw.jobs().SetError(originalFilePath, err)
 		return
 	}
 	defer tp.Close()
+	tp.SetMedia(media)
+	tp.SetLimits(fw.config().Limits)
+	tp.SetPools(fw.config().pools)
+	tp.SetTimeout(fw.config().timeout)
+	tp.SetResources(fw.config().Resources)
+	tp.SetBuiltin(fw.config().Builtin)
+	tp.SetOutputValidation(fw.config().ValidateOutput)
+	tp.SetLivePhotos(fw.config().LivePhotos)
+	if fw.appConfig != nil && fw.appConfig.ResultCache != nil {
+		tp.SetResultCache(fw.appConfig.ResultCache, fw.contentSum(originalFilePath, hashes))
+	}
 
-	if err := tp.Process(fw.config.Tasks); err != nil {
-		fw.handleProcessingError(originalFilePath, err)
+	fw.jobs().SetState(originalFilePath, JobProcessing)
+	err = tp.Process(ctx, tasks)
+	fw.jobs().Update(originalFilePath, func(job *Job) {
+		if tp.ProcessedTask != nil {
+			job.Task = tp.ProcessedTask.Name
+			job.OptimizedSize = tp.ProcessedSize
+		}
+	})
+	if err != nil {
+		if cancelled, forward := fw.jobs().Cancelled(originalFilePath); cancelled {
+			fw.handleCancelledJob(originalFilePath, hashes, forward)
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			fw.logger.Printf("Leaving file %s in place, processing was interrupted", originalFilePath)
+			fw.jobs().SetError(originalFilePath, err)
+			return
+		}
+		if errors.Is(err, ErrTempUnavailable) {
+			fw.handleTempUnavailable(originalFilePath, hashes, err)
+			return
+		}
+		if errors.Is(err, ErrNoMatchingTask) {
+			fw.handleUnmatchedFile(originalFilePath, hashes)
+			return
+		}
+		if errors.Is(err, ErrTempBudgetExceeded) {
+			fw.logger.Printf("%s: %v", originalFilePath, err)
+			fw.deferFile(originalFilePath, time.Now().Add(tempBudgetRetryDelay), "the temp budget is used up")
+			return
+		}
+		if errors.Is(err, ErrInsufficientTempSpace) {
+			fw.logger.Printf("%s: %v", originalFilePath, err)
+			fw.deferFile(originalFilePath, time.Now().Add(tempSpaceRetryDelay), "the temp filesystem is full")
+			return
+		}
+		fw.handleProcessingError(originalFilePath, hashes, err)
 		return
 	}
 
-	fw.handleProcessingSuccess(originalFilePath, tp)
+	if asset, ok := fw.handleProcessingSuccess(originalFilePath, tp); ok {
+		fw.recordUpload(hashes, originalFilePath, asset)
+	}
 	fw.cleanupOriginalFile(originalFilePath)
 }
 
@@ -39,22 +292,66 @@ func (fw *FileWatcher) processFile(originalFilePath string) {
 func (fw *FileWatcher) validateFile(filePath string) bool {
 	info, err := os.Stat(filePath)
 	if err != nil {
-		fw.logger.Printf("Error getting file info for %s: %v", filePath, err)
+		fw.logger.Errorf("Error getting file info for %s: %v", filePath, err)
 		return false
 	}
 	return !info.IsDir()
 }
 
+// inMaintenance reports whether optimization is bypassed at runtime
+func (fw *FileWatcher) inMaintenance() bool {
+	return fw.appConfig != nil && fw.appConfig.Maintenance.Enabled()
+}
+
 // shouldOptimizeFile determines if a file should be processed for optimization
-func (fw *FileWatcher) shouldOptimizeFile(filePath string) bool {
-	extension := filepath.Ext(filePath)
-	if !shouldProcessExtension(extension, fw.config.Tasks) {
-		fw.logger.Printf("Skipping file %s (extension %s not configured for processing)", filePath, extension)
+func (fw *FileWatcher) shouldOptimizeFile(filePath string, media MediaInfo) bool {
+	if !shouldProcessMedia(media, fw.config().Tasks) {
+		fw.logger.Printf("Skipping file %s (extension %s, type %s not configured for processing)", filePath, filepath.Ext(filePath), media.MimeType)
 		return false
 	}
 	return true
 }
 
+// handleUnmatchedFile applies the configured policy to files no task is configured for
+func (fw *FileWatcher) handleUnmatchedFile(filePath string, hashes FileHashes) {
+	fw.recordUnmatchedFile(filePath)
+
+	switch fw.config().UnmatchedExtensions {
+	case UnmatchedSkip:
+		fw.logger.Printf("Leaving file %s in place (unmatched extensions are skipped)", filePath)
+		fw.jobs().SetResult(filePath, "skipped, no matching task")
+		return
+	case UnmatchedFail:
+		fw.logger.Errorf("Error processing file %s: no task is configured for it (unmatched extensions fail)", filePath)
+		fw.jobs().SetError(filePath, ErrNoMatchingTask)
+		if err := fw.copyToUndone(filePath, MessageUnmatched, ErrNoMatchingTask); err != nil {
+			fw.logger.Errorf("Error copying file %s to undone directory: %v", filePath, err)
+		}
+		return
+	}
+
+	if asset, ok := fw.uploadToImmich(filePath, filePath); ok {
+		fw.recordUpload(hashes, filePath, asset)
+	}
+}
+
+// recordUnmatchedFile counts the unmatched file and hints when an extension keeps arriving without a task
+func (fw *FileWatcher) recordUnmatchedFile(filePath string) {
+	if fw.appConfig == nil {
+		return
+	}
+
+	var size int64
+	if info, err := os.Stat(filePath); err == nil {
+		size = info.Size()
+	}
+
+	extension := filepath.Ext(filePath)
+	if count := fw.appConfig.Stats.RecordUnmatched(extension, size); count == unmatchedHintThreshold {
+		fw.logger.Printf("Hint: %s", unmatchedHint(extensionStatsKey(extension), count))
+	}
+}
+
 // createTaskProcessor creates and configures a new task processor for the file
 func (fw *FileWatcher) createTaskProcessor(filePath string) (*TaskProcessor, error) {
 	tp, err := NewTaskProcessor(filePath)
@@ -62,63 +359,227 @@ func (fw *FileWatcher) createTaskProcessor(filePath string) (*TaskProcessor, err
 		return nil, err
 	}
 
-	jobLogger := newCustomLogger(fw.logger, fmt.Sprintf("file %s: ", filePath))
+	jobLogger := newCustomLogger(fw.logger, fmt.Sprintf("file %s: ", filePath)).Subsystem(logTasks)
 	tp.SetLogger(jobLogger)
 
 	if fw.appConfig != nil {
-		tp.SetSemaphore(fw.appConfig.Semaphore)
+		tp.SetSlots(fw.appConfig.Slots, false)
 		tp.SetConfigDir(filepath.Dir(fw.appConfig.ConfigFile))
+		tp.SetWorkDirGC(fw.appConfig.WorkDirs)
+		tp.SetTempBudget(fw.appConfig.TempBudget)
+		tp.SetRemote(fw.appConfig.RemoteWorker)
 	}
+	tp.SetProgress(func(percent float64, eta time.Duration) {
+		fw.jobs().SetProgress(filePath, percent, eta)
+	})
 
 	return tp, nil
 }
 
-// handleProcessingError handles errors that occur during file processing
-func (fw *FileWatcher) handleProcessingError(filePath string, err error) {
-	fw.logger.Printf("Error processing file %s: %v", filePath, err)
-	if copyErr := copyFileToUndone(filePath, fw.watchDir, fw.appConfig.UndoneDir); copyErr != nil {
-		fw.logger.Printf("Error copying file %s to undone directory: %v", filePath, copyErr)
+// handleProcessingError handles errors that occur during file processing according to the on_error policy
+func (fw *FileWatcher) handleProcessingError(filePath string, hashes FileHashes, err error) {
+	fw.logger.Errorf("Error processing file %s: %v", filePath, err)
+	fw.jobs().SetError(filePath, err)
+
+	if fw.config().OnError == OnErrorForwardOriginal {
+		fw.logger.Printf("Forwarding original file %s unmodified", filePath)
+		if asset, ok := fw.uploadToImmich(filePath, filePath); ok {
+			fw.recordUpload(hashes, filePath, asset)
+			fw.cleanupOriginalFile(filePath)
+		}
+		return
+	}
+
+	if fw.deadLetter() != nil {
+		fw.retryOrDeadLetter(filePath, hashes, err)
+		return
+	}
+
+	if copyErr := fw.copyToUndone(filePath, MessageProcessingFailed, err); copyErr != nil {
+		fw.logger.Errorf("Error copying file %s to undone directory: %v", filePath, copyErr)
+	}
+}
+
+// handleCancelledJob either forwards the original of a job cancelled through the admin API unmodified or
+// moves it aside to the undone directory, so it is not optimized again
+func (fw *FileWatcher) handleCancelledJob(filePath string, hashes FileHashes, forward bool) {
+	if forward {
+		fw.logger.Printf("Processing of %s was cancelled, forwarding the original file unmodified", filePath)
+		if asset, ok := fw.uploadToImmich(filePath, filePath); ok {
+			fw.recordUpload(hashes, filePath, asset)
+			fw.cleanupOriginalFile(filePath)
+		}
+		return
+	}
+
+	fw.logger.Printf("Processing of %s was cancelled, moving it to the undone directory", filePath)
+	if err := fw.copyToUndone(filePath, MessageCancelled, nil); err != nil {
+		fw.logger.Errorf("Error copying file %s to undone directory: %v", filePath, err)
+		return
+	}
+	// The sidecar goes along, it is removed with the original
+	if sidecarPath := findSidecar(filePath); sidecarPath != "" {
+		if err := copyFileToUndone(sidecarPath, fw.watchDir, fw.appConfig.UndoneDir); err != nil {
+			fw.logger.Errorf("Error copying sidecar %s to undone directory: %v", sidecarPath, err)
+			return
+		}
+	}
+	fw.jobs().SetResult(filePath, "cancelled, moved to the undone directory")
+	fw.cleanupOriginalFile(filePath)
+}
+
+// handleTempUnavailable switches to pass-through mode when the temp volume is full or read-only,
+// since every following file would fail the same way, and uploads the file that hit the error
+func (fw *FileWatcher) handleTempUnavailable(filePath string, hashes FileHashes, err error) {
+	reason := fmt.Sprintf("temp volume unavailable: %v", err)
+	fw.appConfig.Maintenance.Enable(reason)
+
+	fw.logger.Errorf("!!! ALERT: %s", reason)
+	fw.logger.Errorf("!!! ALERT: switched to pass-through mode, files are uploaded WITHOUT optimization")
+	fw.logger.Errorf("!!! ALERT: fix %s and disable maintenance mode via the admin API or restart to resume", os.TempDir())
+
+	if asset, ok := fw.uploadToImmich(filePath, filePath); ok {
+		fw.recordUpload(hashes, filePath, asset)
 	}
 }
 
-// handleProcessingSuccess handles successful file processing and determines upload strategy
-func (fw *FileWatcher) handleProcessingSuccess(originalFilePath string, tp *TaskProcessor) {
-	if fw.shouldUploadProcessedFile(tp) {
-		fw.uploadProcessedFile(originalFilePath, tp)
+// handleProcessingSuccess handles successful file processing and determines upload strategy from the policy
+// of the task that produced the file. It returns the asset Immich created and whether the upload succeeded.
+func (fw *FileWatcher) handleProcessingSuccess(originalFilePath string, tp *TaskProcessor) (AssetUploadResult, bool) {
+	policy := fw.config().policyFor(tp.ProcessedTask, tp.Media)
+	if fw.config().DryRun || tp.ProcessedTask != nil && tp.ProcessedTask.DryRun {
+		return fw.uploadDryRun(originalFilePath, tp, policy)
+	}
+	if !fw.shouldUploadProcessedFile(tp, policy) {
+		return fw.uploadOriginalFile(originalFilePath)
+	}
+
+	asset, ok := fw.uploadProcessedFile(originalFilePath, tp)
+	if !ok || asset.Duplicate() {
+		return asset, ok
+	}
+
+	var stacked []string
+	for _, output := range tp.ExtraOutputs {
+		if output.Role != OutputStack {
+			continue
+		}
+		if extra, ok := fw.uploadExtraOutput(originalFilePath, output); ok && !extra.Duplicate() {
+			stacked = append(stacked, extra.ID)
+		}
+	}
+	if policy.Stacks() {
+		if original, ok := fw.uploadToImmich(originalFilePath, originalFilePath); ok {
+			stacked = append(stacked, original.ID)
+		}
+	}
+	fw.stackBelow(originalFilePath, asset, stacked)
+	return asset, ok
+}
+
+// uploadDryRun logs how much the optimized file would have saved and whether it would have replaced the
+// original, then uploads the original as if no task had run
+func (fw *FileWatcher) uploadDryRun(originalFilePath string, tp *TaskProcessor, policy Policy) (AssetUploadResult, bool) {
+	if tp.ProcessedTask == nil || tp.ProcessedFile == nil {
+		fw.logger.Printf("Dry run on %s: no task produced an optimized file", originalFilePath)
 	} else {
-		fw.uploadOriginalFile(originalFilePath)
+		// The quality metrics are as slow as a transcode, a dry run only reports the savings
+		outcome := "kept the original"
+		if policy.Replaces(tp.OriginalSize, tp.ProcessedSize) {
+			outcome = "replaced the original"
+			if policy.QualityGated() {
+				outcome += " if it passed the quality check, which dry runs skip"
+			}
+		}
+		change := 0.0
+		if tp.OriginalSize > 0 {
+			change = float64(tp.ProcessedSize-tp.OriginalSize) / float64(tp.OriginalSize) * 100
+		}
+		fw.logger.Printf("Dry run of task %s on %s: %s -> %s (%+.1f%%), the policy would have %s",
+			tp.ProcessedTask.Name, originalFilePath, humanReadableSize(tp.OriginalSize), humanReadableSize(tp.ProcessedSize), change, outcome)
 	}
+
+	asset, ok := fw.uploadToImmich(originalFilePath, originalFilePath)
+	if ok && !asset.Duplicate() {
+		fw.jobs().SetResult(originalFilePath, "dry run, uploaded original")
+	}
+	return asset, ok
 }
 
-// shouldUploadProcessedFile determines if the processed file should be uploaded instead of original
-func (fw *FileWatcher) shouldUploadProcessedFile(tp *TaskProcessor) bool {
-	return tp.ProcessedFile != nil && tp.ProcessedSize > 0 && tp.OriginalSize > tp.ProcessedSize
+// shouldUploadProcessedFile determines if the processed file should be uploaded instead of original: it has
+// to save enough and, when the policy sets a minimum quality, look close enough to the original
+func (fw *FileWatcher) shouldUploadProcessedFile(tp *TaskProcessor, policy Policy) bool {
+	if tp.ProcessedFile == nil || !policy.Replaces(tp.OriginalSize, tp.ProcessedSize) {
+		return false
+	}
+	if !policy.QualityGated() {
+		return true
+	}
+
+	scores, ok, err := tp.MeetsQuality(fw.ctx, policy)
+	if err != nil {
+		fw.logger.Errorf("Keeping the original of %s, the quality check failed: %v", tp.OriginalFilename, err)
+		return false
+	}
+	if !ok {
+		fw.logger.Printf("Keeping the original of %s, the optimized file scores %s, below the minimum", tp.OriginalFilename, scores)
+		return false
+	}
+	fw.logger.Debugf("Optimized %s scores %s", tp.OriginalFilename, scores)
+	return true
 }
 
 // uploadProcessedFile uploads the optimized version of the file
-func (fw *FileWatcher) uploadProcessedFile(originalFilePath string, tp *TaskProcessor) {
+func (fw *FileWatcher) uploadProcessedFile(originalFilePath string, tp *TaskProcessor) (AssetUploadResult, bool) {
 	processedFilePath, err := tp.GetProcessedFilePath()
 	if err != nil {
-		fw.logger.Printf("Error getting processed file path: %v", err)
-		fw.uploadToImmich(originalFilePath)
-		return
+		fw.logger.Errorf("Error getting processed file path: %v", err)
+		return fw.uploadOriginalFile(originalFilePath)
 	}
 
 	fw.logger.Printf("Optimized file uploaded: %s -> %s",
 		humanReadableSize(tp.OriginalSize),
 		humanReadableSize(tp.ProcessedSize))
-	fw.uploadToImmich(processedFilePath)
+	if sidecar := tp.sidecarOutput(); sidecar != "" {
+		return fw.uploadWithSidecar(originalFilePath, processedFilePath, sidecar)
+	}
+	return fw.uploadToImmich(originalFilePath, processedFilePath)
+}
+
+// stackBelow stacks the assets uploaded along with the optimized file, the untouched original and the
+// outputs of the task with the stack role, below the optimized asset. Assets that failed to upload are not
+// among assetIDs; a failed upload of the original leaves a copy in the undone directory like any other.
+func (fw *FileWatcher) stackBelow(originalFilePath string, primary AssetUploadResult, assetIDs []string) {
+	if len(assetIDs) == 0 {
+		return
+	}
+
+	if err := fw.immichClient.CreateStack(append([]string{primary.ID}, assetIDs...)...); err != nil {
+		fw.logger.Errorf("Error stacking %d assets below the optimized version of %s: %v", len(assetIDs), originalFilePath, err)
+		return
+	}
+	fw.logger.Printf("Stacked %d assets below the optimized version of %s", len(assetIDs), originalFilePath)
 }
 
 // uploadOriginalFile uploads the original file without optimization
-func (fw *FileWatcher) uploadOriginalFile(filePath string) {
+func (fw *FileWatcher) uploadOriginalFile(filePath string) (AssetUploadResult, bool) {
 	fw.logger.Printf("Original file uploaded (no optimization achieved)")
-	fw.uploadToImmich(filePath)
+	return fw.uploadToImmich(filePath, filePath)
 }
 
-// cleanupOriginalFile removes the original file after successful processing
+// cleanupOriginalFile removes the original file and its sidecar after successful processing
 func (fw *FileWatcher) cleanupOriginalFile(filePath string) {
+	fw.deadLetter().Forget(filePath)
+	sidecarPath := findSidecar(filePath)
+
 	if err := os.Remove(filePath); err != nil {
-		fw.logger.Printf("Error removing file %s after upload: %v", filePath, err)
+		fw.logger.Errorf("Error removing file %s after upload: %v", filePath, err)
+		return
+	}
+
+	if sidecarPath != "" {
+		if err := os.Remove(sidecarPath); err != nil {
+			fw.logger.Errorf("Error removing sidecar %s after upload: %v", sidecarPath, err)
+		}
 	}
 }
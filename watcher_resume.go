@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const (
+	// pendingBucket is the store bucket holding the files left queued by the last shutdown
+	pendingBucket = "pending"
+	pendingKey    = "watcher"
+)
+
+// pendingState is what the watcher was working on when it stopped
+type pendingState struct {
+	// Files were being processed or waiting in the queue, in the order they are resumed in
+	Files []string `json:"files"`
+	// Deferred files were waiting for their active hours or a retry
+	Deferred map[string]pendingDeferral `json:"deferred,omitempty"`
+	// Attempts counts the failed attempts of files not dead-lettered yet
+	Attempts map[string]int `json:"attempts,omitempty"`
+	SavedAt  time.Time      `json:"saved_at"`
+}
+
+type pendingDeferral struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// savePending stores the files left queued in the store, so the next start resumes them in the same order
+// rather than in the order the initial scan finds them, and keeps deferred files waiting until they are due
+func (fw *FileWatcher) savePending(files []string, deferred map[string]pendingDeferral) {
+	if fw.appConfig == nil || fw.appConfig.Store == nil {
+		return
+	}
+
+	state := pendingState{
+		Files:    files,
+		Deferred: deferred,
+		Attempts: fw.deadLetter().Attempts(),
+		SavedAt:  time.Now(),
+	}
+	if len(state.Files) == 0 && len(state.Deferred) == 0 && len(state.Attempts) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = fw.appConfig.Store.Put(pendingBucket, pendingKey, data)
+	}
+	if err != nil {
+		fw.logger.Errorf("Error saving the queued files: %v", err)
+		return
+	}
+	fw.logger.Printf("Saved %d queued and %d deferred files to resume on the next start", len(state.Files), len(state.Deferred))
+}
+
+// resumePending queues the files saved by the last shutdown again, files that no longer exist are skipped
+func (fw *FileWatcher) resumePending() {
+	if fw.appConfig.Store == nil {
+		return
+	}
+
+	data, ok, err := fw.appConfig.Store.Get(pendingBucket, pendingKey)
+	if err != nil {
+		fw.logger.Errorf("Error reading the files queued before the last shutdown: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := fw.appConfig.Store.Delete(pendingBucket, pendingKey); err != nil {
+		fw.logger.Errorf("Error removing the files queued before the last shutdown: %v", err)
+	}
+
+	var state pendingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fw.logger.Errorf("Ignoring invalid files queued before the last shutdown: %v", err)
+		return
+	}
+
+	fw.logger.Printf("Resuming %d queued and %d deferred files saved on %s", len(state.Files), len(state.Deferred), state.SavedAt.Format(time.DateTime))
+	fw.deadLetter().Restore(state.Attempts)
+	for filePath, deferral := range state.Deferred {
+		if fileExists(filePath) {
+			fw.deferFile(filePath, deferral.At, deferral.Reason)
+		}
+	}
+	for _, filePath := range state.Files {
+		if fileExists(filePath) {
+			fw.enqueue(filePath)
+		}
+	}
+}
+
+// fileExists reports whether filePath is an existing regular file
+func fileExists(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// deferredFile is a file waiting to be processed again at a later time
+type deferredFile struct {
+	timer  *time.Timer
+	at     time.Time
+	reason string
+}
+
+// deferFile queues a file that cannot be processed now, e.g. because its tasks are all outside their active
+// hours, and processes it again at the given time
+func (fw *FileWatcher) deferFile(filePath string, at time.Time, reason string) {
+	fw.deferredMu.Lock()
+	defer fw.deferredMu.Unlock()
+
+	if _, ok := fw.deferred[filePath]; ok {
+		return
+	}
+
+	fw.logger.Printf("Deferring %s until %s, %s", filePath, at.Format(time.DateTime), reason)
+	fw.jobs().SetResult(filePath, fmt.Sprintf("deferred until %s, %s", at.Format(time.DateTime), reason))
+	timer := time.AfterFunc(time.Until(at), func() {
+		fw.deferredMu.Lock()
+		delete(fw.deferred, filePath)
+		fw.deferredMu.Unlock()
+
+		fw.enqueue(filePath)
+	})
+	fw.deferred[filePath] = &deferredFile{timer: timer, at: at, reason: reason}
+}
+
+// isDeferred reports whether a file waits to be processed at a later time
+func (fw *FileWatcher) isDeferred(filePath string) bool {
+	fw.deferredMu.Lock()
+	defer fw.deferredMu.Unlock()
+
+	_, ok := fw.deferred[filePath]
+	return ok
+}
+
+// stopDeferred drops the queued files and returns when each was due, they are picked up again by the
+// initial scan on the next start
+func (fw *FileWatcher) stopDeferred() map[string]pendingDeferral {
+	fw.deferredMu.Lock()
+	defer fw.deferredMu.Unlock()
+
+	stopped := make(map[string]pendingDeferral, len(fw.deferred))
+	for filePath, deferred := range fw.deferred {
+		deferred.timer.Stop()
+		stopped[filePath] = pendingDeferral{At: deferred.at, Reason: deferred.reason}
+		delete(fw.deferred, filePath)
+	}
+	return stopped
+}
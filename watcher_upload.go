@@ -1,17 +1,103 @@
 package main
 
-// uploadToImmich uploads a file to the Immich server
-func (fw *FileWatcher) uploadToImmich(uploadFilePath string) {
-	err := fw.immichClient.UploadAsset(uploadFilePath)
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// uploadToImmich uploads a file to the Immich server, returning the created asset and whether it succeeded.
+// uploadFilePath is either the original or its processed version; the sidecar of the original is sent along.
+func (fw *FileWatcher) uploadToImmich(originalFilePath, uploadFilePath string) (AssetUploadResult, bool) {
+	return fw.uploadWithSidecar(originalFilePath, uploadFilePath, findSidecar(originalFilePath))
+}
+
+// uploadWithSidecar uploads a file like uploadToImmich, with the sidecar at sidecarPath unless it is empty
+func (fw *FileWatcher) uploadWithSidecar(originalFilePath, uploadFilePath, sidecarPath string) (AssetUploadResult, bool) {
+	fw.jobs().SetState(originalFilePath, JobUploading)
+
+	// Uploads are not interrupted on shutdown, so waiting for one to finish is not either
+	if fw.appConfig != nil && fw.appConfig.Uploads != nil {
+		release, _ := fw.appConfig.Uploads.Acquire(context.Background(), false)
+		defer release()
+	}
+
+	filename := fw.config().uploadFilename(originalFilePath, uploadFilePath)
+	asset, err := fw.immichClient.UploadAssetWithProgress(uploadFilePath, filename, sidecarPath, func(percent float64, eta time.Duration) {
+		fw.jobs().SetProgress(originalFilePath, percent, eta)
+	})
+	if err != nil {
+		fw.handleUploadError(originalFilePath, err)
+		return asset, false
+	}
+
+	// The first upload is the primary asset, a stacked original uploaded next does not replace it
+	fw.jobs().Update(originalFilePath, func(job *Job) {
+		if job.AssetID != "" {
+			return
+		}
+		job.AssetID = asset.ID
+		job.User = fw.immichClient.UserLabel()
+		job.UploadedSize = asset.Size
+		switch {
+		case asset.Duplicate():
+			job.Result = "duplicate of an existing asset"
+		case uploadFilePath != originalFilePath:
+			job.Result = "uploaded optimized file"
+			job.SavedBytes = job.OriginalSize - asset.Size
+		default:
+			job.Result = "uploaded original"
+		}
+	})
+
+	if uploadFilePath != originalFilePath && !asset.Duplicate() && fw.appConfig != nil {
+		fw.appConfig.Verifier.RecordReplacement(originalFilePath, asset)
+	}
+	return asset, true
+}
+
+// uploadExtraOutput uploads a file a task wrote besides the optimized file as an asset of its own. A failed
+// upload is logged only, the original is already in Immich in optimized form.
+func (fw *FileWatcher) uploadExtraOutput(originalFilePath string, output ExtraOutput) (AssetUploadResult, bool) {
+	if fw.appConfig != nil && fw.appConfig.Uploads != nil {
+		release, _ := fw.appConfig.Uploads.Acquire(context.Background(), false)
+		defer release()
+	}
+
+	asset, err := fw.immichClient.UploadAsset(output.Path, output.Filename, "")
 	if err != nil {
-		fw.handleUploadError(uploadFilePath, err)
+		fw.logger.Errorf("Error uploading %s, written by the task for %s, to Immich: %v", output.Filename, originalFilePath, err)
+		return asset, false
 	}
+	return asset, true
 }
 
-// handleUploadError handles errors that occur during file upload
+// handleUploadError handles errors that occur during file upload by keeping a copy of the original
 func (fw *FileWatcher) handleUploadError(filePath string, err error) {
-	fw.logger.Printf("Error uploading file %s to Immich: %v", filePath, err)
-	if copyErr := copyFileToUndone(filePath, fw.watchDir, fw.appConfig.UndoneDir); copyErr != nil {
-		fw.logger.Printf("Error copying file %s to undone directory: %v", filePath, copyErr)
+	fw.logger.Errorf("Error uploading file %s to Immich: %v", filePath, err)
+	fw.jobs().SetError(filePath, err)
+	if copyErr := fw.copyToUndone(filePath, MessageUploadFailed, err); copyErr != nil {
+		fw.logger.Errorf("Error copying file %s to undone directory: %v", filePath, copyErr)
+	}
+}
+
+// recordUpload records a successful upload in the hash database and the per-user statistics, and stacks
+// RAW and JPEG pairs once both are uploaded
+func (fw *FileWatcher) recordUpload(hashes FileHashes, originalFilePath string, asset AssetUploadResult) {
+	fw.recordUploadedHash(hashes, originalFilePath, asset)
+	fw.recordUploadedContent(hashes, originalFilePath)
+	fw.stackRawPair(originalFilePath, asset)
+
+	// A duplicate is still recorded above, so the original maps to the existing asset, but it stored
+	// and saved nothing
+	if fw.appConfig == nil || asset.Duplicate() {
+		return
+	}
+
+	originalInfo, err := os.Stat(originalFilePath)
+	if err != nil {
+		return
 	}
-}
\ No newline at end of file
+
+	fw.appConfig.Stats.RecordUpload(fw.immichClient.UserLabel(), originalInfo.Size(), asset.Size)
+}
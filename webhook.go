@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookEvents maps the job states reported to the webhook to their event names
+var webhookEvents = map[JobState]string{
+	JobProcessing: "job.started",
+	JobDone:       "job.completed",
+	JobFailed:     "job.failed",
+	JobCancelled:  "job.cancelled",
+}
+
+// WebhookPayload is the JSON body posted for every job event
+type WebhookPayload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Job   Job       `json:"job"`
+}
+
+// webhookQueueLimit is the number of events waiting for delivery beyond which further events are dropped,
+// so an unreachable endpoint cannot take all the memory
+const webhookQueueLimit = 10000
+
+// Webhook posts job lifecycle events to a URL, so the optimizer can be wired into home automation or
+// alerting without scraping logs. The events are taken from the job registry as they happen and queued,
+// then delivered one at a time in the background; failed deliveries are logged and not retried.
+type Webhook struct {
+	url         string
+	client      *http.Client
+	logger      *customLogger
+	mu          sync.Mutex
+	wake        *sync.Cond
+	queue       []WebhookPayload
+	dropped     int
+	stopped     bool
+	unsubscribe func()
+	done        chan struct{}
+}
+
+func NewWebhook(url string, jobs *JobRegistry, logger *customLogger) *Webhook {
+	wh := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	wh.wake = sync.NewCond(&wh.mu)
+	wh.unsubscribe = jobs.Observe(wh.enqueue)
+	return wh
+}
+
+// enqueue queues the lifecycle events, progress updates are not reported
+func (wh *Webhook) enqueue(event JobEvent) {
+	name, ok := webhookEvents[event.Job.State]
+	if !ok || event.Type != JobEventState {
+		return
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.stopped {
+		return
+	}
+	if len(wh.queue) >= webhookQueueLimit {
+		wh.dropped++
+		return
+	}
+	wh.queue = append(wh.queue, WebhookPayload{Event: name, Time: event.Time, Job: event.Job})
+	wh.wake.Signal()
+}
+
+// next waits for the next event to deliver, reporting false once stopped
+func (wh *Webhook) next() (WebhookPayload, bool) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for len(wh.queue) == 0 && !wh.stopped {
+		wh.wake.Wait()
+	}
+	if dropped := wh.dropped; dropped > 0 {
+		wh.dropped = 0
+		wh.logger.Errorf("Dropped %d events, more than %d were waiting for delivery", dropped, webhookQueueLimit)
+	}
+	if wh.stopped {
+		return WebhookPayload{}, false
+	}
+	payload := wh.queue[0]
+	wh.queue[0] = WebhookPayload{}
+	wh.queue = wh.queue[1:]
+	return payload, true
+}
+
+// Start delivers events in the background until Stop
+func (wh *Webhook) Start() {
+	go func() {
+		defer close(wh.done)
+
+		for {
+			payload, ok := wh.next()
+			if !ok {
+				return
+			}
+			if err := wh.post(payload); err != nil {
+				wh.logger.Errorf("Error delivering %s event of job %s to webhook: %v", payload.Event, payload.Job.ID, err)
+			}
+		}
+	}()
+}
+
+// Stop ends the observation and waits for the event being delivered, the events still queued are dropped
+func (wh *Webhook) Stop() {
+	wh.unsubscribe()
+	wh.mu.Lock()
+	wh.stopped = true
+	if len(wh.queue) > 0 {
+		wh.logger.Printf("Dropping %d undelivered events on shutdown", len(wh.queue))
+	}
+	wh.queue = nil
+	wh.wake.Broadcast()
+	wh.mu.Unlock()
+	<-wh.done
+}
+
+func (wh *Webhook) post(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "immich-optimizer/"+version)
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliversEveryLifecycleEvent(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received[payload.Event]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	r := NewJobRegistry()
+	wh := NewWebhook(server.URL, r, newCustomLogger(log.New(io.Discard, "", 0), ""))
+	wh.Start()
+	defer wh.Stop()
+
+	// Many more events than a subscriber may fall behind by, while the first ones are being delivered
+	const files = 2 * jobEventBuffer
+	for i := range files {
+		path := fmt.Sprintf("/watch/%d.jpg", i)
+		r.Start(context.Background(), path)
+		r.SetState(path, JobProcessing)
+		r.SetProgress(path, 50, time.Second)
+		r.Finish(path)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		started, completed := received["job.started"], received["job.completed"]
+		mu.Unlock()
+		if started == files && completed == files {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d started and %d completed events, want %d each", started, completed, files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
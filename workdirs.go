@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// workDirGCInterval is how often the temp folder is scanned for leftovers
+	workDirGCInterval = 5 * time.Minute
+	// workDirGracePeriod protects folders that were just created but not tracked yet
+	workDirGracePeriod = 10 * time.Minute
+)
+
+// workDirPatterns match the temp folders created by the optimizer
+var workDirPatterns = []string{"processing-*", "test-task-*"}
+
+// WorkDirUsage is a gauge of the disk used by work folders in the temp directory
+type WorkDirUsage struct {
+	Bytes        int64 `json:"bytes"`
+	WorkDirs     int   `json:"work_dirs"`
+	ActiveDirs   int   `json:"active_dirs"`
+	RemovedTotal int64 `json:"removed_total"`
+}
+
+// WorkDirGC removes work folders left behind by crashed or killed runs and measures temp usage.
+// Folders registered with Track belong to running jobs and are never removed.
+// A nil *WorkDirGC tracks nothing.
+type WorkDirGC struct {
+	dir    string
+	logger *customLogger
+	stop   chan struct{}
+
+	mu      sync.Mutex
+	active  map[string]struct{}
+	usage   WorkDirUsage
+	stopped bool
+}
+
+func NewWorkDirGC(dir string, logger *customLogger) *WorkDirGC {
+	return &WorkDirGC{
+		dir:    dir,
+		logger: logger,
+		stop:   make(chan struct{}),
+		active: make(map[string]struct{}),
+	}
+}
+
+// Start runs a first collection immediately and then keeps collecting in the background
+func (gc *WorkDirGC) Start() {
+	gc.Collect()
+
+	go func() {
+		ticker := time.NewTicker(workDirGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				gc.Collect()
+			case <-gc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends background collection
+func (gc *WorkDirGC) Stop() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if !gc.stopped {
+		close(gc.stop)
+		gc.stopped = true
+	}
+}
+
+// Track marks a work folder as in use by a running job
+func (gc *WorkDirGC) Track(path string) {
+	if gc == nil {
+		return
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.active[path] = struct{}{}
+}
+
+// Untrack releases a work folder once its job has cleaned it up
+func (gc *WorkDirGC) Untrack(path string) {
+	if gc == nil {
+		return
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	delete(gc.active, path)
+}
+
+// Usage returns the gauges measured during the last collection
+func (gc *WorkDirGC) Usage() WorkDirUsage {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	usage := gc.usage
+	usage.ActiveDirs = len(gc.active)
+	return usage
+}
+
+// Collect removes stale untracked work folders and refreshes the usage gauges
+func (gc *WorkDirGC) Collect() {
+	var dirs []string
+	for _, pattern := range workDirPatterns {
+		matches, err := filepath.Glob(filepath.Join(gc.dir, pattern))
+		if err != nil {
+			gc.logger.Errorf("Error listing work folders: %v", err)
+			return
+		}
+		dirs = append(dirs, matches...)
+	}
+
+	var usage WorkDirUsage
+	var removed int64
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		if gc.isStale(dir, info) {
+			if err := os.RemoveAll(dir); err != nil {
+				gc.logger.Errorf("Error removing stale work folder %s: %v", dir, err)
+			} else {
+				gc.logger.Printf("Removed stale work folder %s", dir)
+				removed++
+				continue
+			}
+		}
+
+		usage.WorkDirs++
+		usage.Bytes += directorySize(dir)
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	usage.RemovedTotal = gc.usage.RemovedTotal + removed
+	gc.usage = usage
+}
+
+// isStale reports whether dir is not used by any running job and is past the grace period
+func (gc *WorkDirGC) isStale(dir string, info os.FileInfo) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if _, ok := gc.active[dir]; ok {
+		return false
+	}
+	return time.Since(info.ModTime()) > workDirGracePeriod
+}
+
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}